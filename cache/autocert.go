@@ -0,0 +1,67 @@
+/*
+Package cache adapts flockd tables to well-known cache and store interfaces,
+so that processes on a host can share certificates, tokens, and sessions
+through a flockd directory:
+
+  - AutocertCache implements autocert.Cache for ACME certificates.
+  - TokenSource caches OAuth 2.0 tokens from an oauth2.TokenSource.
+  - SessionStore implements sessions.Store for HTTP sessions.
+
+Certificates, tokens, and sessions are secrets. Configure their tables with
+Encrypt to protect them at rest.
+
+Package cache is a separate module, so that programs that use flockd alone
+don't depend on the modules it adapts.
+*/
+package cache
+
+import (
+	"context"
+	"os"
+
+	"github.com/iovation/flockd"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var _ autocert.Cache = (*AutocertCache)(nil)
+
+// AutocertCache implements autocert.Cache on a table, so that several
+// processes can share certificates and ACME account keys rather than each
+// requesting its own.
+type AutocertCache struct {
+	table *flockd.Table
+}
+
+// NewAutocertCache creates an AutocertCache that stores data in table.
+func NewAutocertCache(table *flockd.Table) *AutocertCache {
+	return &AutocertCache{table: table}
+}
+
+// Get returns the data for name, or autocert.ErrCacheMiss if it does not exist.
+func (c *AutocertCache) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := c.table.Get(name)
+	if os.IsNotExist(err) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+// Put stores data for name.
+func (c *AutocertCache) Put(ctx context.Context, name string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.table.Set(name, data)
+}
+
+// Delete removes the data for name. It returns no error if name does not
+// exist.
+func (c *AutocertCache) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.table.Delete(name)
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/iovation/flockd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// testTable creates a database in a temporary directory and returns a table
+// in it.
+func testTable(t *testing.T, name string) *flockd.Table {
+	dir, err := ioutil.TempDir("", "flockd-cache")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := flockd.New(dir, time.Second)
+	if err != nil {
+		t.Fatal("New", err)
+	}
+	table, err := db.Table(name)
+	if err != nil {
+		t.Fatal("Table", err)
+	}
+	return table
+}
+
+func TestAutocertCache(t *testing.T) {
+	table := testTable(t, "certs")
+	cache := NewAutocertCache(table)
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err, "Should have cache miss")
+	assert.Nil(t, cache.Delete(ctx, "example.com"), "Should delete missing name")
+
+	assert.Nil(t, cache.Put(ctx, "example.com", []byte("cert")), "Should put cert")
+	assert.Nil(t, cache.Put(ctx, "acme_account+key", []byte("key")), "Should put account key")
+	data, err := cache.Get(ctx, "example.com")
+	assert.Nil(t, err, "Should get cert")
+	assert.Equal(t, "cert", string(data), "Should have cert")
+
+	// Another cache on the same directory should see the data.
+	other := NewAutocertCache(table)
+	data, err = other.Get(ctx, "acme_account+key")
+	assert.Nil(t, err, "Should get account key from other cache")
+	assert.Equal(t, "key", string(data), "Should have account key")
+	val, err := table.Get("example.com")
+	assert.Nil(t, err, "Should get cert from table")
+	assert.Equal(t, "cert", string(val), "Should have cert in table")
+
+	assert.Nil(t, cache.Delete(ctx, "example.com"), "Should delete cert")
+	_, err = other.Get(ctx, "example.com")
+	assert.Equal(t, autocert.ErrCacheMiss, err, "Should have cache miss after delete")
+
+	// Canceled contexts.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = cache.Get(canceled, "acme_account+key")
+	assert.Equal(t, context.Canceled, err, "Should not get with canceled context")
+	assert.Equal(t, context.Canceled, cache.Put(canceled, "x", nil), "Should not put with canceled context")
+	assert.Equal(t, context.Canceled, cache.Delete(canceled, "x"), "Should not delete with canceled context")
+}
@@ -0,0 +1,20 @@
+module github.com/iovation/flockd/cache
+
+go 1.18
+
+require (
+	github.com/gorilla/securecookie v1.1.1
+	github.com/gorilla/sessions v1.2.1
+	github.com/iovation/flockd v0.0.0-20261018151433-4bb7e9310af5
+	github.com/stretchr/testify v1.2.1
+	golang.org/x/crypto v0.24.0
+	golang.org/x/oauth2 v0.21.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/gofrs/flock v0.7.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+)
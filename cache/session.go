@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"encoding/base32"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/iovation/flockd"
+)
+
+var _ sessions.Store = (*SessionStore)(nil)
+
+// SessionStore implements sessions.Store on a table, like
+// sessions.FilesystemStore, so that several processes can share HTTP sessions.
+// The cookie holds only the session ID, and the table stores the session
+// values, under the session ID, encoded by the Codecs. Deleting a session by
+// saving it with a negative MaxAge deletes its record, but the store does not
+// otherwise remove expired sessions.
+type SessionStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	table   *flockd.Table
+}
+
+// NewSessionStore creates a SessionStore that stores sessions in table. The
+// keyPairs authenticate and optionally encrypt the cookies and session values,
+// just as for sessions.NewFilesystemStore.
+func NewSessionStore(table *flockd.Table, keyPairs ...[]byte) *SessionStore {
+	s := &SessionStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		table: table,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge sets the maximum age, in seconds, of the store's sessions and
+// cookies.
+func (s *SessionStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// Get returns the session for name, from the request registry if it has
+// already been loaded during the request. See sessions.CookieStore.Get.
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session for name, loading its values from the table if the
+// request has a valid session cookie for a session that still exists. Otherwise
+// it returns a new session.
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		// No session yet.
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	data, err := s.table.Get(session.ID)
+	if err != nil {
+		session.ID = ""
+		if os.IsNotExist(err) {
+			// Deleted or never saved, so start over.
+			return session, nil
+		}
+		return session, err
+	}
+	if err := securecookie.DecodeMulti(name, string(data), &session.Values, s.Codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session values in the table and sets the session cookie. If
+// the session MaxAge is negative or zero, it deletes the session record and
+// the cookie.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.table.Delete(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(
+			base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)),
+			"=",
+		)
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	if err := s.table.Set(session.ID, []byte(data)); err != nil {
+		return err
+	}
+	id, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), id, session.Options))
+	return nil
+}
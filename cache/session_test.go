@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionRequest returns a request with the cookies set by res.
+func sessionRequest(res *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range res.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestSessionStore(t *testing.T) {
+	table := testTable(t, "sessions")
+	store := NewSessionStore(table, []byte("hash-key-hash-key-hash-key-12345"))
+
+	// New session.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.Get(req, "sess")
+	assert.Nil(t, err, "Should get new session")
+	assert.True(t, session.IsNew, "Should be new")
+	assert.Empty(t, session.ID, "Should have no ID")
+	session.Values["user"] = "theory"
+	res := httptest.NewRecorder()
+	assert.Nil(t, session.Save(req, res), "Should save session")
+	assert.NotEmpty(t, session.ID, "Should have ID")
+	keys, err := table.Keys()
+	assert.Nil(t, err, "Should list keys")
+	assert.Equal(t, []string{session.ID}, keys, "Should store session under its ID")
+	id := session.ID
+
+	// The cookie should hold only the encoded ID.
+	cookies := res.Result().Cookies()
+	if assert.Len(t, cookies, 1, "Should set cookie") {
+		assert.Equal(t, "sess", cookies[0].Name, "Should have session cookie")
+		assert.NotContains(t, cookies[0].Value, "theory", "Should not store values in cookie")
+		assert.Equal(t, 86400*30, cookies[0].MaxAge, "Should have default max age")
+	}
+
+	// Load the session in another store, as another process would.
+	other := NewSessionStore(table, []byte("hash-key-hash-key-hash-key-12345"))
+	req = sessionRequest(res)
+	session, err = other.Get(req, "sess")
+	assert.Nil(t, err, "Should get existing session")
+	assert.False(t, session.IsNew, "Should not be new")
+	assert.Equal(t, id, session.ID, "Should have ID")
+	assert.Equal(t, "theory", session.Values["user"], "Should have values")
+	again, err := other.Get(req, "sess")
+	assert.Nil(t, err, "Should get session again")
+	assert.True(t, again == session, "Should get session from registry")
+
+	// Update it.
+	session.Values["n"] = 2
+	res = httptest.NewRecorder()
+	assert.Nil(t, sessions.Save(req, res), "Should save sessions")
+	session, err = store.New(sessionRequest(res), "sess")
+	assert.Nil(t, err, "Should load updated session")
+	assert.Equal(t, 2, session.Values["n"], "Should have updated values")
+
+	// A different key cannot decode the cookie.
+	wrong := NewSessionStore(table, []byte("wrong-key-wrong-key-wrong-key-12"))
+	session, err = wrong.New(sessionRequest(res), "sess")
+	assert.NotNil(t, err, "Should fail to decode cookie")
+	assert.True(t, session.IsNew, "Should have new session")
+	assert.Empty(t, session.ID, "Should have no ID")
+
+	// Delete it.
+	req = sessionRequest(res)
+	session, err = store.New(req, "sess")
+	assert.Nil(t, err, "Should load session")
+	session.Options.MaxAge = -1
+	res = httptest.NewRecorder()
+	assert.Nil(t, session.Save(req, res), "Should delete session")
+	keys, err = table.Keys()
+	assert.Nil(t, err, "Should list keys")
+	assert.Empty(t, keys, "Should delete session record")
+	cookies = res.Result().Cookies()
+	if assert.Len(t, cookies, 1, "Should set cookie") {
+		assert.True(t, cookies[0].MaxAge < 0, "Should expire cookie")
+	}
+
+	// The old cookie refers to a deleted session.
+	session, err = store.New(req, "sess")
+	assert.Nil(t, err, "Should have no error for deleted session")
+	assert.True(t, session.IsNew, "Should have new session")
+	assert.Empty(t, session.ID, "Should not reuse ID")
+	assert.Empty(t, session.Values, "Should have no values")
+}
+
+func TestSessionStoreMaxAge(t *testing.T) {
+	table := testTable(t, "sessions")
+	store := NewSessionStore(table, []byte("hash-key-hash-key-hash-key-12345"))
+	store.MaxAge(60)
+	assert.Equal(t, 60, store.Options.MaxAge, "Should set max age")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.New(req, "sess")
+	assert.Nil(t, err, "Should get new session")
+	assert.Equal(t, 60, session.Options.MaxAge, "Should have max age")
+	res := httptest.NewRecorder()
+	assert.Nil(t, session.Save(req, res), "Should save session")
+	cookies := res.Result().Cookies()
+	if assert.Len(t, cookies, 1, "Should set cookie") {
+		assert.Equal(t, 60, cookies[0].MaxAge, "Should have max age")
+	}
+}
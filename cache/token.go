@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/iovation/flockd"
+	"golang.org/x/oauth2"
+)
+
+// TokenSource returns an oauth2.TokenSource that caches the tokens returned by
+// src in table under key, so that several processes can share a token rather
+// than each fetching its own. Its Token method returns the cached token while
+// it is valid, and otherwise fetches a new one from src and caches it. If
+// another process caches a new token at the same time, Token returns that token
+// instead, so that all processes settle on the same token.
+//
+// Token reads the cache on every call. Wrap the TokenSource with
+// oauth2.ReuseTokenSource to keep the token in memory until it expires.
+func TokenSource(table *flockd.Table, key string, src oauth2.TokenSource) oauth2.TokenSource {
+	return &tokenSource{table: table, key: key, src: src}
+}
+
+// tokenSource implements TokenSource.
+type tokenSource struct {
+	table *flockd.Table
+	key   string
+	src   oauth2.TokenSource
+	mu    sync.Mutex
+}
+
+// Token returns the cached token if it is valid, or else a new token from the
+// source.
+func (ts *tokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tok, etag, err := ts.cached()
+	if err != nil {
+		return nil, err
+	}
+	if tok.Valid() {
+		return tok, nil
+	}
+
+	// Fetch a new token and cache it, unless another process has already
+	// replaced the cached token.
+	if tok, err = ts.src.Token(); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if etag == "" {
+			err = ts.table.Create(ts.key, data)
+		} else {
+			_, err = ts.table.SetIfMatch(ts.key, data, etag)
+		}
+		if !os.IsExist(err) && !errors.Is(err, flockd.ErrPrecondition) {
+			break
+		}
+
+		// Another process got there first. Use its token if it is valid, or
+		// else try again to replace it.
+		cur, curTag, err := ts.cached()
+		if err != nil {
+			return nil, err
+		}
+		if cur.Valid() {
+			return cur, nil
+		}
+		etag = curTag
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+// cached returns the cached token and the ETag of its record. Returns a nil
+// token and an empty ETag if there is no cached token, and a nil token with
+// the ETag if the cached token cannot be decoded, so that it will be replaced.
+func (ts *tokenSource) cached() (*oauth2.Token, string, error) {
+	rec, err := ts.table.GetRecord(ts.key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(rec.Value, tok); err != nil {
+		return nil, rec.ETag, nil
+	}
+	return tok, rec.ETag, nil
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+// countingSource returns a new token that expires after ttl for each call to
+// Token, and counts the calls. The access tokens are named for the prefix and
+// the call count.
+type countingSource struct {
+	mu     sync.Mutex
+	prefix string
+	ttl    time.Duration
+	calls  int
+	err    error
+}
+
+func (s *countingSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.calls++
+	return &oauth2.Token{
+		AccessToken:  s.prefix + "-" + strconv.Itoa(s.calls),
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Now().Add(s.ttl),
+	}, nil
+}
+
+func (s *countingSource) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func TestTokenSource(t *testing.T) {
+	table := testTable(t, "tokens")
+	src := &countingSource{prefix: "access", ttl: time.Hour}
+	ts := TokenSource(table, "api", src)
+
+	tok, err := ts.Token()
+	assert.Nil(t, err, "Should get token")
+	assert.Equal(t, "access-1", tok.AccessToken, "Should have first token")
+	assert.Equal(t, 1, src.count(), "Should fetch token")
+
+	// Another process should share the cached token.
+	other := &countingSource{prefix: "access", ttl: time.Hour}
+	tok, err = TokenSource(table, "api", other).Token()
+	assert.Nil(t, err, "Should get token from other source")
+	assert.Equal(t, "access-1", tok.AccessToken, "Should have cached token")
+	assert.Equal(t, "refresh", tok.RefreshToken, "Should have refresh token")
+	assert.True(t, tok.Valid(), "Should have valid token")
+	assert.Equal(t, 0, other.count(), "Should not fetch token")
+
+	// Different keys cache different tokens.
+	tok, err = TokenSource(table, "other", other).Token()
+	assert.Nil(t, err, "Should get token for other key")
+	assert.Equal(t, "access-1", tok.AccessToken, "Should have token from other source")
+	assert.Equal(t, 1, other.count(), "Should fetch token for other key")
+
+	// Corrupt tokens are replaced.
+	assert.Nil(t, table.Set("api", []byte("{")), "Should corrupt token")
+	tok, err = ts.Token()
+	assert.Nil(t, err, "Should get token")
+	assert.Equal(t, "access-2", tok.AccessToken, "Should replace corrupt token")
+
+	// Errors from the source.
+	src.err = errors.New("oops")
+	assert.Nil(t, table.Delete("api"), "Should delete token")
+	_, err = ts.Token()
+	assert.Equal(t, src.err, err, "Should have source error")
+}
+
+func TestTokenSourceExpiry(t *testing.T) {
+	table := testTable(t, "tokens")
+
+	// Tokens that expire within the oauth2 expiry delta are never valid.
+	src := &countingSource{prefix: "access", ttl: time.Second}
+	ts := TokenSource(table, "api", src)
+	for i := 1; i <= 3; i++ {
+		tok, err := ts.Token()
+		assert.Nil(t, err, "Should get token")
+		assert.False(t, tok.Valid(), "Should have expiring token")
+		assert.Equal(t, i, src.count(), "Should fetch token %d", i)
+	}
+
+	// Once a token is refreshed, other processes use it.
+	src.ttl = time.Hour
+	tok, err := ts.Token()
+	assert.Nil(t, err, "Should get token")
+	other := &countingSource{prefix: "access", ttl: time.Hour}
+	cached, err := TokenSource(table, "api", other).Token()
+	assert.Nil(t, err, "Should get cached token")
+	assert.Equal(t, tok.AccessToken, cached.AccessToken, "Should share refreshed token")
+	assert.Equal(t, 0, other.count(), "Should not fetch token")
+}
+
+func TestTokenSourceConcurrent(t *testing.T) {
+	table := testTable(t, "tokens")
+
+	// Several processes racing to fetch a token should settle on one.
+	const workers = 8
+	tokens := make([]string, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src := &countingSource{prefix: "worker" + strconv.Itoa(i), ttl: time.Hour}
+			tok, err := TokenSource(table, "api", src).Token()
+			if assert.Nil(t, err, "Should get token") {
+				tokens[i] = tok.AccessToken
+			}
+		}(i)
+	}
+	wg.Wait()
+	cached, err := TokenSource(table, "api", &countingSource{prefix: "access", ttl: time.Hour}).Token()
+	assert.Nil(t, err, "Should get cached token")
+	assert.Regexp(t, `^worker\d-1$`, cached.AccessToken, "Should have token from a worker")
+	for i, tok := range tokens {
+		assert.Equal(t, cached.AccessToken, tok, "Worker %d should have cached token", i)
+	}
+}
@@ -0,0 +1,420 @@
+package flockd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// changeLogFile is the name of the file in the root directory to which writers
+// append changes when the change log is enabled.
+const changeLogFile = ".flockd.changes"
+
+var (
+	// ErrNoChangeLog is returned by Changes when the change log is not
+	// enabled.
+	ErrNoChangeLog = errors.New("flockd: change log not enabled")
+
+	// ErrTrimmed is returned by Changes when TrimChanges has removed changes
+	// after the requested sequence number. A consumer that gets it has missed
+	// changes, and must start over from a Dump or Snapshot of the database.
+	ErrTrimmed = errors.New("flockd: changes trimmed from change log")
+
+	// ErrNotLogged is returned, wrapped with the underlying error, by a write or
+	// delete that committed but could not append its change to the change log.
+	// The write is not undone, but consumers of the log will not see it.
+	ErrNotLogged = errors.New("flockd: change committed but not logged")
+)
+
+// Op identifies the kind of change recorded in the change log.
+type Op string
+
+const (
+	// OpSet records that a record was written by Set, Create, Update, or any
+	// other method that writes a value.
+	OpSet Op = "set"
+
+	// OpDelete records that a record was deleted.
+	OpDelete Op = "delete"
+)
+
+// Change describes a change recorded in the change log.
+type Change struct {
+	// Seq is the sequence number of the change. Sequence numbers start at one
+	// and increase by one with each change.
+	Seq uint64 `json:"seq"`
+
+	// Table is the name of the table, with forward slashes separating nested
+	// table names. The root table is named "".
+	Table string `json:"table"`
+
+	// Key is the key of the record that changed.
+	Key string `json:"key"`
+
+	// Op identifies the kind of change.
+	Op Op `json:"op"`
+
+	// Time is the time of the change.
+	Time time.Time `json:"time"`
+}
+
+// WithChangeLog enables the change log, creating the change log file in the
+// root directory if it does not exist. Once the file exists, New enables the
+// change log for the database even without this option, so that every process
+// writing to the database appends to it. Every write and delete appends a
+// Change to the log, while holding the exclusive lock on the record file, so
+// that changes to a record appear in the order they were made. It locks the log
+// before committing, so that a write that cannot log fails without changing
+// anything, and returns ErrNotLogged if the append fails after all. Table
+// configurations and internal maintenance, such as Compact and PurgeTrash, are
+// not logged. The log grows with every change; use TrimChanges to remove
+// changes that every consumer has read.
+func WithChangeLog() Option {
+	return func(db *DB) {
+		db.changeLog = true
+	}
+}
+
+// initChangeLog creates the change log file if the change log is enabled, or
+// enables the change log if the file exists.
+func (db *DB) initChangeLog() error {
+	file := filepath.Join(db.root.path, changeLogFile)
+	if _, err := os.Stat(file); err == nil {
+		db.changeLog = true
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if !db.changeLog || db.readOnly {
+		db.changeLog = false
+		return nil
+	}
+	fh, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return fh.Close()
+}
+
+// logChange calls commit to make a change to the record for key and, if the
+// change log is enabled, appends the change to it. It first acquires an
+// exclusive lock on the change log file, waiting up to the timeout set for the
+// database, so that it fails before calling commit if it cannot log the change,
+// and holds it to assign the next sequence number. Returns ErrNotLogged,
+// wrapped with the error, if commit succeeded but the append failed. The caller
+// must hold an exclusive lock on the record file.
+func (table *Table) logChange(key string, op Op, commit func() error) error {
+	db := table.db
+	if !db.changeLog {
+		return commit()
+	}
+	fh, unlock, err := db.openChangeLog(true)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	defer unlock()
+
+	// Remove an incomplete last line left by an interrupted write, so that
+	// the new change starts on a line of its own.
+	seq, end, err := lastSeq(fh)
+	if err != nil {
+		return err
+	}
+	if info, err := fh.Stat(); err != nil {
+		return err
+	} else if info.Size() > end {
+		if err := fh.Truncate(end); err != nil {
+			return err
+		}
+	}
+
+	if err := commit(); err != nil {
+		return err
+	}
+	if err := appendChange(fh, Change{
+		Seq:   seq + 1,
+		Table: filepath.ToSlash(table.name),
+		Key:   key,
+		Op:    op,
+		Time:  time.Now().UTC(),
+	}); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotLogged, err)
+	}
+	return nil
+}
+
+// appendChange writes c as a line at the end of the change log file and syncs
+// it to disk.
+func appendChange(fh *os.File, c Change) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return fh.Sync()
+}
+
+// openChangeLog opens the change log file and locks it, waiting up to the
+// timeout set for the database, with an exclusive lock for appending or a
+// shared lock for reading. Because TrimChanges replaces the file, it then makes
+// sure that the file it locked is still the change log, and tries again if not.
+// Returns the file and a function that releases the lock.
+func (db *DB) openChangeLog(exclusive bool) (*os.File, func(), error) {
+	file := filepath.Join(db.root.path, changeLogFile)
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_APPEND
+	}
+	deadline := time.Now().Add(db.root.timeout)
+	for {
+		fh, err := os.OpenFile(file, flag, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		unlock, err := lockOpen(fh, exclusive, time.Until(deadline))
+		if err != nil {
+			fh.Close()
+			return nil, nil, err
+		}
+		info, err := fh.Stat()
+		if err != nil {
+			unlock()
+			fh.Close()
+			return nil, nil, err
+		}
+		if cur, err := os.Stat(file); err == nil && os.SameFile(info, cur) {
+			return fh, unlock, nil
+		}
+		unlock()
+		fh.Close()
+	}
+}
+
+// lastSeq returns the sequence number of the last complete change in the
+// change log file, or zero if it has none, and the offset of the end of its
+// line. It reads backward from the end of the file until it finds the start of
+// the last line.
+func lastSeq(fh *os.File) (uint64, int64, error) {
+	var seq uint64
+	var end int64
+	err := scanBack(fh, func(c Change, off int64) bool {
+		seq, end = c.Seq, off
+		return false
+	})
+	return seq, end, err
+}
+
+// seekAfter returns the offset of the line for the first change in the change
+// log file with a sequence number greater than after, or the offset of the end
+// of the last complete line if there is none. It reads backward from the end of
+// the file, so that reading recent changes does not require reading the whole
+// log.
+func seekAfter(fh *os.File, after uint64) (int64, error) {
+	var pos int64
+	err := scanBack(fh, func(c Change, off int64) bool {
+		if c.Seq <= after {
+			pos = off
+			return false
+		}
+		return true
+	})
+	return pos, err
+}
+
+// scanBack calls fn for each complete line in the change log file, from the
+// last to the first, with the change it records and the offset of the end of
+// its line, until fn returns false. It reads the file backward from the end,
+// in chunks of doubling size, ignoring an incomplete last line.
+func scanBack(fh *os.File, fn func(c Change, end int64) bool) error {
+	info, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	done := size // start of the earliest line already passed to fn
+	for n := int64(4096); ; n *= 2 {
+		off := size - n
+		if off < 0 {
+			off = 0
+		}
+		buf := make([]byte, done-off)
+		if _, err := fh.ReadAt(buf, off); err != nil && err != io.EOF {
+			return err
+		}
+
+		// Ignore an incomplete last line.
+		end := bytes.LastIndexByte(buf, '\n')
+		if done < size {
+			end = len(buf) - 1
+		}
+		for end >= 0 {
+			start := bytes.LastIndexByte(buf[:end], '\n') + 1
+			if start == 0 && off > 0 {
+				// The line may start before this chunk.
+				break
+			}
+			var c Change
+			if err := json.Unmarshal(buf[start:end], &c); err != nil {
+				return err
+			}
+			if !fn(c, off+int64(end)+1) {
+				return nil
+			}
+			done = off + int64(start)
+			end = start - 1
+		}
+		if off == 0 {
+			return nil
+		}
+	}
+}
+
+// Changes returns up to limit changes from the change log with sequence
+// numbers greater than after, in order. Pass a limit less than one for no
+// limit. It reads the log with a shared lock on the change log file, waiting up
+// to the timeout set for the database. It reads backward from the end of the
+// log to find the first change after after, so the time it takes depends on the
+// number of changes after after, not on the size of the log. Returns
+// ErrTrimmed if TrimChanges has removed the change after after, and
+// ErrNoChangeLog if the change log is not enabled.
+func (db *DB) Changes(after uint64, limit int) ([]Change, error) {
+	if !db.changeLog {
+		return nil, ErrNoChangeLog
+	}
+	fh, unlock, err := db.openChangeLog(false)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	defer unlock()
+
+	pos, err := seekAfter(fh, after)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fh.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	r := bufio.NewReader(fh)
+	for limit < 1 || len(changes) < limit {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// Ignore an incomplete last line.
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		var c Change
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, err
+		}
+		if c.Seq <= after {
+			continue
+		}
+		if len(changes) == 0 && c.Seq > after+1 {
+			return nil, ErrTrimmed
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// TrimChanges removes the changes with sequence numbers up to and including
+// through from the change log, so that it does not grow without bound. Call it
+// once every consumer of the log, such as a Replicator, has read those changes;
+// Changes returns ErrTrimmed to a consumer that has not. It always keeps the
+// last change, so that sequence numbers continue from it. It acquires an
+// exclusive lock on the change log file, waiting up to the timeout set for the
+// database, and replaces the file with a new one containing the remaining
+// changes. Returns the number of changes removed, and ErrNoChangeLog if the
+// change log is not enabled.
+func (db *DB) TrimChanges(through uint64) (int, error) {
+	if !db.changeLog {
+		return 0, ErrNoChangeLog
+	}
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+	fh, unlock, err := db.openChangeLog(true)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	defer unlock()
+
+	// Find the first change to keep.
+	last, end, err := lastSeq(fh)
+	if err != nil || last == 0 {
+		return 0, err
+	}
+	if through >= last {
+		through = last - 1
+	}
+	pos, err := seekAfter(fh, through)
+	if err != nil {
+		return 0, err
+	}
+	if pos == 0 {
+		return 0, nil
+	}
+
+	// Count the changes to remove.
+	n := 0
+	r := bufio.NewReader(io.NewSectionReader(fh, 0, pos))
+	for {
+		if _, err := r.ReadBytes('\n'); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		n++
+	}
+
+	// Replace the file with the rest, leaving out an incomplete last line.
+	data := make([]byte, end-pos)
+	if _, err := fh.ReadAt(data, pos); err != nil && err != io.EOF {
+		return 0, err
+	}
+	tmp, err := writeTemp(db.root.path, changeLogFile, data, db.root.timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer tmp.Release()
+	if err := os.Rename(tmp.file, filepath.Join(db.root.path, changeLogFile)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Fetch returns the value and metadata of the record for key in the table with
+// the name, with forward slashes separating nested table names, as they would
+// be written by Dump. Returns os.ErrNotExist if the table or record does not
+// exist, and os.ErrInvalid if the table name would escape the database
+// directory. Fetch allows a DB to serve as the ChangeSource for a Replicator.
+func (db *DB) Fetch(table, key string) ([]byte, *Meta, error) {
+	tbl, err := db.findTable(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, meta, err := tbl.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta != nil {
+		meta.Checksum, meta.Encoding, meta.KeyID = "", "", ""
+	}
+	return val, meta, nil
+}
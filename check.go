@@ -0,0 +1,320 @@
+package flockd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// tempPattern matches the names of temporary files created by writeTemp.
+var tempPattern = regexp.MustCompile(
+	`(?:` + regexp.QuoteMeta(recExt) + `|^` + regexp.QuoteMeta(cfgFile) +
+		`|^` + regexp.QuoteMeta(replicaFile) + `|^` + regexp.QuoteMeta(changeLogFile) + `)\d+$`,
+)
+
+// internalDirs lists the names of subdirectories of table directories that
+// flockd manages internally.
+var internalDirs = map[string]bool{
+	quarantineDir: true,
+	historyDir:    true,
+	trashDir:      true,
+	locksDir:      true,
+	sumsDir:       true,
+}
+
+// rootFiles lists the names of files in the root directory that flockd manages
+// internally.
+var rootFiles = map[string]bool{
+	dbLockFile:    true,
+	snapshotFile:  true,
+	changeLogFile: true,
+	replicaFile:   true,
+}
+
+// ProblemKind identifies the kind of a Problem found by Check.
+type ProblemKind string
+
+const (
+	// TempFile indicates a temporary file left behind by an interrupted write.
+	TempFile ProblemKind = "temp-file"
+
+	// EmptyRecord indicates a zero-byte record file, which might have been
+	// left behind by an interrupted Create. In a table that does not use
+	// envelopes, it might also be a legitimately empty value.
+	EmptyRecord ProblemKind = "empty-record"
+
+	// DirRecord indicates a directory named like a record file.
+	DirRecord ProblemKind = "dir-record"
+
+	// Unreadable indicates a file or directory that cannot be read.
+	Unreadable ProblemKind = "unreadable"
+
+	// Permissions indicates a file without owner read and write permission, or
+	// a directory without owner read, write, and execute permission.
+	Permissions ProblemKind = "permissions"
+
+	// Stray indicates a file not created by flockd.
+	Stray ProblemKind = "stray"
+)
+
+// Problem describes a problem found by Check.
+type Problem struct {
+	// Kind identifies the kind of problem.
+	Kind ProblemKind
+
+	// Path is the path to the file or directory with the problem.
+	Path string
+
+	// Detail describes the problem.
+	Detail string
+
+	// Repaired is true if Check repaired the problem.
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	status := ""
+	if p.Repaired {
+		status = " (repaired)"
+	}
+	return fmt.Sprintf("%v: %v: %v%v", p.Kind, p.Path, p.Detail, status)
+}
+
+// CheckOptions defines the options for Check.
+type CheckOptions struct {
+	// Repair indicates that Check should repair the problems it can repair
+	// safely: it removes unlocked temporary files older than TempAge, removes
+	// empty records from tables that use envelopes and empty directories named
+	// like records, and adds missing owner permissions.
+	Repair bool
+
+	// TempAge is the minimum age of a temporary file for Check to remove it.
+	// Defaults to one minute.
+	TempAge time.Duration
+}
+
+// CheckReport describes the results of Check.
+type CheckReport struct {
+	// Tables is the number of tables checked.
+	Tables int
+
+	// Records is the number of records checked.
+	Records int
+
+	// Problems lists the problems found.
+	Problems []Problem
+}
+
+// Unrepaired returns the number of problems Check did not repair.
+func (r *CheckReport) Unrepaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Check walks the database directory to check its integrity. It reports
+// temporary files left behind by interrupted writes, empty records, directories
+// named like records, files and directories that cannot be read or have the
+// wrong permissions, and files not created by flockd. It does not verify record
+// contents; use Scrub for that. Pass CheckOptions with Repair set to repair the
+// problems that can be repaired safely. Check returns an error only if it
+// cannot walk the directory, or ErrReadOnly if asked to repair a read-only
+// database.
+func (db *DB) Check(opts CheckOptions) (*CheckReport, error) {
+	if opts.Repair && db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if opts.TempAge <= 0 {
+		opts.TempAge = time.Minute
+	}
+	c := &checker{db: db, opts: opts, report: &CheckReport{}}
+	if err := filepath.Walk(db.root.path, c.walk); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+type checker struct {
+	db     *DB
+	opts   CheckOptions
+	report *CheckReport
+}
+
+func (c *checker) add(kind ProblemKind, path, detail string, repaired bool) {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Kind:     kind,
+		Path:     path,
+		Detail:   detail,
+		Repaired: repaired,
+	})
+}
+
+// isTableDir returns true if dir is the root directory or a table directory.
+func (c *checker) isTableDir(dir string) bool {
+	return dir == c.db.root.path || filepath.Ext(dir) == tblExt
+}
+
+func (c *checker) walk(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		if path == c.db.root.path {
+			return err
+		}
+		c.add(Unreadable, path, err.Error(), false)
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	inTable := c.isTableDir(filepath.Dir(path))
+	name := info.Name()
+	switch {
+	case info.IsDir():
+		return c.checkDir(path, info, inTable)
+	case !info.Mode().IsRegular():
+		c.add(Stray, path, "not a regular file", false)
+	case !inTable:
+		c.add(Stray, path, "file outside a table directory", false)
+	case filepath.Ext(name) == recExt:
+		c.checkRecord(path, info)
+	case tempPattern.MatchString(name):
+		c.checkTemp(path, info)
+	case name == cfgFile:
+		c.checkPerms(path, info)
+	case filepath.Dir(path) == c.db.root.path && rootFiles[name]:
+		c.checkPerms(path, info)
+	default:
+		c.add(Stray, path, "not a flockd file", false)
+	}
+	return nil
+}
+
+func (c *checker) checkDir(path string, info os.FileInfo, inTable bool) error {
+	if path != c.db.root.path && inTable && internalDirs[info.Name()] {
+		return filepath.SkipDir
+	}
+	if filepath.Ext(path) == recExt {
+		repaired := c.opts.Repair && os.Remove(path) == nil
+		c.add(DirRecord, path, "directory named like a record", repaired)
+		return filepath.SkipDir
+	}
+	if c.isTableDir(path) {
+		c.report.Tables++
+	}
+	if !c.checkPerms(path, info) {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// checkPerms checks that path has owner read and write permission, plus
+// execute permission if it's a directory. Returns false if the permissions
+// remain wrong.
+func (c *checker) checkPerms(path string, info os.FileInfo) bool {
+	want := os.FileMode(0600)
+	if info.IsDir() {
+		want = 0700
+	}
+	mode := info.Mode().Perm()
+	if mode&want == want {
+		return true
+	}
+	repaired := c.opts.Repair && os.Chmod(path, mode|want) == nil
+	c.add(Permissions, path, fmt.Sprintf("mode %v lacks %v", mode, want), repaired)
+	return repaired
+}
+
+func (c *checker) checkRecord(path string, info os.FileInfo) {
+	c.report.Records++
+	if !c.checkPerms(path, info) {
+		return
+	}
+
+	// Make sure we can read it.
+	fh, err := os.Open(path)
+	if err != nil {
+		c.add(Unreadable, path, err.Error(), false)
+		return
+	}
+	fh.Close()
+
+	if info.Size() > 0 {
+		return
+	}
+
+	// Empty records are invalid only in tables that use envelopes.
+	table := c.table(filepath.Dir(path))
+	if table == nil || !table.Config().enveloped() {
+		c.add(EmptyRecord, path, "empty record; may be an empty value", false)
+		return
+	}
+
+	repaired := c.opts.Repair && c.remove(path, info)
+	c.add(EmptyRecord, path, "empty record in envelope table", repaired)
+}
+
+func (c *checker) checkTemp(path string, info os.FileInfo) {
+	// Don't remove it if it's still being written.
+	repaired := c.opts.Repair && time.Since(info.ModTime()) >= c.opts.TempAge &&
+		c.remove(path, info)
+	c.add(TempFile, path, "temporary file left by an interrupted write", repaired)
+}
+
+// remove removes the file at path, but only if it is still the file described
+// by info, with the same size. It first acquires the database write lock and an
+// exclusive lock on the open file, so that it never removes a file that another
+// process is writing or has replaced since the check found it. Returns true if
+// the file was removed.
+func (c *checker) remove(path string, info os.FileInfo) bool {
+	dbLock, err := c.db.lockWrites()
+	if err != nil {
+		return false
+	}
+	defer dbLock.Unlock()
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	unlock, err := lockOpen(fh, true, c.db.root.timeout)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+
+	// Make sure it's the same file and hasn't changed.
+	locked, err := fh.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(path)
+	if err != nil || !os.SameFile(locked, cur) || !os.SameFile(info, cur) ||
+		cur.Size() != info.Size() {
+		return false
+	}
+	return os.Remove(path) == nil
+}
+
+// table returns the table for the directory, or nil if it cannot be loaded.
+func (c *checker) table(dir string) *Table {
+	if dir == c.db.root.path {
+		return c.db.root
+	}
+	rel, err := filepath.Rel(c.db.root.path, dir)
+	if err != nil {
+		return nil
+	}
+	table, err := c.db.loadTable(strings.TrimSuffix(rel, tblExt), dir)
+	if err != nil {
+		return nil
+	}
+	return table
+}
@@ -0,0 +1,194 @@
+package flockd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestCheckClean() {
+	tbl, err := s.db.Table("clean")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should configure table")
+	for _, key := range []string{"a", "b"} {
+		s.Nil(s.db.Set(key, []byte(key)), "Should set %v", key)
+		s.Nil(tbl.Set(key, []byte(key)), "Should set %v", key)
+	}
+
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Equal(&CheckReport{Tables: 2, Records: 4}, report, "Should have clean report")
+	s.Equal(0, report.Unrepaired(), "Should have no unrepaired problems")
+}
+
+func (s *TS) TestCheckProblems() {
+	root := s.db.root.path
+	tbl, err := s.db.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should configure table")
+
+	write := func(path string, data string, mode os.FileMode) {
+		if err := ioutil.WriteFile(path, []byte(data), mode); err != nil {
+			s.T().Fatal("WriteFile", err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			s.T().Fatal("Chmod", err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+
+	// Temporary files, old and new.
+	oldTemp := filepath.Join(root, "foo"+recExt+"12345")
+	newTemp := filepath.Join(tbl.path, "foo"+recExt+"67890")
+	write(oldTemp, "hi", 0600)
+	write(newTemp, "hi", 0600)
+	if err := os.Chtimes(oldTemp, old, old); err != nil {
+		s.T().Fatal("Chtimes", err)
+	}
+
+	// Empty records in raw and envelope tables.
+	rawEmpty := filepath.Join(root, "empty"+recExt)
+	envEmpty := filepath.Join(tbl.path, "empty"+recExt)
+	write(rawEmpty, "", 0600)
+	write(envEmpty, "", 0600)
+
+	// A directory record.
+	dirRec := filepath.Join(tbl.path, "dir"+recExt)
+	if err := os.Mkdir(dirRec, 0755); err != nil {
+		s.T().Fatal("Mkdir", err)
+	}
+
+	// Bad permissions.
+	badPerms := filepath.Join(root, "perms"+recExt)
+	write(badPerms, "hi", 0400)
+
+	// Stray files.
+	stray := filepath.Join(tbl.path, "README.txt")
+	write(stray, "hi", 0644)
+	other := filepath.Join(root, "other", "file"+recExt)
+	if err := os.MkdirAll(filepath.Dir(other), 0755); err != nil {
+		s.T().Fatal("MkdirAll", err)
+	}
+	write(other, "hi", 0644)
+
+	// Quarantined files should be ignored.
+	qdir := filepath.Join(tbl.path, quarantineDir)
+	if err := os.MkdirAll(qdir, 0755); err != nil {
+		s.T().Fatal("MkdirAll", err)
+	}
+	write(filepath.Join(qdir, "x"+recExt+".1234"), "hi", 0600)
+
+	// Check without repair.
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Equal(2, report.Tables, "Should have checked two tables")
+	s.Equal(3, report.Records, "Should have checked three records")
+	s.ElementsMatch([]ProblemKind{
+		TempFile, TempFile, EmptyRecord, EmptyRecord, DirRecord,
+		Permissions, Stray, Stray,
+	}, kinds(report.Problems), "Should have all the problems")
+	s.Equal(len(report.Problems), report.Unrepaired(), "Should have repaired nothing")
+	s.FileExists(oldTemp, "Should not have removed temp file")
+
+	// Now repair.
+	report, err = s.db.Check(CheckOptions{Repair: true})
+	s.Nil(err, "Should have no error from Check")
+	repaired := map[string]bool{}
+	for _, p := range report.Problems {
+		repaired[p.Path] = p.Repaired
+	}
+	s.Equal(map[string]bool{
+		oldTemp:  true,
+		newTemp:  false,
+		rawEmpty: false,
+		envEmpty: true,
+		dirRec:   true,
+		badPerms: true,
+		stray:    false,
+		other:    false,
+	}, repaired, "Should have repaired safe problems")
+	s.fileNotExists(oldTemp)
+	s.fileNotExists(envEmpty)
+	s.fileNotExists(dirRec)
+	s.FileExists(newTemp, "Should have kept new temp file")
+	s.FileExists(rawEmpty, "Should have kept raw empty record")
+	if info, err := os.Stat(badPerms); s.Nil(err, "Should stat %v", badPerms) {
+		s.Equal(os.FileMode(0600), info.Mode().Perm(), "Should have fixed permissions")
+	}
+
+	// A short temp age should allow removal of the new temp file.
+	report, err = s.db.Check(CheckOptions{Repair: true, TempAge: time.Nanosecond})
+	s.Nil(err, "Should have no error from Check")
+	s.Equal(3, report.Unrepaired(), "Should have three unrepaired problems")
+	s.fileNotExists(newTemp)
+
+	// Should get an error for a nonexistent database directory.
+	s.db.root.path = filepath.Join(root, "nonesuch")
+	report, err = s.db.Check(CheckOptions{})
+	s.Nil(report, "Should have no report")
+	s.NotNil(err, "Should have error for nonexistent directory")
+}
+
+func kinds(problems []Problem) []ProblemKind {
+	kinds := make([]ProblemKind, len(problems))
+	for i, p := range problems {
+		kinds[i] = p.Kind
+	}
+	return kinds
+}
+
+// Repair should only remove a file that hasn't changed since Check found it.
+func (s *TS) TestCheckRemove() {
+	c := &checker{db: s.db, report: &CheckReport{}}
+	path := filepath.Join(s.db.root.path, "empty"+recExt)
+	stat := func() os.FileInfo {
+		info, err := os.Stat(path)
+		if err != nil {
+			s.T().Fatal("Stat", err)
+		}
+		return info
+	}
+
+	// A record written since it was found should be left alone.
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	info := stat()
+	s.Nil(s.db.Set("empty", []byte("full")), "Should set empty")
+	s.False(c.remove(path, info), "Should not remove replaced record")
+	s.FileExists(path, "Should have kept replaced record")
+
+	// So should a file that has grown.
+	tmp := filepath.Join(s.db.root.path, "foo"+recExt+"12345")
+	if err := ioutil.WriteFile(tmp, []byte("hi"), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	path = tmp
+	info = stat()
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		s.T().Fatal("OpenFile", err)
+	}
+	fh.WriteString("there")
+	fh.Close()
+	s.False(c.remove(tmp, info), "Should not remove changed file")
+	s.FileExists(tmp, "Should have kept changed file")
+
+	// But an unchanged file should go.
+	s.True(c.remove(tmp, stat()), "Should remove unchanged file")
+	s.fileNotExists(tmp)
+
+	// Nothing should be removed from a read-only database.
+	if err := ioutil.WriteFile(tmp, nil, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	s.db.readOnly = true
+	s.False(c.remove(tmp, stat()), "Should not remove from read-only database")
+	s.db.readOnly = false
+	s.FileExists(tmp, "Should have kept file")
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iovation/flockd"
+)
+
+func check(e *env, args []string) error {
+	flags := e.newFlags("check")
+	repair := flags.Bool("repair", false, "repair problems that can be repaired safely")
+	tempAge := flags.Duration("temp-age", time.Minute, "minimum age of temporary files to remove")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+
+	report, err := e.db.Check(flockd.CheckOptions{Repair: *repair, TempAge: *tempAge})
+	if err != nil {
+		return err
+	}
+
+	if e.format == "json" {
+		if err := e.printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range report.Problems {
+			fmt.Fprintln(e.stdout, p)
+		}
+		fmt.Fprintf(
+			e.stdout, "%v tables, %v records, %v problems, %v unrepaired\n",
+			report.Tables, report.Records, len(report.Problems), report.Unrepaired(),
+		)
+	}
+
+	if n := report.Unrepaired(); n > 0 {
+		return fmt.Errorf("%v unrepaired problems", n)
+	}
+	return nil
+}
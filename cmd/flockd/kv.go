@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/iovation/flockd"
+)
+
+// record represents a key/value pair in a table for JSON output.
+type record struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// keyArgs parses the -table flag and the key, and optionally the value,
+// from args. If the value is required but not in args, it is read from stdin.
+// Pass create to create the table if it does not exist.
+func (e *env) keyArgs(name string, args []string, withValue, create bool) (*flockd.Table, string, []byte, error) {
+	flags := e.newFlags(name)
+	tblName := flags.String("table", "", "table name")
+	if err := flags.Parse(args); err != nil {
+		return nil, "", nil, errUsage
+	}
+	max := 1
+	if withValue {
+		max = 2
+	}
+	if flags.NArg() < 1 || flags.NArg() > max {
+		return nil, "", nil, errUsage
+	}
+
+	key := flags.Arg(0)
+	var val []byte
+	if withValue {
+		if flags.NArg() == 2 {
+			val = []byte(flags.Arg(1))
+		} else {
+			var err error
+			if val, err = ioutil.ReadAll(e.stdin); err != nil {
+				return nil, "", nil, err
+			}
+		}
+	}
+
+	tbl, err := e.table(*tblName, create)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return tbl, key, val, nil
+}
+
+func get(e *env, args []string) error {
+	tbl, key, _, err := e.keyArgs("get", args, false, false)
+	if err != nil {
+		return err
+	}
+	val, err := tbl.Get(key)
+	if err != nil {
+		return err
+	}
+	if e.format == "json" {
+		return e.printJSON(record{Table: tbl.Name(), Key: key, Value: val})
+	}
+	_, err = e.stdout.Write(val)
+	return err
+}
+
+func set(e *env, args []string) error {
+	tbl, key, val, err := e.keyArgs("set", args, true, true)
+	if err != nil {
+		return err
+	}
+	return tbl.Set(key, val)
+}
+
+func create(e *env, args []string) error {
+	tbl, key, val, err := e.keyArgs("create", args, true, true)
+	if err != nil {
+		return err
+	}
+	return tbl.Create(key, val)
+}
+
+func update(e *env, args []string) error {
+	tbl, key, val, err := e.keyArgs("update", args, true, false)
+	if err != nil {
+		return err
+	}
+	return tbl.Update(key, val)
+}
+
+func del(e *env, args []string) error {
+	tbl, key, _, err := e.keyArgs("delete", args, false, false)
+	if err != nil {
+		return err
+	}
+	return tbl.Delete(key)
+}
+
+func ls(e *env, args []string) error {
+	flags := e.newFlags("ls")
+	tblName := flags.String("table", "", "table name")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	tbl, err := e.table(*tblName, false)
+	if err != nil {
+		return err
+	}
+
+	keys, err := tbl.Keys()
+	if err != nil {
+		return err
+	}
+	return e.printList(keys)
+}
+
+func tables(e *env, args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	tbls, err := e.db.Tables()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, tbl := range tbls {
+		if tbl.Name() != "" {
+			names = append(names, tbl.Name())
+		}
+	}
+	sort.Strings(names)
+	return e.printList(names)
+}
+
+// printList prints list one item per line, or as a JSON array.
+func (e *env) printList(list []string) error {
+	if e.format == "json" {
+		return e.printJSON(list)
+	}
+	for _, item := range list {
+		if _, err := fmt.Fprintln(e.stdout, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpFormat returns the dump format selected by the -tar flag.
+func dumpFormat(tar bool) flockd.Format {
+	if tar {
+		return flockd.FormatTar
+	}
+	return flockd.FormatJSONL
+}
+
+func dump(e *env, args []string) error {
+	flags := e.newFlags("dump")
+	tar := flags.Bool("tar", false, "write a tar archive instead of JSON lines")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	_, err := e.db.Dump(e.stdout, dumpFormat(*tar))
+	return err
+}
+
+var loadPolicies = map[string]flockd.LoadPolicy{
+	"create":    flockd.LoadCreate,
+	"overwrite": flockd.LoadOverwrite,
+	"skip":      flockd.LoadSkipExisting,
+}
+
+func load(e *env, args []string) error {
+	flags := e.newFlags("load")
+	tar := flags.Bool("tar", false, "read a tar archive instead of JSON lines")
+	policyName := flags.String("policy", "create", "existing key policy: create, overwrite, or skip")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	policy, ok := loadPolicies[*policyName]
+	if !ok {
+		return errUsage
+	}
+
+	n, err := e.db.Load(e.stdin, dumpFormat(*tar), policy)
+	if err != nil {
+		return err
+	}
+	if e.format == "json" {
+		return e.printJSON(map[string]int{"loaded": n})
+	}
+	_, err = fmt.Fprintf(e.stdout, "%v records loaded\n", n)
+	return err
+}
+
+// keyPath returns a display path for key in the table.
+func keyPath(table, key string) string {
+	if table == "" {
+		return key
+	}
+	return table + "/" + key
+}
+
+// event describes a change observed by watch.
+type event struct {
+	Op    string `json:"op"`
+	Table string `json:"table"`
+	Key   string `json:"key"`
+}
+
+func watch(e *env, args []string) error {
+	flags := e.newFlags("watch")
+	interval := flags.Duration("interval", time.Second, "polling interval")
+	count := flags.Int("count", 0, "exit after this many changes; 0 for no limit")
+	if err := flags.Parse(args); err != nil || *interval <= 0 {
+		return errUsage
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	prev, err := e.scan(flags.Args())
+	if err != nil {
+		return err
+	}
+	n := 0
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		cur, err := e.scan(flags.Args())
+		if err != nil {
+			return err
+		}
+		for _, ev := range diff(prev, cur) {
+			if err := e.printEvent(ev); err != nil {
+				return err
+			}
+			if n++; n == *count {
+				return nil
+			}
+		}
+		prev = cur
+	}
+}
+
+// selectTables returns the tables named in names, or all tables if names is
+// empty.
+func (e *env) selectTables(names []string) ([]*flockd.Table, error) {
+	if len(names) == 0 {
+		return e.db.Tables()
+	}
+	tbls := make([]*flockd.Table, len(names))
+	for i, name := range names {
+		tbl, err := e.table(name, false)
+		if err != nil {
+			return nil, err
+		}
+		tbls[i] = tbl
+	}
+	return tbls, nil
+}
+
+// scan returns a map of the records in the named tables to hashes of their
+// values.
+func (e *env) scan(names []string) (map[event][sha256.Size]byte, error) {
+	tbls, err := e.selectTables(names)
+	if err != nil {
+		return nil, err
+	}
+	sums := map[event][sha256.Size]byte{}
+	for _, tbl := range tbls {
+		if err := tbl.ForEach(func(key string, val []byte) error {
+			sums[event{Table: tbl.Name(), Key: key}] = sha256.Sum256(val)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// diff returns the events that changed prev to cur, sorted by table and key.
+func diff(prev, cur map[event][sha256.Size]byte) []event {
+	events := []event{}
+	for rec, sum := range cur {
+		if old, ok := prev[rec]; !ok || old != sum {
+			rec.Op = "set"
+			events = append(events, rec)
+		}
+	}
+	for rec := range prev {
+		if _, ok := cur[rec]; !ok {
+			rec.Op = "delete"
+			events = append(events, rec)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Table != events[j].Table {
+			return events[i].Table < events[j].Table
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+// printEvent prints ev as text or as a line of JSON.
+func (e *env) printEvent(ev event) error {
+	if e.format == "json" {
+		return json.NewEncoder(e.stdout).Encode(ev)
+	}
+	_, err := fmt.Fprintf(e.stdout, "%v %v\n", ev.Op, keyPath(ev.Table, ev.Key))
+	return err
+}
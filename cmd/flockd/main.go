@@ -0,0 +1,221 @@
+/*
+Command flockd provides command-line access to flockd databases. It uses the
+public flockd API, so it respects file locks and is safe to run against a live
+database.
+
+Usage:
+
+	flockd [flags] command [arguments]
+
+Run "flockd -help" for the list of flags and commands.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/iovation/flockd"
+)
+
+// errUsage indicates a usage error, reported with exit code 2.
+var errUsage = errors.New("usage error")
+
+// env provides the database and I/O streams to commands.
+type env struct {
+	db     *flockd.DB
+	format string
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// command defines a subcommand.
+type command struct {
+	// usage describes the command arguments.
+	usage string
+
+	// desc briefly describes the command.
+	desc string
+
+	// create indicates that the command may create the database directory.
+	create bool
+
+	// run executes the command.
+	run func(e *env, args []string) error
+}
+
+var commands = map[string]*command{
+	"get": {
+		usage: "get [-table name] key",
+		desc:  "print the value for a key",
+		run:   get,
+	},
+	"set": {
+		usage:  "set [-table name] key [value]",
+		desc:   "set the value for a key, read from standard input if not an argument",
+		create: true,
+		run:    set,
+	},
+	"create": {
+		usage:  "create [-table name] key [value]",
+		desc:   "create a key that does not exist",
+		create: true,
+		run:    create,
+	},
+	"update": {
+		usage: "update [-table name] key [value]",
+		desc:  "update the value for a key that exists",
+		run:   update,
+	},
+	"delete": {
+		usage: "delete [-table name] key",
+		desc:  "delete a key and its value",
+		run:   del,
+	},
+	"ls": {
+		usage: "ls [-table name]",
+		desc:  "list the keys in a table",
+		run:   ls,
+	},
+	"tables": {
+		usage: "tables",
+		desc:  "list the tables in the database",
+		run:   tables,
+	},
+	"dump": {
+		usage: "dump [-tar]",
+		desc:  "write all records to standard output as JSON lines or a tar archive",
+		run:   dump,
+	},
+	"load": {
+		usage:  "load [-tar] [-policy create|overwrite|skip]",
+		desc:   "load dumped records from standard input",
+		create: true,
+		run:    load,
+	},
+	"check": {
+		usage: "check [-repair] [-temp-age duration]",
+		desc:  "check the integrity of the database directory",
+		run:   check,
+	},
+	"serve": {
+		usage:  "serve [-addr host:port] [-replication]",
+		desc:   "serve tables and keys over HTTP until interrupted",
+		create: true,
+		run:    serve,
+	},
+	"watch": {
+		usage: "watch [-interval duration] [-count n] [table ...]",
+		desc:  "poll all or the named tables and print changes to records",
+		run:   watch,
+	},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run parses args, executes the command, and returns the exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("flockd", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dir := flags.String("db", ".", "database directory")
+	timeout := flags.Duration("timeout", time.Second, "maximum time to wait for a lock")
+	format := flags.String("format", "text", "output format: text or json")
+	flags.Usage = func() { usage(flags) }
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "flockd: unknown command %q\n", name)
+		flags.Usage()
+		return 2
+	}
+
+	// Don't create a database unless the command calls for it.
+	if !cmd.create {
+		if _, err := os.Stat(*dir); err != nil {
+			fmt.Fprintf(stderr, "flockd: %v\n", err)
+			return 1
+		}
+	}
+
+	db, err := flockd.New(*dir, *timeout)
+	if err != nil {
+		fmt.Fprintf(stderr, "flockd: %v\n", err)
+		return 1
+	}
+
+	e := &env{db: db, format: *format, stdin: stdin, stdout: stdout, stderr: stderr}
+	if err := cmd.run(e, flags.Args()[1:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(stderr, "usage: flockd [flags] %v\n", cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(stderr, "flockd %v: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(flags *flag.FlagSet) {
+	out := flags.Output()
+	fmt.Fprintf(out, "usage: flockd [flags] command [arguments]\n\nFlags:\n")
+	flags.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %v\n    \t%v\n", commands[name].usage, commands[name].desc)
+	}
+}
+
+// newFlags returns a FlagSet for the arguments to a command.
+func (e *env) newFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(e.stderr)
+	flags.Usage = func() {}
+	return flags
+}
+
+// printJSON writes v to stdout as JSON.
+func (e *env) printJSON(v interface{}) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table returns the table named name, or the root table if name is empty. If
+// create is false, it returns an error if the table does not exist.
+func (e *env) table(name string, create bool) (*flockd.Table, error) {
+	if create && name != "" {
+		return e.db.Table(name)
+	}
+	tbls, err := e.db.Tables()
+	if err != nil {
+		return nil, err
+	}
+	for _, tbl := range tbls {
+		if tbl.Name() == name {
+			return tbl, nil
+		}
+	}
+	return nil, fmt.Errorf("no such table %q", name)
+}
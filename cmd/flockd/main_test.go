@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// runCmd runs the command with args and returns the exit code, stdout, and
+// stderr.
+func runCmd(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func tempDB(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flockd-cmd")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	return dir
+}
+
+func TestUsage(t *testing.T) {
+	assert := assert.New(t)
+	code, _, stderr := runCmd("")
+	assert.Equal(2, code, "Should exit 2 with no command")
+	assert.Contains(stderr, "usage: flockd", "Should print usage")
+	assert.Contains(stderr, "check [-repair]", "Should list commands")
+
+	code, _, stderr = runCmd("", "nonesuch")
+	assert.Equal(2, code, "Should exit 2 for unknown command")
+	assert.Contains(stderr, `unknown command "nonesuch"`, "Should report unknown command")
+
+	code, _, _ = runCmd("", "-format", "xml", "check")
+	assert.Equal(2, code, "Should exit 2 for unknown format")
+
+	code, _, stderr = runCmd("", "-db", filepath.Join(os.TempDir(), "nonesuch-flockd"), "check")
+	assert.Equal(1, code, "Should exit 1 for nonexistent database")
+	assert.Contains(stderr, "no such file or directory", "Should report missing directory")
+}
+
+func TestCheck(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDB(t)
+	defer os.RemoveAll(dir)
+
+	code, stdout, stderr := runCmd("", "-db", dir, "check")
+	assert.Equal(0, code, "Should exit 0 for clean database: %v", stderr)
+	assert.Equal("1 tables, 0 records, 0 problems, 0 unrepaired\n", stdout)
+
+	stray := filepath.Join(dir, "stray.txt")
+	if err := ioutil.WriteFile(stray, []byte("hi"), 0644); err != nil {
+		t.Fatal("WriteFile", err)
+	}
+	code, stdout, stderr = runCmd("", "-db", dir, "check", "-repair")
+	assert.Equal(1, code, "Should exit 1 for unrepaired problems")
+	assert.Contains(stdout, "stray: "+stray+": not a flockd file\n")
+	assert.Contains(stderr, "1 unrepaired problems")
+
+	code, stdout, _ = runCmd("", "-db", dir, "-format", "json", "check")
+	assert.Equal(1, code, "Should exit 1 for unrepaired problems")
+	assert.Contains(stdout, `"Kind": "stray"`, "Should have JSON output")
+
+	code, _, stderr = runCmd("", "-db", dir, "check", "extra")
+	assert.Equal(2, code, "Should exit 2 for extra arguments")
+	assert.Contains(stderr, "usage: flockd [flags] check", "Should print command usage")
+}
+
+func TestKeyValue(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	db := filepath.Join(dir, "db")
+
+	code, _, stderr := runCmd("", "-db", db, "get", "foo")
+	assert.Equal(1, code, "Should exit 1 for nonexistent database")
+	assert.Contains(stderr, "no such file or directory")
+
+	// Set creates the database.
+	code, _, stderr = runCmd("", "-db", db, "set", "foo", "bar")
+	assert.Equal(0, code, "Should exit 0 from set: %v", stderr)
+	code, stdout, _ := runCmd("", "-db", db, "get", "foo")
+	assert.Equal(0, code, "Should exit 0 from get")
+	assert.Equal("bar", stdout, "Should get the value")
+
+	// Values can come from stdin.
+	code, _, stderr = runCmd("hello\nworld", "-db", db, "set", "-table", "greet", "hi")
+	assert.Equal(0, code, "Should exit 0 from set: %v", stderr)
+	code, stdout, _ = runCmd("", "-db", db, "get", "-table", "greet", "hi")
+	assert.Equal(0, code, "Should exit 0 from get")
+	assert.Equal("hello\nworld", stdout, "Should get the value from stdin")
+	code, stdout, _ = runCmd("", "-db", db, "-format", "json", "get", "-table", "greet", "hi")
+	assert.Equal(0, code, "Should exit 0 from get")
+	assert.Equal("{\n  \"table\": \"greet\",\n  \"key\": \"hi\",\n  \"value\": \"aGVsbG8Kd29ybGQ=\"\n}\n", stdout)
+
+	// Create and update.
+	code, _, stderr = runCmd("", "-db", db, "create", "foo", "baz")
+	assert.Equal(1, code, "Should exit 1 from create for existing key")
+	assert.Contains(stderr, "flockd create: file already exists")
+	code, _, stderr = runCmd("", "-db", db, "update", "nonesuch", "baz")
+	assert.Equal(1, code, "Should exit 1 from update for nonexistent key")
+	assert.Contains(stderr, "flockd update: file does not exist")
+	code, _, stderr = runCmd("", "-db", db, "create", "-table", "greet", "yo", "dude")
+	assert.Equal(0, code, "Should exit 0 from create: %v", stderr)
+	code, _, stderr = runCmd("", "-db", db, "update", "foo", "baz")
+	assert.Equal(0, code, "Should exit 0 from update: %v", stderr)
+	code, stdout, _ = runCmd("", "-db", db, "get", "foo")
+	assert.Equal("baz", stdout, "Should get the updated value")
+
+	// Update does not create tables.
+	code, _, stderr = runCmd("", "-db", db, "update", "-table", "nonesuch", "foo", "bar")
+	assert.Equal(1, code, "Should exit 1 from update for nonexistent table")
+	assert.Contains(stderr, `no such table "nonesuch"`)
+	_, err := os.Stat(filepath.Join(db, "nonesuch.tbl"))
+	assert.True(os.IsNotExist(err), "Should not have created table")
+
+	// List keys and tables.
+	code, stdout, _ = runCmd("", "-db", db, "ls", "-table", "greet")
+	assert.Equal(0, code, "Should exit 0 from ls")
+	assert.Equal("hi\nyo\n", stdout, "Should list keys")
+	code, stdout, _ = runCmd("", "-db", db, "-format", "json", "ls")
+	assert.Equal(0, code, "Should exit 0 from ls")
+	assert.Equal("[\n  \"foo\"\n]\n", stdout, "Should list keys as JSON")
+	runCmd("", "-db", db, "set", "-table", "a/b", "x", "y")
+	code, stdout, _ = runCmd("", "-db", db, "tables")
+	assert.Equal(0, code, "Should exit 0 from tables")
+	assert.Equal("a/b\ngreet\n", stdout, "Should list tables")
+
+	// Delete.
+	code, _, stderr = runCmd("", "-db", db, "delete", "-table", "greet", "hi")
+	assert.Equal(0, code, "Should exit 0 from delete: %v", stderr)
+	code, _, stderr = runCmd("", "-db", db, "get", "-table", "greet", "hi")
+	assert.Equal(1, code, "Should exit 1 from get for deleted key")
+	assert.Contains(stderr, "flockd get: file does not exist")
+
+	// Usage errors.
+	for _, args := range [][]string{
+		{"get"}, {"get", "a", "b"}, {"set"}, {"set", "a", "b", "c"},
+		{"delete", "-nonesuch", "a"}, {"ls", "a"}, {"tables", "a"},
+	} {
+		code, _, stderr = runCmd("", append([]string{"-db", db}, args...)...)
+		assert.Equal(2, code, "Should exit 2 for %v", args)
+		assert.Contains(stderr, "usage: flockd [flags] "+args[0])
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	runCmd("", "-db", src, "set", "foo", "bar")
+	runCmd("", "-db", src, "set", "-table", "tbl", "hi", "there")
+	code, dump, stderr := runCmd("", "-db", src, "dump")
+	assert.Equal(0, code, "Should exit 0 from dump: %v", stderr)
+	assert.Equal(
+		`{"table":"","key":"foo","value":"YmFy"}`+"\n"+
+			`{"table":"tbl","key":"hi","value":"dGhlcmU="}`+"\n",
+		dump, "Should dump records as JSON lines",
+	)
+	code, tarball, stderr := runCmd("", "-db", src, "dump", "-tar")
+	assert.Equal(0, code, "Should exit 0 from dump -tar: %v", stderr)
+	assert.Contains(tarball, "tbl.tbl/hi.kv", "Should have tar archive")
+
+	// Load into a new database.
+	code, stdout, stderr := runCmd(dump, "-db", dst, "load")
+	assert.Equal(0, code, "Should exit 0 from load: %v", stderr)
+	assert.Equal("2 records loaded\n", stdout)
+	_, stdout, _ = runCmd("", "-db", dst, "get", "-table", "tbl", "hi")
+	assert.Equal("there", stdout, "Should have loaded record")
+
+	// Policies.
+	runCmd("", "-db", dst, "set", "foo", "changed")
+	code, _, stderr = runCmd(dump, "-db", dst, "load")
+	assert.Equal(1, code, "Should exit 1 loading existing records")
+	assert.Contains(stderr, `load "foo" in table "": file already exists`)
+	code, stdout, _ = runCmd(dump, "-db", dst, "-format", "json", "load", "-policy", "skip")
+	assert.Equal(0, code, "Should exit 0 from load -policy skip")
+	assert.Equal("{\n  \"loaded\": 0\n}\n", stdout)
+	_, stdout, _ = runCmd("", "-db", dst, "get", "foo")
+	assert.Equal("changed", stdout, "Should have skipped existing record")
+	code, stdout, _ = runCmd(dump, "-db", dst, "load", "-policy", "overwrite")
+	assert.Equal(0, code, "Should exit 0 from load -policy overwrite")
+	assert.Equal("2 records loaded\n", stdout)
+	_, stdout, _ = runCmd("", "-db", dst, "get", "foo")
+	assert.Equal("bar", stdout, "Should have overwritten existing record")
+
+	code, _, _ = runCmd(dump, "-db", dst, "load", "-policy", "nonesuch")
+	assert.Equal(2, code, "Should exit 2 for unknown policy")
+	code, _, stderr = runCmd("not json", "-db", dst, "load")
+	assert.Equal(1, code, "Should exit 1 for invalid input")
+	assert.Contains(stderr, "flockd load: invalid character")
+	code, _, _ = runCmd("", "-db", src, "dump", "nonesuch")
+	assert.Equal(2, code, "Should exit 2 for extra arguments")
+
+	// Load a tar archive.
+	tarDB := filepath.Join(dir, "tar")
+	code, stdout, stderr = runCmd(tarball, "-db", tarDB, "load", "-tar")
+	assert.Equal(0, code, "Should exit 0 from load -tar: %v", stderr)
+	assert.Equal("2 records loaded\n", stdout)
+	_, stdout, _ = runCmd("", "-db", tarDB, "get", "-table", "tbl", "hi")
+	assert.Equal("there", stdout, "Should have loaded record from tar")
+}
+
+func TestWatch(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDB(t)
+	defer os.RemoveAll(dir)
+	runCmd("", "-db", dir, "set", "-table", "tbl", "k0", "0")
+
+	type result struct {
+		code           int
+		stdout, stderr string
+	}
+	done := make(chan result)
+	go func() {
+		code, stdout, stderr := runCmd("", "-db", dir, "-format", "json", "watch", "-interval", "5ms", "-count", "2", "tbl")
+		done <- result{code, stdout, stderr}
+	}()
+
+	// Keep changing things until watch sees them. Watch takes its first
+	// snapshot at an unknown point, so each iteration uses fresh keys.
+	for i := 1; ; i++ {
+		select {
+		case res := <-done:
+			assert.Equal(0, res.code, "Should exit 0 from watch: %v", res.stderr)
+			assert.Regexp(
+				`^(\{"op":"(set|delete)","table":"tbl","key":"k\d+"\}\n){2}$`,
+				res.stdout, "Should have printed changes",
+			)
+			return
+		case <-time.After(20 * time.Millisecond):
+			runCmd("", "-db", dir, "delete", "-table", "tbl", "k"+strconv.Itoa(i-1))
+			runCmd("", "-db", dir, "set", "-table", "tbl", "k"+strconv.Itoa(i), strconv.Itoa(i))
+			runCmd("", "-db", dir, "set", "ignored", strconv.Itoa(i))
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServe(t *testing.T) {
+	assert := assert.New(t)
+	dir := tempDB(t)
+	defer os.RemoveAll(dir)
+
+	code, _, stderr := runCmd("", "-db", dir, "serve", "extra")
+	assert.Equal(2, code, "Should exit 2 for extra arguments")
+	assert.Contains(stderr, "usage: flockd [flags] serve")
+	code, _, _ = runCmd("", "-db", dir, "serve", "-addr", "nonesuch:x")
+	assert.Equal(1, code, "Should exit 1 for invalid address")
+
+	var stdout, errOut syncBuffer
+	done := make(chan int)
+	go func() {
+		done <- run([]string{"-db", dir, "serve", "-addr", "127.0.0.1:0", "-replication"}, strings.NewReader(""), &stdout, &errOut)
+	}()
+
+	// Wait for the server to start.
+	var base string
+	for i := 0; i < 100 && base == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if _, addr, ok := strings.Cut(errOut.String(), "listening on "); ok {
+			base = strings.TrimSpace(addr)
+		}
+	}
+	if base == "" {
+		t.Fatal("Server did not start: ", errOut.String())
+	}
+
+	req, err := http.NewRequest(http.MethodPut, base+"/tables/tbl/keys/hi", strings.NewReader("there"))
+	if err != nil {
+		t.Fatal("NewRequest", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Do", err)
+	}
+	resp.Body.Close()
+	assert.Equal(http.StatusNoContent, resp.StatusCode, "Should set key")
+	resp, err = http.Get(base + "/tables/tbl/keys/hi")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("there", string(body), "Should get key")
+	resp, err = http.Get(base + "/replication/changes")
+	if err != nil {
+		t.Fatal("Get", err)
+	}
+	resp.Body.Close()
+	assert.Equal(http.StatusNotFound, resp.StatusCode, "Should serve replication without change log")
+
+	// Interrupt it.
+	proc, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal("FindProcess", err)
+	}
+	if err := proc.Signal(os.Interrupt); err != nil {
+		t.Fatal("Signal", err)
+	}
+	select {
+	case code := <-done:
+		assert.Equal(0, code, "Should exit 0 when interrupted: %v", errOut.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+}
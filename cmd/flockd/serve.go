@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/iovation/flockd"
+)
+
+// serve serves the database over HTTP until interrupted.
+func serve(e *env, args []string) error {
+	flags := e.newFlags("serve")
+	addr := flags.String("addr", "localhost:8080", "address to listen on")
+	repl := flags.Bool("replication", false, "also serve the change log for replication under /replication/")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", flockd.RESTHandler(e.db))
+	if *repl {
+		mux.Handle("/replication/", http.StripPrefix("/replication", flockd.ReplicationHandler(e.db)))
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	errs := make(chan error, 1)
+	go func() { errs <- srv.Serve(ln) }()
+	fmt.Fprintf(e.stderr, "flockd: listening on http://%v\n", ln.Addr())
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Let requests in progress finish.
+	shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutCtx); err != nil {
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package flockd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// ErrUnknownCodec is returned when a table is configured to use, or a record
+// was written with, a compression codec that has not been registered.
+var ErrUnknownCodec = errors.New("flockd: unknown codec")
+
+// Codec defines the interface for compression codecs. Register a Codec with
+// RegisterCodec and enable it for a table by setting TableConfig.Compression to
+// its name. The standard library gzip codec is registered as "gzip".
+type Codec interface {
+	// Name returns the name of the codec, which is recorded in the envelope of
+	// each record it compresses.
+	Name() string
+
+	// NewWriter returns a WriteCloser that compresses data written to it and
+	// writes it to w. Close must flush any pending data to w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// NewReader returns a ReadCloser that decompresses data read from r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = &sync.Map{}
+
+// RegisterCodec makes a compression codec available by name. If a codec with
+// the same name has already been registered, it will be replaced.
+func RegisterCodec(codec Codec) {
+	codecs.Store(codec.Name(), codec)
+}
+
+// lookupCodec returns the codec registered with name, or ErrUnknownCodec.
+func lookupCodec(name string) (Codec, error) {
+	codec, ok := codecs.Load(name)
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec.(Codec), nil
+}
+
+func init() {
+	RegisterCodec(gzipCodec{})
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// compress compresses value with the codec registered with name.
+func compress(name string, value []byte) ([]byte, error) {
+	codec, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	w, err := codec.NewWriter(buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress decompresses payload with the codec registered with name.
+func decompress(name string, payload []byte) ([]byte, error) {
+	codec, err := lookupCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,123 @@
+package flockd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// rot13Codec is a silly codec for testing custom codecs.
+type rot13Codec struct{}
+
+func (rot13Codec) Name() string {
+	return "rot13"
+}
+
+func (rot13Codec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return &rot13Writer{w}, nil
+}
+
+func (rot13Codec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(rot13(data))), nil
+}
+
+type rot13Writer struct {
+	io.Writer
+}
+
+func (w *rot13Writer) Write(p []byte) (int, error) {
+	return w.Writer.Write(rot13(p))
+}
+
+func (w *rot13Writer) Close() error {
+	return nil
+}
+
+func rot13(p []byte) []byte {
+	out := make([]byte, len(p))
+	for i, c := range p {
+		switch {
+		case c >= 'a' && c <= 'z':
+			c = 'a' + (c-'a'+13)%26
+		case c >= 'A' && c <= 'Z':
+			c = 'A' + (c-'A'+13)%26
+		}
+		out[i] = c
+	}
+	return out
+}
+
+func (s *TS) TestCompression() {
+	tbl, err := s.db.Table("squish")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val := []byte(strings.Repeat(`{"greeting": "hello world"}`, 1000))
+
+	// Start with a raw record.
+	s.Nil(tbl.Set("raw", val), "Should have no error from Set")
+
+	// Enable compression.
+	s.Equal(
+		ErrUnknownCodec, tbl.Configure(TableConfig{Compression: "nonesuch"}),
+		"Should have ErrUnknownCodec for unregistered codec",
+	)
+	s.Nil(tbl.Configure(TableConfig{Compression: "gzip"}), "Should configure gzip")
+	s.Nil(tbl.Set("gzip", val), "Should have no error from Set")
+
+	// The file should be compressed.
+	data, err := ioutil.ReadFile(filepath.Join(tbl.path, "gzip"+recExt))
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+	s.True(hasEnvelope(data), "Should have an envelope")
+	s.True(len(data) < len(val)/10, "Should be compressed")
+
+	// Switch to a custom codec.
+	RegisterCodec(rot13Codec{})
+	s.Nil(tbl.Configure(TableConfig{Compression: "rot13"}), "Should configure rot13")
+	s.Nil(tbl.Set("rot13", []byte("hello")), "Should have no error from Set")
+	data, err = ioutil.ReadFile(filepath.Join(tbl.path, "rot13"+recExt))
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+	s.True(bytes.HasSuffix(data, []byte("uryyb")), "Should have rot13 payload")
+
+	// All should be readable.
+	for key, exp := range map[string][]byte{"raw": val, "gzip": val, "rot13": []byte("hello")} {
+		got, meta, err := tbl.GetWithMeta(key)
+		s.Nil(err, "Should have no error from GetWithMeta %v", key)
+		s.Equal(exp, got, "Should have value for %v", key)
+		if key == "raw" {
+			s.Nil(meta, "Should have no meta for raw record")
+		} else {
+			s.Equal(key, meta.Encoding, "Should have encoding for %v", key)
+		}
+	}
+	records := map[string]int{}
+	s.Nil(tbl.ForEach(func(key string, val []byte) error {
+		records[key] = len(val)
+		return nil
+	}), "Should have no error from ForEach")
+	s.Equal(map[string]int{"raw": len(val), "gzip": len(val), "rot13": 5}, records)
+
+	// Disable compression.
+	s.Nil(tbl.Configure(TableConfig{}), "Should disable compression")
+	s.Nil(tbl.Set("gzip", []byte("plain")), "Should have no error from Set")
+	got, meta, err := tbl.GetWithMeta("gzip")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("plain", string(got), "Should have the plain value")
+	s.Nil(meta, "Should have written a raw record")
+
+	// An unknown codec should be an error.
+	codecs.Delete("rot13")
+	got, err = tbl.Get("rot13")
+	s.Nil(got, "Should have no value for unknown codec")
+	s.Equal(ErrUnknownCodec, err, "Should have ErrUnknownCodec")
+}
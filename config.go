@@ -0,0 +1,170 @@
+package flockd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cfgFile is the name of the file in a table directory that stores the table
+// configuration.
+const cfgFile = ".flockd.json"
+
+// TableConfig defines the persistent configuration of a table. It is stored in
+// the file ".flockd.json" in the table directory, so that all processes
+// accessing the table write records the same way.
+type TableConfig struct {
+	// Envelope indicates that records should be written in the envelope
+	// format, with a metadata header. Raw records already in the table remain
+	// readable, so envelopes can be enabled for an existing table.
+	Envelope bool `json:"envelope,omitempty"`
+
+	// Compression is the name of the Codec used to compress values, such as
+	// "gzip". Compressed values are always written in the envelope format,
+	// which records the codec, so records written with or without compression
+	// remain readable when compression is changed.
+	Compression string `json:"compression,omitempty"`
+
+	// Encrypt indicates that values should be encrypted with AES-GCM, using
+	// keys from the KeyProvider passed to New via WithKeyProvider. Encrypted
+	// values are always written in the envelope format, which records the key
+	// ID, so that keys can be rotated with RotateKeys.
+	Encrypt bool `json:"encrypt,omitempty"`
+
+	// HistoryKeep enables history mode, keeping up to this many previous
+	// values of each record when Set, Update, or Delete replaces it. See
+	// Table.History.
+	HistoryKeep int `json:"history_keep,omitempty"`
+
+	// HistoryMaxAge enables history mode, keeping all previous values of each
+	// record replaced within this duration. If HistoryKeep is also set, a
+	// previous value is kept if either condition applies.
+	HistoryMaxAge time.Duration `json:"history_max_age,omitempty"`
+
+	// Trash enables trash mode, in which Delete moves records to the trash
+	// rather than removing them, so that they can be recovered by Undelete.
+	Trash bool `json:"trash,omitempty"`
+
+	// TrashRetention is the minimum time PurgeTrash keeps deleted records in
+	// the trash. If zero, PurgeTrash empties the trash.
+	TrashRetention time.Duration `json:"trash_retention,omitempty"`
+
+	// Tombstones enables tombstone mode, in which Delete replaces records with
+	// tombstones recording the time of deletion and the writer ID, so that
+	// file synchronization tools propagate deletes rather than resurrecting
+	// records from other replicas. Get and ForEach treat tombstones as
+	// nonexistent records.
+	Tombstones bool `json:"tombstones,omitempty"`
+
+	// TombstoneGrace is the minimum time Compact keeps tombstones, which
+	// should be long enough for deletes to propagate to all replicas.
+	TombstoneGrace time.Duration `json:"tombstone_grace,omitempty"`
+}
+
+// enveloped returns true if the configuration requires that records be written
+// in the envelope format.
+func (cfg TableConfig) enveloped() bool {
+	return cfg.Envelope || cfg.Compression != "" || cfg.Encrypt
+}
+
+// history returns true if the configuration enables history mode.
+func (cfg TableConfig) history() bool {
+	return cfg.HistoryKeep > 0 || cfg.HistoryMaxAge > 0
+}
+
+// Config returns the configuration of the root table.
+func (db *DB) Config() TableConfig {
+	return db.root.Config()
+}
+
+// Configure sets the configuration of the root table.
+func (db *DB) Configure(cfg TableConfig) error {
+	return db.root.Configure(cfg)
+}
+
+// Config returns the configuration of the table, as loaded when the table was
+// opened or set by Configure.
+func (table *Table) Config() TableConfig {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.cfg
+}
+
+// Configure sets the configuration of the table and writes it to the file
+// ".flockd.json" in the table directory. Returns ErrUnknownCodec if the
+// compression codec has not been registered, and ErrNoKeyProvider if the
+// configuration enables encryption but no KeyProvider was passed to New. Before
+// writing the file, Configure tries to acquire an exclusive lock on it, waiting
+// up to the timeout set for the database before returning a
+// context.DeadlineExceeded error. Other processes will read the new
+// configuration the next time they open the table.
+func (table *Table) Configure(cfg TableConfig) error {
+	if cfg.Compression != "" {
+		if _, err := lookupCodec(cfg.Compression); err != nil {
+			return err
+		}
+	}
+	if cfg.Encrypt && table.db.keys == nil {
+		return ErrNoKeyProvider
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer dbLock.Unlock()
+
+	// Take an exclusive lock on the config file.
+	file := filepath.Join(table.path, cfgFile)
+	lock, err := lockFile(file, true, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Write to a temporary file and move it.
+	tmp, err := writeTemp(table.path, cfgFile, data, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	if err := os.Rename(tmp.file, file); err != nil {
+		return err
+	}
+
+	table.mu.Lock()
+	table.cfg = cfg
+	table.mu.Unlock()
+	return nil
+}
+
+// loadConfig reads the table configuration from the file ".flockd.json" in the
+// table directory. Leaves the default configuration in place if the file does
+// not exist.
+func (table *Table) loadConfig() error {
+	data, err := ioutil.ReadFile(filepath.Join(table.path, cfgFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	cfg := TableConfig{}
+	if len(data) == 0 {
+		// Created by a lock while another process configures the table.
+		return nil
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	table.cfg = cfg
+	return nil
+}
@@ -0,0 +1,59 @@
+package flockd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestConfigure() {
+	s.Equal(TableConfig{}, s.db.Config(), "Should have default config")
+
+	tbl, err := s.db.Table("conf")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	file := filepath.Join(tbl.path, cfgFile)
+	s.fileNotExists(file)
+
+	cfg := TableConfig{Envelope: true}
+	s.Nil(tbl.Configure(cfg), "Should have no error from Configure")
+	s.Equal(cfg, tbl.Config(), "Should have new config")
+	s.FileExists(file, "Config file should exist")
+
+	// Another instance should load the config.
+	db, err := New(s.dir, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	other, err := db.Table("conf")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Equal(cfg, other.Config(), "Should have loaded config")
+
+	// So should Tables.
+	tables, err := db.Tables()
+	s.Nil(err, "Should have no error from Tables")
+	for _, t := range tables {
+		if t.Name() == "conf" {
+			s.Equal(cfg, t.Config(), "Should have config from Tables")
+		}
+	}
+
+	// The root table can be configured, too.
+	s.Nil(s.db.Configure(cfg), "Should have no error from DB.Configure")
+	s.Equal(cfg, s.db.Config(), "Should have root config")
+
+	// An empty file should be ignored; an invalid one should not.
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	_, err = db.newTable("conf", tbl.path, time.Millisecond)
+	s.Nil(err, "Should have no error for empty config file")
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	_, err = db.newTable("conf", tbl.path, time.Millisecond)
+	s.NotNil(err, "Should have error for invalid config file")
+}
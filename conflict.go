@@ -0,0 +1,356 @@
+package flockd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConflictPattern defines the interface for recognizing the names of conflict
+// files left in table directories by file synchronization tools.
+type ConflictPattern interface {
+	// Match returns the key of the record that the file named name conflicts
+	// with and true if name is the name of a conflict file.
+	Match(name string) (key string, ok bool)
+}
+
+// ConflictRegexp is a ConflictPattern that matches file names against a
+// regular expression. The first subexpression must match the key.
+type ConflictRegexp struct {
+	*regexp.Regexp
+}
+
+// Match returns the key matched by the first subexpression of the regular
+// expression and true if it matches name.
+func (cr ConflictRegexp) Match(name string) (string, bool) {
+	m := cr.FindStringSubmatch(name)
+	if len(m) < 2 {
+		return "", false
+	}
+	return m[1], true
+}
+
+var (
+	// SyncthingConflicts matches conflict files created by Syncthing, such as
+	// "key.sync-conflict-20261016-123456-ABCDEFG.kv".
+	SyncthingConflicts = ConflictRegexp{regexp.MustCompile(
+		`^(.+)\.sync-conflict-\d{8}-\d{6}(?:-[0-9A-Z]+)?` + regexp.QuoteMeta(recExt) + `$`,
+	)}
+
+	// DropboxConflicts matches conflict files created by Dropbox, such as
+	// "key (conflicted copy).kv" and "key (host's conflicted copy 2026-10-16).kv".
+	DropboxConflicts = ConflictRegexp{regexp.MustCompile(
+		`^(.+) \([^()]*conflicted copy[^()]*\)` + regexp.QuoteMeta(recExt) + `$`,
+	)}
+
+	// UnisonConflicts matches copies of conflicting files created by Unison
+	// with the copyonconflict preference, which have a parenthetical note
+	// about the conflict, such as "key (copy on conflict from host).kv".
+	UnisonConflicts = ConflictRegexp{regexp.MustCompile(
+		`^(.+) \([^()]*\bconflict\b[^()]*\)` + regexp.QuoteMeta(recExt) + `$`,
+	)}
+
+	// DefaultConflictPatterns are the patterns used to recognize conflict
+	// files unless WithConflictPatterns is passed to New.
+	DefaultConflictPatterns = []ConflictPattern{
+		SyncthingConflicts,
+		DropboxConflicts,
+		UnisonConflicts,
+	}
+)
+
+// WithConflictPatterns sets the patterns used to recognize conflict files,
+// replacing DefaultConflictPatterns. Pass no patterns to disable conflict
+// detection.
+func WithConflictPatterns(patterns ...ConflictPattern) Option {
+	return func(db *DB) {
+		db.conflicts = patterns
+	}
+}
+
+// matchConflict returns the key of the record that the file named name
+// conflicts with and true if name is the name of a conflict file.
+func (db *DB) matchConflict(name string) (string, bool) {
+	for _, p := range db.conflicts {
+		if key, ok := p.Match(name); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Conflict describes a conflict file in a table directory.
+type Conflict struct {
+	// Key is the key of the record with which the file conflicts.
+	Key string
+
+	// File is the name of the conflict file.
+	File string
+
+	// Modified is the modification time of the conflict file.
+	Modified time.Time
+}
+
+// Keys returns the keys in the root directory. See Table.Keys for details.
+func (db *DB) Keys() ([]string, error) {
+	return db.root.Keys()
+}
+
+// Keys returns the keys of the records in the table, sorted. Like ForEach, it
+// skips conflict files and tombstones.
+func (table *Table) Keys() ([]string, error) {
+	keys := []string{}
+	err := table.eachKey(func(key string) error {
+		tomb, err := isTombstone(filepath.Join(table.path, key+recExt))
+		if err != nil || tomb {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Conflicts returns the conflict files in the table directory, sorted by key
+// and file name. Conflict files are recognized by the patterns passed to New
+// via WithConflictPatterns, or DefaultConflictPatterns.
+func (table *Table) Conflicts() ([]Conflict, error) {
+	files, err := ioutil.ReadDir(table.path)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []Conflict{}
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if key, ok := table.db.matchConflict(info.Name()); ok {
+			conflicts = append(conflicts, Conflict{
+				Key:      key,
+				File:     info.Name(),
+				Modified: info.ModTime(),
+			})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Key != conflicts[j].Key {
+			return conflicts[i].Key < conflicts[j].Key
+		}
+		return conflicts[i].File < conflicts[j].File
+	})
+	return conflicts, nil
+}
+
+// ConflictVersion represents one of the versions of a record passed to a
+// ConflictResolver.
+type ConflictVersion struct {
+	// Value is the value of the version.
+	Value []byte
+
+	// Meta is the metadata of the version, or nil if it is a raw record.
+	Meta *Meta
+
+	// Modified is the modification time of the file containing the version,
+	// or, for a tombstone, the time of the delete recorded in its metadata.
+	Modified time.Time
+}
+
+// Deleted returns true if the version is a tombstone left by a delete in
+// tombstone mode. Its Value is nil.
+func (cv *ConflictVersion) Deleted() bool {
+	return cv != nil && cv.Meta != nil && cv.Meta.Tombstone
+}
+
+// ConflictResolver is the type of the function called by ResolveConflicts to
+// resolve a conflict between the current version of the record for key and the
+// version in a conflict file. Current is nil if the record does not exist. A
+// record deleted in tombstone mode, in either file, is passed as a version for
+// which Deleted returns true, so that resolvers can weigh deletes against
+// writes. ResolveConflicts writes the returned version to the record, unless it
+// is current, and removes the conflict file. If the returned version is a
+// tombstone, ResolveConflicts deletes the record, just like Delete.
+// Returning an error halts ResolveConflicts and leaves the conflict file in
+// place.
+type ConflictResolver func(key string, current, conflict *ConflictVersion) (*ConflictVersion, error)
+
+// LatestWins is a ConflictResolver that resolves conflicts in favor of the
+// version with the latest modification time. Because tombstones carry the time
+// of the delete, a delete wins over an older write and loses to a newer one.
+func LatestWins(key string, current, conflict *ConflictVersion) (*ConflictVersion, error) {
+	if current == nil || conflict.Modified.After(current.Modified) {
+		return conflict, nil
+	}
+	return current, nil
+}
+
+// MergeWith returns a ConflictResolver that resolves conflicts by calling
+// merge to merge the current and conflicting values. The merged value is
+// written with the metadata of the current version. If the record does not
+// exist, the conflict version wins without calling merge. If either version is
+// a tombstone, there is nothing to merge, and MergeWith falls back on
+// LatestWins.
+func MergeWith(merge func(key string, current, conflict []byte) ([]byte, error)) ConflictResolver {
+	return func(key string, current, conflict *ConflictVersion) (*ConflictVersion, error) {
+		if current == nil {
+			return conflict, nil
+		}
+		if current.Deleted() || conflict.Deleted() {
+			return LatestWins(key, current, conflict)
+		}
+		val, err := merge(key, current.Value, conflict.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &ConflictVersion{Value: val, Meta: current.Meta}, nil
+	}
+}
+
+// ResolveConflicts resolves the conflicts returned by Conflicts by calling
+// resolve for each. For each conflict, it acquires an exclusive lock on the
+// record file, waiting up to the timeout set for the database before returning
+// a context.DeadlineExceeded error, and reads the current and conflicting
+// versions of the record. It then writes the version returned by resolve, just
+// like Set, and removes the conflict file before releasing the lock. Returns
+// the number of conflicts resolved.
+func (table *Table) ResolveConflicts(resolve ConflictResolver) (int, error) {
+	conflicts, err := table.Conflicts()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, c := range conflicts {
+		if strings.ContainsRune(c.Key, os.PathSeparator) {
+			continue
+		}
+		if err := table.resolve(c, resolve); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// resolve resolves the conflict c under an exclusive lock.
+func (table *Table) resolve(c Conflict, resolve ConflictResolver) error {
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer dbLock.Unlock()
+
+	// Take an exclusive lock on the key file. Unlock removes the file if the
+	// lock created it and nothing replaced it.
+	file := filepath.Join(table.path, c.Key+recExt)
+	lock, err := lockRecord(file, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	// Read the current version, unless locking created the file.
+	var current *ConflictVersion
+	if lock.created == nil {
+		if current, err = table.readVersion(c.Key, file); err != nil {
+			return err
+		}
+	}
+
+	// Read the conflicting version.
+	conflictFile := filepath.Join(table.path, c.File)
+	conflict, err := table.readVersion(c.Key, conflictFile)
+	if err != nil {
+		return err
+	}
+	if conflict == nil {
+		// Already resolved.
+		return removeFile(conflictFile)
+	}
+
+	// Resolve it.
+	winner, err := resolve(c.Key, current, conflict)
+	if err != nil {
+		return err
+	}
+	switch {
+	case winner == current || winner == nil:
+		// Keep the current version.
+	case winner.Deleted():
+		if current != nil && !current.Deleted() {
+			// Delete the record, keeping the time of the delete.
+			if err := table.drop(c.Key, winner.Meta); err != nil {
+				return err
+			}
+		} else if table.Config().Tombstones {
+			// Propagate the delete.
+			if err := table.tombstone(c.Key, winner.Meta); err != nil {
+				return err
+			}
+		}
+	default:
+		if current != nil {
+			if err := table.archive(c.Key); err != nil {
+				return err
+			}
+		}
+		data, err := table.encode(c.Key, winner.Value, winner.Meta)
+		if err != nil {
+			return err
+		}
+		tmp, err := table.writeTemp(c.Key, data)
+		if err != nil {
+			return err
+		}
+		defer tmp.Release()
+		if err := table.logChange(c.Key, OpSet, func() error {
+			return table.commit(tmp, c.Key, data)
+		}); err != nil {
+			return err
+		}
+	}
+	return removeFile(conflictFile)
+}
+
+// readVersion reads and decodes the record file at path for key. Returns nil
+// if the file does not exist. A tombstone is returned as a version with a nil
+// Value and the time of the delete.
+func (table *Table) readVersion(key, path string) (*ConflictVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, meta, err := decodeEnvelope(data); err == nil && meta != nil && meta.Tombstone {
+		v := &ConflictVersion{Meta: meta, Modified: meta.Modified}
+		if v.Modified.IsZero() {
+			v.Modified = info.ModTime()
+		}
+		return v, nil
+	}
+	val, meta, err := table.decode(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return &ConflictVersion{Value: val, Meta: meta, Modified: info.ModTime()}, nil
+}
+
+// removeFile removes the file at path, ignoring an error if it does not exist.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
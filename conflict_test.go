@@ -0,0 +1,286 @@
+package flockd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+func (s *TS) TestConflictPatterns() {
+	for _, tc := range []struct {
+		name string
+		key  string
+	}{
+		{"foo.sync-conflict-20261016-123456-ABCDEFG.kv", "foo"},
+		{"foo.sync-conflict-20261016-123456.kv", "foo"},
+		{"foo bar (conflicted copy).kv", "foo bar"},
+		{"foo (Host's conflicted copy 2026-10-16).kv", "foo"},
+		{"foo (copy on conflict from host).kv", "foo"},
+		{"foo.kv", ""},
+		{"foo (copy).kv", ""},
+		{"foo.sync-conflict-2026.kv", ""},
+		{"foo.sync-conflict-20261016-123456-ABCDEFG.txt", ""},
+	} {
+		key, ok := s.db.matchConflict(tc.name)
+		s.Equal(tc.key != "", ok, "Should match %q", tc.name)
+		s.Equal(tc.key, key, "Should have key for %q", tc.name)
+	}
+
+	// Custom patterns replace the defaults.
+	db, err := New(s.db.root.path, time.Second, WithConflictPatterns(
+		ConflictRegexp{regexp.MustCompile(`^(.+)\.mine\.kv$`)},
+	))
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	key, ok := db.matchConflict("foo.mine.kv")
+	s.True(ok, "Should match custom pattern")
+	s.Equal("foo", key, "Should have key from custom pattern")
+	_, ok = db.matchConflict("foo (conflicted copy).kv")
+	s.False(ok, "Should not match default pattern")
+}
+
+func (s *TS) TestConflicts() {
+	tbl, err := s.db.Table("conflicts")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Set("foo", []byte("foo")), "Should set foo")
+	s.Nil(tbl.Set("bar", []byte("bar")), "Should set bar")
+	for _, name := range []string{
+		"foo.sync-conflict-20261016-123456-ABCDEFG.kv",
+		"bar (conflicted copy).kv",
+		"baz (conflicted copy).kv",
+	} {
+		s.Nil(ioutil.WriteFile(filepath.Join(tbl.path, name), []byte("x"), 0644), "Should write %v", name)
+	}
+
+	// ForEach and Keys should skip them.
+	keys := []string{}
+	s.Nil(tbl.ForEach(func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}), "Should have no error from ForEach")
+	s.ElementsMatch([]string{"foo", "bar"}, keys, "Should skip conflicts in ForEach")
+	keys, err = tbl.Keys()
+	s.Nil(err, "Should have no error from Keys")
+	s.Equal([]string{"bar", "foo"}, keys, "Should skip conflicts in Keys")
+
+	// Conflicts should list them.
+	conflicts, err := tbl.Conflicts()
+	s.Nil(err, "Should have no error from Conflicts")
+	s.Len(conflicts, 3, "Should have three conflicts")
+	got := [][2]string{}
+	for _, c := range conflicts {
+		got = append(got, [2]string{c.Key, c.File})
+		s.False(c.Modified.IsZero(), "Should have modified time for %v", c.File)
+	}
+	s.Equal([][2]string{
+		{"bar", "bar (conflicted copy).kv"},
+		{"baz", "baz (conflicted copy).kv"},
+		{"foo", "foo.sync-conflict-20261016-123456-ABCDEFG.kv"},
+	}, got, "Should have sorted conflicts")
+
+	// Without patterns, they're just keys.
+	db, err := New(s.db.root.path, time.Second, WithConflictPatterns())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	raw, err := db.Table("conflicts")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	keys, err = raw.Keys()
+	s.Nil(err, "Should have no error from Keys")
+	s.Len(keys, 5, "Should have conflicts as keys")
+	conflicts, err = raw.Conflicts()
+	s.Nil(err, "Should have no error from Conflicts")
+	s.Empty(conflicts, "Should have no conflicts")
+
+	// Keys in the root table.
+	s.Nil(s.db.Set("root", []byte("root")), "Should set root key")
+	keys, err = s.db.Keys()
+	s.Nil(err, "Should have no error from DB.Keys")
+	s.Equal([]string{"root"}, keys, "Should have root key")
+}
+
+func (s *TS) TestResolveLatestWins() {
+	tbl, err := s.db.Table("latest")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true, HistoryKeep: 5}), "Should configure table")
+	s.Nil(tbl.Set("old", []byte("current")), "Should set old")
+	s.Nil(tbl.Set("new", []byte("current")), "Should set new")
+
+	// Write an older conflict for "old" and a newer one for "new" and "gone".
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, c := range []struct {
+		key string
+		val string
+		t   time.Time
+	}{
+		{"old", "older", past},
+		{"new", "newer", future},
+		{"gone", "resurrected", future},
+	} {
+		data, err := tbl.encode(c.key, []byte(c.val), nil)
+		s.Nil(err, "Should encode %v", c.key)
+		file := filepath.Join(tbl.path, c.key+" (conflicted copy)"+recExt)
+		s.Nil(ioutil.WriteFile(file, data, 0644), "Should write conflict for %v", c.key)
+		s.Nil(os.Chtimes(file, c.t, c.t), "Should set time for %v", c.key)
+	}
+
+	n, err := tbl.ResolveConflicts(LatestWins)
+	s.Nil(err, "Should have no error from ResolveConflicts")
+	s.Equal(3, n, "Should resolve three conflicts")
+	for key, exp := range map[string]string{
+		"old":  "current",
+		"new":  "newer",
+		"gone": "resurrected",
+	} {
+		val, err := tbl.Get(key)
+		s.Nil(err, "Should get %v", key)
+		s.Equal(exp, string(val), "Should have resolved value for %v", key)
+	}
+	conflicts, err := tbl.Conflicts()
+	s.Nil(err, "Should have no error from Conflicts")
+	s.Empty(conflicts, "Should have removed conflict files")
+
+	// The replaced value should be kept in history; the unchanged one not.
+	versions, err := tbl.History("new")
+	s.Nil(err, "Should have no error from History")
+	s.Len(versions, 1, "Should have archived replaced value")
+	versions, err = tbl.History("old")
+	s.Nil(err, "Should have no error from History")
+	s.Empty(versions, "Should not archive unchanged value")
+
+	// Nothing left to resolve.
+	n, err = tbl.ResolveConflicts(LatestWins)
+	s.Nil(err, "Should have no error from ResolveConflicts")
+	s.Equal(0, n, "Should resolve no conflicts")
+}
+
+func (s *TS) TestResolveMerge() {
+	tbl, err := s.db.Table("merge")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true}), "Should configure tombstones")
+	meta := &Meta{Headers: map[string]string{"a": "b"}}
+	s.Nil(tbl.SetWithMeta("foo", []byte("abc"), meta), "Should set foo")
+	s.Nil(tbl.Set("deleted", []byte("x")), "Should set deleted")
+	s.Nil(tbl.Delete("deleted"), "Should delete deleted")
+	future := time.Now().Add(time.Hour)
+	for key, val := range map[string]string{"foo": "def", "deleted": "y"} {
+		file := filepath.Join(tbl.path, key+".sync-conflict-20261016-123456-ABC"+recExt)
+		s.Nil(ioutil.WriteFile(file, []byte(val), 0644), "Should write conflict for %v", key)
+		s.Nil(os.Chtimes(file, future, future), "Should set time for %v", key)
+	}
+
+	calls := 0
+	n, err := tbl.ResolveConflicts(MergeWith(func(key string, current, conflict []byte) ([]byte, error) {
+		calls++
+		s.Equal("foo", key, "Should merge foo")
+		return append(current, conflict...), nil
+	}))
+	s.Nil(err, "Should have no error from ResolveConflicts")
+	s.Equal(2, n, "Should resolve two conflicts")
+	s.Equal(1, calls, "Should call merge once")
+
+	val, got, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should get foo")
+	s.Equal("abcdef", string(val), "Should have merged value")
+	s.NotNil(got, "Should have meta")
+	s.Equal(meta.Headers, got.Headers, "Should keep current headers")
+	val, err = tbl.Get("deleted")
+	s.Nil(err, "Should get deleted")
+	s.Equal("y", string(val), "Should replace older tombstone with conflict")
+
+	// An error should leave the conflict file in place.
+	file := filepath.Join(tbl.path, "foo (conflicted copy)"+recExt)
+	s.Nil(ioutil.WriteFile(file, []byte("ghi"), 0644), "Should write conflict")
+	boom := errors.New("boom")
+	n, err = tbl.ResolveConflicts(MergeWith(func(string, []byte, []byte) ([]byte, error) {
+		return nil, boom
+	}))
+	s.Equal(boom, err, "Should have merge error")
+	s.Equal(0, n, "Should resolve no conflicts")
+	s.FileExists(file, "Should keep conflict file")
+	val, err = tbl.Get("foo")
+	s.Nil(err, "Should get foo")
+	s.Equal("abcdef", string(val), "Should keep merged value")
+}
+
+func (s *TS) TestResolveTombstones() {
+	tbl, err := s.db.Table("tombs")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true}), "Should configure tombstones")
+	past := time.Now().Add(-time.Hour).UTC()
+	future := time.Now().Add(time.Hour).UTC()
+	conflict := func(key string, data []byte, t time.Time) {
+		file := filepath.Join(tbl.path, key+" (conflicted copy)"+recExt)
+		s.Nil(ioutil.WriteFile(file, data, 0644), "Should write conflict for %v", key)
+		s.Nil(os.Chtimes(file, t, t), "Should set time for %v", key)
+	}
+	tomb := func(t time.Time) []byte {
+		data, err := encodeEnvelope(&Meta{Created: t, Modified: t, Tombstone: true}, nil)
+		if err != nil {
+			s.T().Fatal("encodeEnvelope", err)
+		}
+		return data
+	}
+
+	// A newer delete should beat an older write, and vice versa.
+	s.Nil(tbl.Set("deleted", []byte("x")), "Should set deleted")
+	s.Nil(tbl.Delete("deleted"), "Should delete deleted")
+	conflict("deleted", []byte("older"), past)
+	s.Nil(tbl.Set("current", []byte("current")), "Should set current")
+	conflict("current", tomb(past), past)
+	s.Nil(tbl.Set("replaced", []byte("replaced")), "Should set replaced")
+	conflict("replaced", tomb(future), future)
+	conflict("missing", tomb(future), future)
+
+	n, err := tbl.ResolveConflicts(LatestWins)
+	s.Nil(err, "Should have no error from ResolveConflicts")
+	s.Equal(4, n, "Should resolve four conflicts")
+	_, err = tbl.Get("deleted")
+	s.Equal(os.ErrNotExist, err, "Should keep newer tombstone")
+	val, err := tbl.Get("current")
+	s.Nil(err, "Should get current")
+	s.Equal("current", string(val), "Should keep newer value")
+	for _, key := range []string{"replaced", "missing"} {
+		_, err = tbl.Get(key)
+		s.Equal(os.ErrNotExist, err, "Should have deleted %v", key)
+		meta, err := readMeta(filepath.Join(tbl.path, key+recExt))
+		s.Nil(err, "Should read tombstone for %v", key)
+		if s.NotNil(meta, "Should have tombstone for %v", key) {
+			s.True(meta.Tombstone, "Should have tombstone for %v", key)
+			s.True(future.Equal(meta.Modified), "Should keep time of delete for %v", key)
+		}
+	}
+	keys, err := tbl.Keys()
+	s.Nil(err, "Should have no error from Keys")
+	s.Equal([]string{"current"}, keys, "Should have only current key")
+
+	// Keeping a nonexistent record should not leave a file behind.
+	raw, err := s.db.Table("raw")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	file := filepath.Join(raw.path, "nope (conflicted copy)"+recExt)
+	s.Nil(ioutil.WriteFile(file, []byte("nope"), 0644), "Should write conflict")
+	n, err = raw.ResolveConflicts(func(_ string, current, _ *ConflictVersion) (*ConflictVersion, error) {
+		return current, nil
+	})
+	s.Nil(err, "Should have no error from ResolveConflicts")
+	s.Equal(1, n, "Should resolve one conflict")
+	s.fileNotExists(filepath.Join(raw.path, "nope"+recExt))
+	s.fileNotExists(file)
+}
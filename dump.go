@@ -0,0 +1,298 @@
+package flockd
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrUnknownFormat is returned by Dump and Load for an unknown Format.
+var ErrUnknownFormat = errors.New("flockd: unknown dump format")
+
+// paxMeta is the PAX record key under which the tar format stores the
+// JSON-encoded Meta of a record.
+const paxMeta = "FLOCKD.meta"
+
+// Format defines the format of the output of Dump and the input to Load.
+type Format int
+
+const (
+	// FormatJSONL writes each record as a line of JSON, with the fields
+	// "table", "key", "value", and "meta". Nested table names are separated by
+	// forward slashes, the value is encoded in base64, and the meta is omitted
+	// for raw records.
+	FormatJSONL Format = iota
+
+	// FormatTar writes each record as a file in a tar archive, using the same
+	// layout as the database directory. Table directories have the extension
+	// ".tbl", records the extension ".kv", and records in the root table appear
+	// at the top of the archive. Metadata is stored in a PAX record.
+	FormatTar
+)
+
+// LoadPolicy defines how Load handles records that already exist.
+type LoadPolicy int
+
+const (
+	// LoadCreate creates records that don't exist, like Create, and halts the
+	// load with an error wrapping os.ErrExist when a record already exists.
+	LoadCreate LoadPolicy = iota
+
+	// LoadOverwrite sets every record, like Set, replacing existing records.
+	LoadOverwrite
+
+	// LoadSkipExisting creates records that don't exist, like Create, and
+	// skips records that already exist.
+	LoadSkipExisting
+)
+
+// dumpRecord represents a record in the FormatJSONL format.
+type dumpRecord struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	Meta  *Meta  `json:"meta,omitempty"`
+}
+
+// Dump writes every record in every table returned by Tables to w in format.
+// It reads each record with a shared lock, just like Get, and writes the
+// decrypted and decompressed value and its metadata. The Checksum, Encoding,
+// and KeyID describe how a record is stored, and so are omitted from the
+// metadata. Returns the number of records written.
+func (db *DB) Dump(w io.Writer, format Format) (int, error) {
+	var write func(rec *dumpRecord) error
+	var flush func() error
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		write = func(rec *dumpRecord) error { return enc.Encode(rec) }
+		flush = bw.Flush
+	case FormatTar:
+		tw := tar.NewWriter(w)
+		write = func(rec *dumpRecord) error { return writeTarRecord(tw, rec) }
+		flush = tw.Close
+	default:
+		return 0, ErrUnknownFormat
+	}
+
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, table := range tables {
+		if err := table.eachKey(func(key string) error {
+			val, meta, err := table.get(key)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if meta != nil {
+				meta.Checksum, meta.Encoding, meta.KeyID = "", "", ""
+			}
+			rec := &dumpRecord{filepath.ToSlash(table.name), key, val, meta}
+			if err := write(rec); err != nil {
+				return err
+			}
+			n++
+			return nil
+		}); err != nil {
+			return n, err
+		}
+	}
+	return n, flush()
+}
+
+// writeTarRecord writes rec to tw.
+func writeTarRecord(tw *tar.Writer, rec *dumpRecord) error {
+	name := rec.Key + recExt
+	if rec.Table != "" {
+		name = path.Join(rec.Table+tblExt, name)
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(rec.Value)),
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	}
+	if rec.Meta != nil {
+		data, err := json.Marshal(rec.Meta)
+		if err != nil {
+			return err
+		}
+		hdr.PAXRecords = map[string]string{paxMeta: string(data)}
+		hdr.ModTime = rec.Meta.Modified
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(rec.Value)
+	return err
+}
+
+// Load reads records in format from r and writes them to the database,
+// creating tables as necessary. Existing records are handled according to
+// policy. Records with metadata are written with that metadata intact,
+// including the Created and Modified times and WriterID, while raw records are
+// written just like Set. Records are compressed and encrypted as configured for
+// their tables. Returns the number of records written; records skipped by
+// LoadSkipExisting are not counted. Returns os.ErrInvalid for a table name that
+// would escape the database directory.
+func (db *DB) Load(r io.Reader, format Format, policy LoadPolicy) (int, error) {
+	var read func() (*dumpRecord, error)
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		read = func() (*dumpRecord, error) {
+			rec := &dumpRecord{}
+			if err := dec.Decode(rec); err != nil {
+				return nil, err
+			}
+			return rec, nil
+		}
+	case FormatTar:
+		tr := tar.NewReader(r)
+		read = func() (*dumpRecord, error) { return readTarRecord(tr) }
+	default:
+		return 0, ErrUnknownFormat
+	}
+
+	n := 0
+	for {
+		rec, err := read()
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		table, err := db.TableFromSlash(rec.Table)
+		if err != nil {
+			return n, fmt.Errorf("flockd: load table %q: %w", rec.Table, err)
+		}
+		loaded, err := table.load(rec, policy)
+		if err != nil {
+			return n, fmt.Errorf("flockd: load %q in table %q: %w", rec.Key, rec.Table, err)
+		}
+		if loaded {
+			n++
+		}
+	}
+}
+
+// readTarRecord reads the next record from tr, skipping directories.
+func readTarRecord(tr *tar.Reader) (*dumpRecord, error) {
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		// Parse the table and key from the name.
+		dir, file := path.Split(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.Ext(file) != recExt {
+			return nil, fmt.Errorf("flockd: %v is not a record", hdr.Name)
+		}
+		rec := &dumpRecord{Key: strings.TrimSuffix(file, recExt)}
+		if dir = strings.TrimSuffix(dir, "/"); dir != "" {
+			if path.Ext(dir) != tblExt {
+				return nil, fmt.Errorf("flockd: %v is not in a table", hdr.Name)
+			}
+			rec.Table = strings.TrimSuffix(dir, tblExt)
+		}
+
+		if data, ok := hdr.PAXRecords[paxMeta]; ok {
+			rec.Meta = &Meta{}
+			if err := json.Unmarshal([]byte(data), rec.Meta); err != nil {
+				return nil, err
+			}
+		}
+		if rec.Value, err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+		return rec, nil
+	}
+}
+
+// TableFromSlash returns the table named name, just like Table, but with forward
+// slashes separating nested table names, as in dumps, change logs, and network
+// protocols. An empty name returns the root table. Returns os.ErrInvalid if the
+// name would escape the database directory.
+func (db *DB) TableFromSlash(name string) (*Table, error) {
+	if name == "" {
+		return db.root, nil
+	}
+	if !validTableName(name) {
+		return nil, os.ErrInvalid
+	}
+	return db.Table(filepath.FromSlash(name))
+}
+
+// findTable returns the existing table named name, with forward slashes
+// separating nested table names, without creating it. Returns os.ErrNotExist if
+// the table does not exist, or os.ErrInvalid if the name would escape the
+// database directory.
+func (db *DB) findTable(name string) (*Table, error) {
+	if name == "" {
+		return db.root, nil
+	}
+	if !validTableName(name) {
+		return nil, os.ErrInvalid
+	}
+	info, err := os.Stat(filepath.Join(db.root.path, filepath.FromSlash(name)+tblExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	return db.Table(filepath.FromSlash(name))
+}
+
+// validTableName returns true if name, with forward slashes separating nested
+// table names, would not escape the database directory.
+func validTableName(name string) bool {
+	clean := path.Clean(name)
+	return clean == name && !path.IsAbs(clean) && clean != "." && clean != ".." &&
+		!strings.HasPrefix(clean, "../")
+}
+
+// load writes rec to the table according to policy. Returns true if it wrote
+// the record.
+func (table *Table) load(rec *dumpRecord, policy LoadPolicy) (bool, error) {
+	encode := func() ([]byte, error) {
+		if rec.Meta == nil {
+			return table.encode(rec.Key, rec.Value, nil)
+		}
+		meta := *rec.Meta
+		return table.seal(rec.Key, &meta, rec.Value)
+	}
+
+	var err error
+	if policy == LoadOverwrite {
+		err = table.set(rec.Key, encode)
+	} else if err = table.create(rec.Key, encode); err == os.ErrExist && policy == LoadSkipExisting {
+		return false, nil
+	}
+	return err == nil, err
+}
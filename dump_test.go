@@ -0,0 +1,197 @@
+package flockd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dumpDB populates the test database and returns the metadata for the record
+// "meta" in the "nested/tbl" table.
+func (s *TS) dumpDB() *Meta {
+	s.Nil(s.db.Set("root", []byte("root value")), "Should set root record")
+	tbl, err := s.db.Table("squish")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Compression: "gzip"}), "Should configure compression")
+	s.Nil(tbl.Set("gz", []byte("compressed")), "Should set compressed record")
+
+	tbl, err = s.db.Table(filepath.Join("nested", "tbl"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.SetWithMeta("meta", []byte("hi"), &Meta{
+		ContentType: "text/plain",
+		Headers:     map[string]string{"X-Foo": "bar"},
+	}), "Should set record with meta")
+	_, meta, err := tbl.GetWithMeta("meta")
+	if err != nil {
+		s.T().Fatal("GetWithMeta", err)
+	}
+	return meta
+}
+
+func (s *TS) TestDumpJSONL() {
+	meta := s.dumpDB()
+	buf := &bytes.Buffer{}
+	n, err := s.db.Dump(buf, FormatJSONL)
+	s.Nil(err, "Should have no error from Dump")
+	s.Equal(3, n, "Should have dumped three records")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	s.Len(lines, 3, "Should have three lines")
+	s.Contains(lines, `{"table":"","key":"root","value":"cm9vdCB2YWx1ZQ=="}`)
+	for _, line := range lines {
+		if strings.Contains(line, `"key":"gz"`) {
+			s.Contains(line, `"table":"squish"`, "Should have table name")
+			s.Contains(line, `"value":"Y29tcHJlc3NlZA=="`, "Should have decompressed value")
+			s.NotContains(line, `"encoding"`, "Should omit encoding")
+			s.NotContains(line, `"checksum"`, "Should omit checksum")
+		}
+		if strings.Contains(line, `"key":"meta"`) {
+			s.Contains(line, `"table":"nested/tbl"`, "Should have slashed table name")
+			s.Contains(line, `"content_type":"text/plain"`, "Should have content type")
+			s.Contains(line, `"X-Foo":"bar"`, "Should have headers")
+		}
+	}
+
+	// Load into another database.
+	dest := s.loadDB(FormatJSONL, buf.Bytes(), LoadCreate, 3)
+	s.checkLoaded(dest, meta)
+}
+
+func (s *TS) TestDumpTar() {
+	meta := s.dumpDB()
+	buf := &bytes.Buffer{}
+	n, err := s.db.Dump(buf, FormatTar)
+	s.Nil(err, "Should have no error from Dump")
+	s.Equal(3, n, "Should have dumped three records")
+
+	// Check the layout.
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	files := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		files[hdr.Name] = hdr.PAXRecords[paxMeta]
+	}
+	s.Len(files, 3, "Should have three files")
+	s.Equal("", files["root.kv"], "Should have raw root record")
+	s.Contains(files["squish.tbl/gz.kv"], `"created"`, "Should have compressed record metadata")
+	s.Contains(files["nested/tbl.tbl/meta.kv"], `"content_type":"text/plain"`, "Should have nested record metadata")
+
+	dest := s.loadDB(FormatTar, buf.Bytes(), LoadCreate, 3)
+	s.checkLoaded(dest, meta)
+}
+
+// loadDB loads data into a new database and returns it.
+func (s *TS) loadDB(format Format, data []byte, policy LoadPolicy, exp int) *DB {
+	dest, err := New(filepath.Join(s.dir, "dest"), time.Millisecond)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	n, err := dest.Load(bytes.NewReader(data), format, policy)
+	s.Nil(err, "Should have no error from Load")
+	s.Equal(exp, n, "Should have loaded %v records", exp)
+	return dest
+}
+
+// checkLoaded checks that dest contains the records created by dumpDB.
+func (s *TS) checkLoaded(dest *DB, meta *Meta) {
+	val, got, err := dest.GetWithMeta("root")
+	s.Nil(err, "Should have no error getting root record")
+	s.Equal("root value", string(val), "Should have root value")
+	s.Nil(got, "Should have raw root record")
+
+	tbl, err := dest.Table("squish")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, err = tbl.Get("gz")
+	s.Nil(err, "Should have no error getting compressed record")
+	s.Equal("compressed", string(val), "Should have compressed record value")
+
+	tbl, err = dest.Table(filepath.Join("nested", "tbl"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, got, err = tbl.GetWithMeta("meta")
+	s.Nil(err, "Should have no error getting record with meta")
+	s.Equal("hi", string(val), "Should have value for record with meta")
+	s.Equal(meta, got, "Should have preserved metadata")
+}
+
+func (s *TS) TestLoadPolicy() {
+	s.dumpDB()
+	buf := &bytes.Buffer{}
+	if _, err := s.db.Dump(buf, FormatJSONL); err != nil {
+		s.T().Fatal("Dump", err)
+	}
+	dest := s.loadDB(FormatJSONL, buf.Bytes(), LoadCreate, 3)
+	s.Nil(dest.Set("root", []byte("changed")), "Should set root record")
+	s.Nil(dest.Delete("root"), "Should delete root record")
+	s.Nil(dest.Set("other", []byte("other")), "Should set other record")
+
+	// Create should fail on the first existing record.
+	n, err := dest.Load(bytes.NewReader(buf.Bytes()), FormatJSONL, LoadCreate)
+	s.True(errors.Is(err, os.ErrExist), "Should have ErrExist from Load")
+	s.Contains(err.Error(), "flockd: load", "Should describe the record")
+	s.True(n < 3, "Should have loaded fewer than three records")
+
+	// Skip should load only the missing record.
+	s.Nil(dest.Delete("root"), "Should delete root record")
+	n, err = dest.Load(bytes.NewReader(buf.Bytes()), FormatJSONL, LoadSkipExisting)
+	s.Nil(err, "Should have no error from Load")
+	s.Equal(1, n, "Should have loaded one record")
+
+	// Overwrite should load them all.
+	s.Nil(dest.Set("root", []byte("changed")), "Should set root record")
+	n, err = dest.Load(bytes.NewReader(buf.Bytes()), FormatJSONL, LoadOverwrite)
+	s.Nil(err, "Should have no error from Load")
+	s.Equal(3, n, "Should have loaded three records")
+	val, err := dest.Get("root")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("root value", string(val), "Should have overwritten record")
+	val, err = dest.Get("other")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("other", string(val), "Should have left other record alone")
+}
+
+func (s *TS) TestDumpLoadErrors() {
+	_, err := s.db.Dump(&bytes.Buffer{}, Format(42))
+	s.Equal(ErrUnknownFormat, err, "Should have ErrUnknownFormat from Dump")
+	_, err = s.db.Load(&bytes.Buffer{}, Format(42), LoadCreate)
+	s.Equal(ErrUnknownFormat, err, "Should have ErrUnknownFormat from Load")
+
+	for _, table := range []string{"..", "../x", "/etc", "a/../..", "a//b"} {
+		in := `{"table":"` + table + `","key":"k","value":""}`
+		n, err := s.db.Load(strings.NewReader(in), FormatJSONL, LoadCreate)
+		s.Equal(0, n, "Should have loaded no records for %q", table)
+		s.True(errors.Is(err, os.ErrInvalid), "Should have ErrInvalid for %q", table)
+	}
+	n, err := s.db.Load(strings.NewReader(`{"table":"","key":"a/b","value":""}`), FormatJSONL, LoadCreate)
+	s.Equal(0, n, "Should have loaded no records for invalid key")
+	s.True(errors.Is(err, os.ErrInvalid), "Should have ErrInvalid for invalid key")
+	_, err = s.db.Load(strings.NewReader(`nonesuch`), FormatJSONL, LoadCreate)
+	s.NotNil(err, "Should have error for invalid JSON")
+
+	// Tar entries must be records in tables.
+	for _, name := range []string{"foo.txt", "foo/bar.kv"} {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Typeflag: tar.TypeReg}); err != nil {
+			s.T().Fatal("WriteHeader", err)
+		}
+		tw.Close()
+		n, err := s.db.Load(buf, FormatTar, LoadCreate)
+		s.Equal(0, n, "Should have loaded no records for %v", name)
+		s.NotNil(err, "Should have error for %v", name)
+	}
+}
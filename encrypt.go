@@ -0,0 +1,283 @@
+package flockd
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrNoKeyProvider is returned when a table is configured to encrypt
+	// values, or a record was encrypted, but no KeyProvider was passed to New.
+	ErrNoKeyProvider = errors.New("flockd: no key provider")
+
+	// ErrUnknownKey is returned by KeyRing when a key ID is unknown.
+	ErrUnknownKey = errors.New("flockd: unknown key")
+
+	// ErrDecrypt is returned when an encrypted payload cannot be decrypted,
+	// because it has been tampered with or the key is wrong.
+	ErrDecrypt = errors.New("flockd: decryption failed")
+)
+
+// KeyProvider defines the interface for providing keys to encrypt and decrypt
+// values with AES-GCM. Keys must be 16, 24, or 32 bytes long, to select
+// AES-128, AES-192, or AES-256. Pass a KeyProvider to New via WithKeyProvider.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key to use to encrypt values.
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the value of the key with the ID, to decrypt values.
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a simple KeyProvider that holds keys in memory.
+type KeyRing struct {
+	// Current is the ID of the key to use to encrypt values.
+	Current string
+
+	// Keys maps key IDs to keys.
+	Keys map[string][]byte
+}
+
+// CurrentKey returns the ID and value of the current key.
+func (kr *KeyRing) CurrentKey() (string, []byte, error) {
+	key, err := kr.Key(kr.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	return kr.Current, key, nil
+}
+
+// Key returns the key with the ID, or ErrUnknownKey if there is no such key.
+func (kr *KeyRing) Key(id string) ([]byte, error) {
+	key, ok := kr.Keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// WithKeyProvider sets the KeyProvider used to encrypt values in tables
+// configured to encrypt them, and to decrypt encrypted values.
+func WithKeyProvider(kp KeyProvider) Option {
+	return func(db *DB) {
+		db.keys = kp
+	}
+}
+
+// newGCM returns an AES-GCM AEAD for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aad returns the additional authenticated data for the record key: the path
+// of the table directory relative to the database directory, with forward
+// slashes, and the key, separated by a NUL byte, which neither may contain. The
+// path identifies the table no matter how its name was spelled, and stays the
+// same in a snapshot.
+func (table *Table) aad(key string) []byte {
+	rel, err := filepath.Rel(table.db.root.path, table.path)
+	if err != nil {
+		rel = table.path
+	}
+	return []byte(filepath.ToSlash(rel) + "\x00" + key)
+}
+
+// encrypt encrypts value with the current key, using aad, returned by
+// Table.aad, as additional authenticated data, so that the ciphertext cannot
+// be moved to another record in the same or any other table. Returns the key ID
+// and the nonce followed by the ciphertext.
+func (db *DB) encrypt(aad, value []byte) (string, []byte, error) {
+	if db.keys == nil {
+		return "", nil, ErrNoKeyProvider
+	}
+	id, secret, err := db.keys.CurrentKey()
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, value, aad), nil
+}
+
+// decrypt decrypts payload with the key with the ID, using the additional
+// authenticated data aad.
+func (db *DB) decrypt(id string, aad, payload []byte) ([]byte, error) {
+	if db.keys == nil {
+		return nil, ErrNoKeyProvider
+	}
+	secret, err := db.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, ciphertext := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	val, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return val, nil
+}
+
+// RotateKeys re-encrypts the records in every table returned by Tables. See
+// Table.RotateKeys for details. Returns the total number of records
+// re-encrypted.
+func (db *DB) RotateKeys(ctx context.Context) (int, error) {
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, table := range tables {
+		n, err := table.RotateKeys(ctx)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// RotateKeys re-encrypts every record in the table that was not encrypted with
+// the current key. If the table is configured to encrypt values, that includes
+// unencrypted records; if it is not, RotateKeys decrypts encrypted records. For
+// each record, RotateKeys acquires an exclusive lock, waiting up to the timeout
+// set for the database before returning a context.DeadlineExceeded error, then
+// decrypts the record and encrypts it again, preserving its metadata. Like any
+// other write, it keeps the previous version in history mode and records the
+// change in the change log. It skips tombstones. Returns the number of records
+// re-encrypted. The cancellation of ctx halts the rotation.
+func (table *Table) RotateKeys(ctx context.Context) (int, error) {
+	current := ""
+	if table.Config().Encrypt {
+		if table.db.keys == nil {
+			return 0, ErrNoKeyProvider
+		}
+		id, _, err := table.db.keys.CurrentKey()
+		if err != nil {
+			return 0, err
+		}
+		current = id
+	}
+
+	n := 0
+	err := table.eachKey(func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rotated, err := table.rotate(key, current)
+		if rotated {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// rotate re-encrypts the record for key under an exclusive lock if it was not
+// encrypted with the key with the ID current. Returns true if it re-encrypted
+// the record.
+func (table *Table) rotate(key, current string) (bool, error) {
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return false, err
+	}
+	defer dbLock.Unlock()
+
+	// Make sure the file still exists.
+	file := filepath.Join(table.path, key+recExt)
+	fh, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	fh.Close()
+
+	// Take an exclusive lock on the key file, and leave alone a file
+	// recreated by locking it after another process deleted it.
+	lock, err := lockRecord(file, table.timeout)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+	if lock.created != nil {
+		return false, nil
+	}
+
+	// Read and decode the file.
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+
+	// Leave tombstones alone; they have no value to encrypt.
+	if hasEnvelope(data) {
+		if _, meta, err := decodeEnvelope(data); err == nil && meta.Tombstone {
+			return false, nil
+		}
+	}
+	val, meta, err := table.decode(key, data)
+	if err != nil {
+		return false, err
+	}
+	keyID := ""
+	if meta != nil {
+		keyID = meta.KeyID
+	}
+	if keyID == current {
+		return false, nil
+	}
+
+	// Encrypt it again.
+	if meta == nil {
+		now := time.Now().UTC()
+		meta = &Meta{Created: now, Modified: now, WriterID: table.db.writerID}
+	}
+	if data, err = table.seal(key, meta, val); err != nil {
+		return false, err
+	}
+	tmp, err := table.writeTemp(key, data)
+	if err != nil {
+		return false, err
+	}
+	defer tmp.Release()
+
+	// Keep the current value in history mode.
+	if err := table.archive(key); err != nil {
+		return false, err
+	}
+
+	// Move the file and log the change.
+	if err := table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,263 @@
+package flockd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) keyDB(ring *KeyRing, opts ...Option) *DB {
+	db, err := New(s.dir, time.Millisecond, append(opts, WithKeyProvider(ring))...)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	return db
+}
+
+func (s *TS) TestEncryption() {
+	s.Equal(
+		ErrNoKeyProvider, s.db.Configure(TableConfig{Encrypt: true}),
+		"Should have ErrNoKeyProvider without a key provider",
+	)
+
+	ring := &KeyRing{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	db := s.keyDB(ring)
+	tbl, err := db.Table("secret")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true, Compression: "gzip"}), "Should configure encryption")
+
+	// Values should be encrypted on disk.
+	val := []byte("super secret token")
+	s.Nil(tbl.Set("token", val), "Should have no error from Set")
+	data, err := ioutil.ReadFile(filepath.Join(tbl.path, "token"+recExt))
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+	s.False(bytes.Contains(data, val), "Should not have plaintext on disk")
+
+	// But decrypted on read.
+	got, meta, err := tbl.GetWithMeta("token")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal(val, got, "Should have decrypted value")
+	s.Equal("k1", meta.KeyID, "Should have key ID")
+	s.Equal("gzip", meta.Encoding, "Should have encoding")
+
+	// A database without keys cannot decrypt.
+	other, err := s.db.Table("secret")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	got, err = other.Get("token")
+	s.Nil(got, "Should have no value without keys")
+	s.Equal(ErrNoKeyProvider, err, "Should have ErrNoKeyProvider")
+
+	// Nor can a database with the wrong keys.
+	wrong := s.keyDB(&KeyRing{Current: "k2", Keys: map[string][]byte{"k2": val[:16]}})
+	wtbl, err := wrong.Table("secret")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	got, err = wtbl.Get("token")
+	s.Nil(got, "Should have no value with unknown key")
+	s.Equal(ErrUnknownKey, err, "Should have ErrUnknownKey")
+}
+
+func (s *TS) TestTamperedCiphertext() {
+	ring := &KeyRing{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 16)},
+	}
+	db := s.keyDB(ring, WithVerifyPolicy(VerifyIgnore))
+	s.Nil(db.Configure(TableConfig{Encrypt: true}), "Should configure encryption")
+	s.Nil(db.Set("a", []byte("hello")), "Should have no error from Set")
+	s.Nil(db.Set("b", []byte("goodbye")), "Should have no error from Set")
+	path := filepath.Join(db.root.path, "a"+recExt)
+	orig, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+
+	// Flip a bit in the ciphertext.
+	s.corrupt(db.root, "a")
+	got, err := db.Get("a")
+	s.Nil(got, "Should have no value for tampered ciphertext")
+	s.Equal(ErrDecrypt, err, "Should have ErrDecrypt for tampered ciphertext")
+
+	// The checksum should catch it first by default.
+	strict := s.keyDB(ring)
+	got, err = strict.Get("a")
+	s.Nil(got, "Should have no value for tampered ciphertext")
+	s.Equal(ErrChecksum, err, "Should have ErrChecksum for tampered ciphertext")
+
+	// Fixing up the checksum should not help.
+	payload, meta, err := decodeEnvelope(append([]byte{}, orig...))
+	if err != nil {
+		s.T().Fatal("decodeEnvelope", err)
+	}
+	payload[len(payload)-1] ^= 0x01
+	meta.Checksum = checksum(payload)
+	data, err := encodeEnvelope(meta, payload)
+	if err != nil {
+		s.T().Fatal("encodeEnvelope", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err = strict.Get("a")
+	s.Nil(got, "Should have no value for tampered ciphertext")
+	s.Equal(ErrDecrypt, err, "Should have ErrDecrypt for tampered ciphertext")
+
+	// Nor should moving ciphertext to another key.
+	if err := ioutil.WriteFile(path, orig, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err = strict.Get("a")
+	s.Nil(err, "Should have no error from Get for restored file")
+	s.Equal("hello", string(got), "Should have restored value")
+	if err := ioutil.WriteFile(filepath.Join(db.root.path, "b"+recExt), orig, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err = strict.Get("b")
+	s.Nil(got, "Should have no value for moved ciphertext")
+	s.Equal(ErrDecrypt, err, "Should have ErrDecrypt for moved ciphertext")
+
+	// Or to the same key in another table.
+	tbl, err := strict.Table("other")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tbl.path, "a"+recExt), orig, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err = tbl.Get("a")
+	s.Nil(got, "Should have no value for ciphertext moved to another table")
+	s.Equal(ErrDecrypt, err, "Should have ErrDecrypt for ciphertext moved to another table")
+
+	// But the spelling of the table name should not matter.
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true}), "Should configure encryption")
+	s.Nil(tbl.Set("a", []byte("hello")), "Should have no error from Set")
+	alias, err := s.keyDB(ring).Table("." + string(os.PathSeparator) + "other")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	got, err = alias.Get("a")
+	s.Nil(err, "Should have no error from Get via another spelling")
+	s.Equal("hello", string(got), "Should have value via another spelling")
+}
+
+func (s *TS) TestRotateKeys() {
+	ring := &KeyRing{
+		Current: "k1",
+		Keys:    map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+	}
+	db := s.keyDB(ring)
+	tbl, err := db.Table("rotate")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Set("raw", []byte("raw")), "Should have no error from Set")
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true}), "Should configure encryption")
+	s.Nil(tbl.SetWithMeta("a", []byte("a"), &Meta{ContentType: "text/plain"}), "Should set a")
+	s.Nil(tbl.Set("b", []byte("b")), "Should set b")
+	_, before, err := tbl.GetWithMeta("a")
+	if err != nil {
+		s.T().Fatal("GetWithMeta", err)
+	}
+
+	// Rotation should encrypt the raw record.
+	n, err := tbl.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(1, n, "Should have encrypted one record")
+
+	// Switch to a new key and rotate.
+	ring.Keys["k2"] = bytes.Repeat([]byte{2}, 32)
+	ring.Current = "k2"
+	n, err = db.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(3, n, "Should have rotated three records")
+	n, err = db.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(0, n, "Should have rotated no records")
+
+	// The old key should no longer be needed.
+	delete(ring.Keys, "k1")
+	for _, key := range []string{"raw", "a", "b"} {
+		got, meta, err := tbl.GetWithMeta(key)
+		s.Nil(err, "Should have no error from GetWithMeta %v", key)
+		s.Equal(key, string(got), "Should have value for %v", key)
+		s.Equal("k2", meta.KeyID, "Should have new key ID for %v", key)
+	}
+
+	// Metadata should be preserved.
+	_, after, err := tbl.GetWithMeta("a")
+	if err != nil {
+		s.T().Fatal("GetWithMeta", err)
+	}
+	s.Equal(before.ContentType, after.ContentType, "Should preserve content type")
+	s.Equal(before.Created, after.Created, "Should preserve created time")
+	s.Equal(before.Modified, after.Modified, "Should preserve modified time")
+
+	// Disabling encryption and rotating should decrypt.
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should disable encryption")
+	n, err = tbl.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(3, n, "Should have decrypted three records")
+	data, err := ioutil.ReadFile(filepath.Join(tbl.path, "a"+recExt))
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+	s.True(bytes.HasSuffix(data, []byte("a")), "Should have plaintext payload")
+
+	// Rotation should keep history and log changes like any other write.
+	db = s.keyDB(ring, WithChangeLog())
+	if tbl, err = db.Table("rotate"); err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true, HistoryKeep: 5}), "Should configure history")
+	n, err = tbl.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(3, n, "Should have encrypted three records")
+	versions, err := tbl.History("a")
+	s.Nil(err, "Should have no error from History")
+	s.Len(versions, 1, "Should have archived the previous value")
+	changes, err := db.Changes(0, 0)
+	s.Nil(err, "Should have no error from Changes")
+	s.Len(changes, 3, "Should have logged three changes")
+	for _, c := range changes {
+		s.Equal(OpSet, c.Op, "Should have logged set for %v", c.Key)
+	}
+
+	// Rotation should leave tombstones alone.
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true, Tombstones: true}), "Should configure tombstones")
+	s.Nil(tbl.Delete("b"), "Should delete b")
+	changes, err = db.Changes(0, 0)
+	s.Nil(err, "Should have no error from Changes")
+	last := changes[len(changes)-1].Seq
+	ring.Keys["k3"] = bytes.Repeat([]byte{3}, 32)
+	ring.Current = "k3"
+	n, err = tbl.RotateKeys(context.Background())
+	s.Nil(err, "Should have no error from RotateKeys")
+	s.Equal(2, n, "Should have rotated two records")
+	changes, err = db.Changes(last, 0)
+	s.Nil(err, "Should have no error from Changes")
+	s.Len(changes, 2, "Should have logged two changes")
+	for _, c := range changes {
+		s.NotEqual("b", c.Key, "Should not log tombstone")
+	}
+	_, err = tbl.Get("b")
+	s.True(os.IsNotExist(err), "Should keep b deleted")
+
+	// Rotation should halt when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tbl.RotateKeys(ctx)
+	s.Equal(context.Canceled, err, "Should have canceled error")
+}
@@ -0,0 +1,313 @@
+package flockd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The envelope format starts with the magic bytes envMagic, followed by a
+// version byte, the length of the JSON-encoded Meta as a 32-bit big-endian
+// integer, the Meta itself, and finally the payload.
+const (
+	envMagic   = "\x00flockd"
+	envVersion = 1
+	envHdrLen  = len(envMagic) + 1 + 4
+	envMaxMeta = 1 << 20
+	sumPrefix  = "sha256:"
+)
+
+// ErrCorrupt is returned when a record file starts with the envelope magic
+// bytes but cannot be decoded.
+var ErrCorrupt = errors.New("flockd: corrupt record")
+
+// Meta contains the metadata stored in the envelope header of a record. Raw
+// records, written by tables that do not use envelopes, have no metadata.
+type Meta struct {
+	// ContentType describes the format of the payload, e.g., "application/json".
+	ContentType string `json:"content_type,omitempty"`
+
+	// Created is the time the record was first written. It is preserved when
+	// the record is replaced.
+	Created time.Time `json:"created"`
+
+	// Modified is the time the record was last written.
+	Modified time.Time `json:"modified"`
+
+	// WriterID identifies the process that last wrote the record. See
+	// WithWriterID.
+	WriterID string `json:"writer_id,omitempty"`
+
+	// Checksum is the checksum of the payload as stored in the file, prefixed
+	// with the name of the algorithm, e.g., "sha256:".
+	Checksum string `json:"checksum,omitempty"`
+
+	// Encoding is the name of the Codec used to compress the payload, if any.
+	Encoding string `json:"encoding,omitempty"`
+
+	// KeyID is the ID of the key used to encrypt the payload, if any.
+	KeyID string `json:"key_id,omitempty"`
+
+	// Headers contains user-defined headers.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Tombstone indicates that the record has been deleted in tombstone mode.
+	// The Modified time is the time of deletion.
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+// hasEnvelope returns true if data starts with the envelope magic bytes.
+func hasEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(envMagic))
+}
+
+// checksum returns the checksum of payload, prefixed with the algorithm name.
+func checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return sumPrefix + hex.EncodeToString(sum[:])
+}
+
+// encodeEnvelope encodes meta and payload in the envelope format.
+func encodeEnvelope(meta *Meta, payload []byte) ([]byte, error) {
+	hdr, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, envHdrLen, envHdrLen+len(hdr)+len(payload))
+	copy(buf, envMagic)
+	buf[len(envMagic)] = envVersion
+	binary.BigEndian.PutUint32(buf[len(envMagic)+1:], uint32(len(hdr)))
+	buf = append(buf, hdr...)
+	return append(buf, payload...), nil
+}
+
+// decodeEnvelope decodes data. If data is not in the envelope format, it is
+// returned as-is with a nil Meta. Returns ErrCorrupt if data starts with the
+// envelope magic bytes but cannot be decoded.
+func decodeEnvelope(data []byte) ([]byte, *Meta, error) {
+	if !hasEnvelope(data) {
+		return data, nil, nil
+	}
+	size, err := envMetaLen(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < envHdrLen+size {
+		return nil, nil, ErrCorrupt
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(data[envHdrLen:envHdrLen+size], meta); err != nil {
+		return nil, nil, ErrCorrupt
+	}
+	return data[envHdrLen+size:], meta, nil
+}
+
+// envMetaLen validates the envelope version in hdr and returns the length of
+// the encoded Meta that follows it.
+func envMetaLen(hdr []byte) (int, error) {
+	if len(hdr) < envHdrLen || hdr[len(envMagic)] != envVersion {
+		return 0, ErrCorrupt
+	}
+	size := int(binary.BigEndian.Uint32(hdr[len(envMagic)+1:]))
+	if size > envMaxMeta {
+		return 0, ErrCorrupt
+	}
+	return size, nil
+}
+
+// readMeta reads the envelope Meta from the file at path without reading the
+// payload. Returns nil if the file does not exist, is empty, or is not in the
+// envelope format.
+func readMeta(path string) (*Meta, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fh.Close()
+
+	hdr := make([]byte, envHdrLen)
+	if _, err := io.ReadFull(fh, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !hasEnvelope(hdr) {
+		return nil, nil
+	}
+	size, err := envMetaLen(hdr)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(fh, buf); err != nil {
+		return nil, ErrCorrupt
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return nil, ErrCorrupt
+	}
+	return meta, nil
+}
+
+// encode prepares value for storage in the record file for key. If the table
+// uses envelopes, compression, or encryption, meta is not nil, or value would
+// be mistaken for an envelope, encode wraps value in an envelope, filling in
+// the Modified time and WriterID and preserving the Created time of any
+// existing record. The caller must hold an exclusive lock on the record file.
+func (table *Table) encode(key string, value []byte, meta *Meta) ([]byte, error) {
+	if meta == nil && !table.Config().enveloped() && !hasEnvelope(value) {
+		return value, nil
+	}
+
+	env := Meta{}
+	if meta != nil {
+		env = *meta
+	}
+	prev, err := readMeta(filepath.Join(table.path, key+recExt))
+	if err != nil && err != ErrCorrupt {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if prev != nil && !prev.Created.IsZero() && !prev.Tombstone {
+		env.Created = prev.Created
+	} else if env.Created.IsZero() {
+		env.Created = now
+	}
+	env.Modified = now
+	env.WriterID = table.db.writerID
+	return table.seal(key, &env, value)
+}
+
+// seal compresses and encrypts value for key as configured for the table,
+// records the Encoding, KeyID, and Checksum in meta, and encodes them in the
+// envelope format.
+func (table *Table) seal(key string, meta *Meta, value []byte) ([]byte, error) {
+	cfg := table.Config()
+	var err error
+
+	// Compress the value.
+	meta.Encoding = cfg.Compression
+	if meta.Encoding != "" {
+		if value, err = compress(meta.Encoding, value); err != nil {
+			return nil, err
+		}
+	}
+
+	// Encrypt the value.
+	meta.KeyID = ""
+	if cfg.Encrypt {
+		if meta.KeyID, value, err = table.db.encrypt(table.aad(key), value); err != nil {
+			return nil, err
+		}
+	}
+
+	meta.Checksum = checksum(value)
+	return encodeEnvelope(meta, value)
+}
+
+// decode decodes the contents of the record file for key, verifying its
+// checksum unless the database verify policy is VerifyIgnore, and decrypting
+// and decompressing its payload.
+func (table *Table) decode(key string, data []byte) ([]byte, *Meta, error) {
+	val, meta, err := decodeEnvelope(data)
+	if err != nil || meta == nil {
+		return val, nil, err
+	}
+	if table.db.verify != VerifyIgnore {
+		if err := verifyChecksum(meta, val); err != nil {
+			return nil, nil, err
+		}
+	}
+	if meta.KeyID != "" {
+		if val, err = table.db.decrypt(meta.KeyID, table.aad(key), val); err != nil {
+			return nil, nil, err
+		}
+	}
+	if meta.Encoding != "" {
+		if val, err = decompress(meta.Encoding, val); err != nil {
+			return nil, nil, err
+		}
+	}
+	return val, meta, nil
+}
+
+// GetWithMeta returns the value and metadata for the key by reading the file
+// named for the key, plus the extension ".kv", from the root directory.
+func (db *DB) GetWithMeta(key string) ([]byte, *Meta, error) {
+	return db.root.GetWithMeta(key)
+}
+
+// SetWithMeta sets the value and metadata for the key by writing them to the
+// file named for the key, plus the extension ".kv", in the root directory.
+func (db *DB) SetWithMeta(key string, val []byte, meta *Meta) error {
+	return db.root.SetWithMeta(key, val, meta)
+}
+
+// CreateWithMeta creates the key with the value and metadata in the root
+// directory, but only if it does not already exist.
+func (db *DB) CreateWithMeta(key string, val []byte, meta *Meta) error {
+	return db.root.CreateWithMeta(key, val, meta)
+}
+
+// UpdateWithMeta updates the value and metadata for the key in the root
+// directory, but only if it already exists.
+func (db *DB) UpdateWithMeta(key string, val []byte, meta *Meta) error {
+	return db.root.UpdateWithMeta(key, val, meta)
+}
+
+// GetWithMeta works just like Get, but also returns the metadata from the
+// record's envelope. The Meta will be nil for a raw record, which has no
+// envelope. The returned value is decrypted and decompressed, but the Meta
+// Checksum refers to the payload as stored.
+func (table *Table) GetWithMeta(key string) ([]byte, *Meta, error) {
+	return table.get(key)
+}
+
+// SetWithMeta works just like Set, but always writes the value in an envelope
+// with the metadata, regardless of the table configuration. The ContentType and
+// Headers fields are taken from meta, which may be nil. The Created time is
+// preserved from any existing record, or else taken from meta if it is not
+// zero, or else set to the current time. The Modified time, WriterID, Encoding,
+// KeyID, and Checksum are always set by SetWithMeta.
+func (table *Table) SetWithMeta(key string, value []byte, meta *Meta) error {
+	if meta == nil {
+		meta = &Meta{}
+	}
+	return table.set(key, func() ([]byte, error) {
+		return table.encode(key, value, meta)
+	})
+}
+
+// CreateWithMeta works just like Create, but always writes the value in an
+// envelope with the metadata, as SetWithMeta does.
+func (table *Table) CreateWithMeta(key string, value []byte, meta *Meta) error {
+	if meta == nil {
+		meta = &Meta{}
+	}
+	return table.create(key, func() ([]byte, error) {
+		return table.encode(key, value, meta)
+	})
+}
+
+// UpdateWithMeta works just like Update, but always writes the value in an
+// envelope with the metadata, as SetWithMeta does.
+func (table *Table) UpdateWithMeta(key string, value []byte, meta *Meta) error {
+	if meta == nil {
+		meta = &Meta{}
+	}
+	return table.update(key, func() ([]byte, error) {
+		return table.encode(key, value, meta)
+	})
+}
@@ -0,0 +1,230 @@
+package flockd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestEnvelopeCodec() {
+	now := time.Now().UTC()
+	meta := &Meta{
+		ContentType: "text/plain",
+		Created:     now,
+		Modified:    now,
+		WriterID:    "test",
+		Checksum:    checksum([]byte("hello")),
+		Headers:     map[string]string{"foo": "bar"},
+	}
+	data, err := encodeEnvelope(meta, []byte("hello"))
+	s.Nil(err, "Should have no error from encodeEnvelope")
+	s.True(hasEnvelope(data), "Should have envelope magic")
+
+	val, got, err := decodeEnvelope(data)
+	s.Nil(err, "Should have no error from decodeEnvelope")
+	s.Equal("hello", string(val), "Should have the payload")
+	s.Equal(meta, got, "Should have the metadata")
+
+	// Raw data should pass through.
+	val, got, err = decodeEnvelope([]byte("raw"))
+	s.Nil(err, "Should have no error decoding raw data")
+	s.Nil(got, "Should have no metadata for raw data")
+	s.Equal("raw", string(val), "Should have raw data")
+
+	// Bad envelopes should be corrupt.
+	for name, bad := range map[string][]byte{
+		"truncated prefix": []byte(envMagic),
+		"bad version":      append([]byte(envMagic), 99, 0, 0, 0, 0),
+		"truncated meta":   data[:envHdrLen+2],
+		"bad meta":         append(append([]byte(envMagic), envVersion, 0, 0, 0, 2), "{x"...),
+	} {
+		val, got, err := decodeEnvelope(bad)
+		s.Nil(val, "Should have no value for %v", name)
+		s.Nil(got, "Should have no meta for %v", name)
+		s.Equal(ErrCorrupt, err, "Should have ErrCorrupt for %v", name)
+	}
+}
+
+func (s *TS) TestGetSetWithMeta() {
+	db, err := New(s.dir, time.Second, WithWriterID("tester"))
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	tbl, err := db.Table("meta")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+
+	// Raw records have no metadata.
+	key := "raw"
+	s.Nil(tbl.Set(key, []byte("hi")), "Should have no error from Set")
+	val, meta, err := tbl.GetWithMeta(key)
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Nil(meta, "Should have no metadata for raw record")
+	s.Equal("hi", string(val), "Should have raw value")
+	s.fileContains(filepath.Join(tbl.path, key+recExt), []byte("hi"))
+
+	// Write a record with metadata.
+	key = "enveloped"
+	s.Nil(tbl.SetWithMeta(key, []byte("hello"), &Meta{
+		ContentType: "text/plain",
+		Headers:     map[string]string{"lang": "en"},
+	}), "Should have no error from SetWithMeta")
+	val, meta, err = tbl.GetWithMeta(key)
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("hello", string(val), "Should have payload")
+	if s.NotNil(meta, "Should have metadata") {
+		s.Equal("text/plain", meta.ContentType, "Should have content type")
+		s.Equal("tester", meta.WriterID, "Should have writer ID")
+		s.Equal(checksum([]byte("hello")), meta.Checksum, "Should have checksum")
+		s.Equal(map[string]string{"lang": "en"}, meta.Headers, "Should have headers")
+		s.False(meta.Created.IsZero(), "Should have created time")
+		s.Equal(meta.Created, meta.Modified, "Modified should equal created")
+	}
+	created := meta.Created
+
+	// Get should return only the payload.
+	val, err = tbl.Get(key)
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("hello", string(val), "Get should return the payload")
+
+	// Created should be preserved when the record is replaced.
+	time.Sleep(time.Millisecond)
+	s.Nil(tbl.SetWithMeta(key, []byte("goodbye"), nil), "Should have no error from SetWithMeta")
+	val, meta, err = tbl.GetWithMeta(key)
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("goodbye", string(val), "Should have new payload")
+	s.Equal(created, meta.Created, "Should have preserved created time")
+	s.True(meta.Modified.After(created), "Should have updated modified time")
+	s.Empty(meta.ContentType, "Should have no content type")
+
+	// A raw value that looks like an envelope should be wrapped.
+	key = "tricky"
+	tricky := []byte(envMagic + "gotcha")
+	s.Nil(tbl.Set(key, tricky), "Should have no error from Set")
+	val, meta, err = tbl.GetWithMeta(key)
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.NotNil(meta, "Should have wrapped the value in an envelope")
+	s.Equal(tricky, val, "Should have the tricky value")
+
+	// DB methods should work on the root table.
+	s.Nil(db.SetWithMeta(key, []byte("root"), nil), "Should have no error from DB.SetWithMeta")
+	val, meta, err = db.GetWithMeta(key)
+	s.Nil(err, "Should have no error from DB.GetWithMeta")
+	s.NotNil(meta, "Should have metadata from the root table")
+	s.Equal("root", string(val), "Should have value from the root table")
+}
+
+func (s *TS) TestCreateUpdateWithMeta() {
+	tbl, err := s.db.Table("meta")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	meta := &Meta{Headers: map[string]string{"lang": "en"}}
+
+	// Update requires an existing record.
+	s.Equal(os.ErrNotExist, tbl.UpdateWithMeta("foo", []byte("x"), meta), "Should have ErrNotExist from UpdateWithMeta")
+	s.fileNotExists(filepath.Join(tbl.path, "foo"+recExt))
+
+	s.Nil(tbl.CreateWithMeta("foo", []byte("hello"), meta), "Should have no error from CreateWithMeta")
+	val, got, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("hello", string(val), "Should have created value")
+	if s.NotNil(got, "Should have metadata") {
+		s.Equal(meta.Headers, got.Headers, "Should have headers")
+	}
+	s.Equal(os.ErrExist, tbl.CreateWithMeta("foo", []byte("x"), nil), "Should have ErrExist from CreateWithMeta")
+
+	// Update replaces the metadata.
+	s.Nil(tbl.UpdateWithMeta("foo", []byte("goodbye"), nil), "Should have no error from UpdateWithMeta")
+	val, got, err = tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("goodbye", string(val), "Should have updated value")
+	if s.NotNil(got, "Should have metadata") {
+		s.Nil(got.Headers, "Should have no headers")
+	}
+
+	// DB methods should work on the root table.
+	s.Nil(s.db.CreateWithMeta("foo", []byte("root"), meta), "Should have no error from DB.CreateWithMeta")
+	s.Nil(s.db.UpdateWithMeta("foo", []byte("toor"), meta), "Should have no error from DB.UpdateWithMeta")
+	val, got, err = s.db.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from DB.GetWithMeta")
+	s.Equal("toor", string(val), "Should have value from the root table")
+	s.NotNil(got, "Should have metadata from the root table")
+}
+
+func (s *TS) TestEnvelopeTable() {
+	tbl, err := s.db.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+
+	// Write a raw record, then switch to envelopes.
+	s.Nil(tbl.Set("old", []byte("raw")), "Should have no error from Set")
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should have no error from Configure")
+	s.Nil(tbl.Create("new", []byte("wrapped")), "Should have no error from Create")
+	s.Nil(tbl.Update("old", []byte("rewrapped")), "Should have no error from Update")
+
+	for key, exp := range map[string]string{"old": "rewrapped", "new": "wrapped"} {
+		val, meta, err := tbl.GetWithMeta(key)
+		s.Nil(err, "Should have no error from GetWithMeta %v", key)
+		s.NotNil(meta, "Should have metadata for %v", key)
+		s.Equal(exp, string(val), "Should have value for %v", key)
+		data, err := ioutil.ReadFile(filepath.Join(tbl.path, key+recExt))
+		if err != nil {
+			s.T().Fatal("ReadFile", err)
+		}
+		s.True(hasEnvelope(data), "File for %v should have an envelope", key)
+	}
+
+	// ForEach should return payloads.
+	records := map[string]string{}
+	s.Nil(tbl.ForEach(func(key string, val []byte) error {
+		records[key] = string(val)
+		return nil
+	}), "Should have no error from ForEach")
+	s.Equal(
+		map[string]string{"old": "rewrapped", "new": "wrapped"}, records,
+		"Should have payloads from ForEach",
+	)
+}
+
+// A write that fails before moving the new file into place should not leave
+// behind the empty file created by locking it.
+func (s *TS) TestFailedWrite() {
+	ring := &KeyRing{Current: "gone", Keys: map[string][]byte{}}
+	db, err := New(s.dir, time.Second, WithKeyProvider(ring))
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	tbl, err := db.Table("fail")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Encrypt: true}), "Should configure encryption")
+
+	s.Equal(ErrUnknownKey, tbl.Set("foo", []byte("foo")), "Should have ErrUnknownKey from Set")
+	s.fileNotExists(filepath.Join(tbl.path, "foo"+recExt))
+	s.Equal(ErrUnknownKey, tbl.Create("foo", []byte("foo")), "Should have ErrUnknownKey from Create")
+	s.fileNotExists(filepath.Join(tbl.path, "foo"+recExt))
+	_, err = tbl.Get("foo")
+	s.True(os.IsNotExist(err), "Should have no record")
+	keys, err := tbl.Keys()
+	s.Nil(err, "Should have no error from Keys")
+	s.Empty(keys, "Should have no keys")
+
+	// Once the key is available, the writes should work.
+	ring.Keys["gone"] = bytes.Repeat([]byte{1}, 32)
+	s.Nil(tbl.Create("foo", []byte("foo")), "Should create foo")
+	s.Nil(tbl.Set("foo", []byte("bar")), "Should set foo")
+
+	// But a failed write to an existing record should leave it alone.
+	delete(ring.Keys, "gone")
+	s.Equal(ErrUnknownKey, tbl.Set("foo", []byte("baz")), "Should have ErrUnknownKey from Set")
+	ring.Keys["gone"] = bytes.Repeat([]byte{1}, 32)
+	val, err := tbl.Get("foo")
+	s.Nil(err, "Should get foo")
+	s.Equal("bar", string(val), "Should have last value")
+}
@@ -0,0 +1,167 @@
+package flockd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrPrecondition is returned by conditional writes when the current version
+// of a record does not satisfy the condition.
+var ErrPrecondition = errors.New("flockd: precondition failed")
+
+// Record represents a record with its version information, as returned by
+// GetRecord.
+type Record struct {
+	// Value is the value of the record.
+	Value []byte
+
+	// Meta is the metadata of the record, or nil for a raw record.
+	Meta *Meta
+
+	// ETag identifies the version of the record. It is a quoted hash of the
+	// contents of the record file, suitable for use as an HTTP entity tag, and
+	// changes with every write.
+	ETag string
+
+	// Modified is the time the record was last written: the Modified time of
+	// its metadata, if any, or else the modification time of its file.
+	Modified time.Time
+}
+
+// etag returns the ETag for the contents of a record file.
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// checkFunc is the type of the function passed to setIf and deleteIf to check
+// the current contents of a record file under the exclusive lock. The data is
+// nil if the record does not exist or is a tombstone, and empty but not nil if
+// the record has an empty value. Returning an error prevents the write.
+type checkFunc func(data []byte) error
+
+// checkVersion reads the record file locked by lock and passes its contents to
+// fn. A file created by locking it means the record does not exist, but an
+// empty file that existed before is a record with an empty value, and fn gets
+// empty, non-nil data for it. checkVersion never removes the file; if the lock
+// created it, Unlock does.
+func (table *Table) checkVersion(lock *recordLock, fn checkFunc) error {
+	if lock.created != nil {
+		return fn(nil)
+	}
+	data, err := ioutil.ReadFile(lock.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fn(nil)
+		}
+		return err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	if hasEnvelope(data) {
+		if _, meta, err := decodeEnvelope(data); err == nil && meta.Tombstone {
+			data = nil
+		}
+	}
+	return fn(data)
+}
+
+// matchETag returns true if data is not nil and its ETag is in etags, or if
+// etags contains "*".
+func matchETag(data []byte, etags []string) bool {
+	return data != nil && tagIn(etag(data), etags)
+}
+
+// tagIn returns true if tag is in etags, or if etags contains "*". Weak ETags
+// match their strong equivalents.
+func tagIn(tag string, etags []string) bool {
+	for _, t := range etags {
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch returns a checkFunc that returns ErrPrecondition unless the record
+// exists and its ETag is one of etags, or etags contains "*".
+func ifMatch(etags []string) checkFunc {
+	return func(data []byte) error {
+		if !matchETag(data, etags) {
+			return ErrPrecondition
+		}
+		return nil
+	}
+}
+
+// ifNoneMatch returns a checkFunc that returns ErrPrecondition if the record
+// exists and its ETag is one of etags, or etags contains "*".
+func ifNoneMatch(etags []string) checkFunc {
+	return func(data []byte) error {
+		if matchETag(data, etags) {
+			return ErrPrecondition
+		}
+		return nil
+	}
+}
+
+// GetRecord returns the value for the key, just like GetWithMeta, along with
+// its version information.
+func (table *Table) GetRecord(key string) (*Record, error) {
+	// Make sure there is no directory separator.
+	if strings.ContainsRune(key, os.PathSeparator) {
+		return nil, os.ErrInvalid
+	}
+
+	data, info, sum, err := table.readRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	val, meta, err := table.decodeRecord(key, data, info, sum)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{Value: val, Meta: meta, ETag: etag(data), Modified: info.ModTime()}
+	if meta != nil && !meta.Modified.IsZero() {
+		rec.Modified = meta.Modified
+	}
+	return rec, nil
+}
+
+// SetIfMatch sets the value for the key, just like Set, but only if the ETag of
+// the current version of the record, as returned by GetRecord, is one of
+// etags, or etags contains "*" and the record exists. It checks the version
+// only once it has the exclusive lock, so that no other write can intervene.
+// Returns the ETag of the new version, or ErrPrecondition if the record does
+// not exist or its ETag does not match.
+func (table *Table) SetIfMatch(key string, value []byte, etags ...string) (string, error) {
+	return table.setIf(key, ifMatch(etags), func() ([]byte, error) {
+		return table.encode(key, value, nil)
+	})
+}
+
+// SetWithMetaIfMatch works just like SetIfMatch, but always writes the value in
+// an envelope with the metadata, as SetWithMeta does.
+func (table *Table) SetWithMetaIfMatch(key string, value []byte, meta *Meta, etags ...string) (string, error) {
+	if meta == nil {
+		meta = &Meta{}
+	}
+	return table.setIf(key, ifMatch(etags), func() ([]byte, error) {
+		return table.encode(key, value, meta)
+	})
+}
+
+// DeleteIfMatch deletes the key and its value, just like Delete, but only if
+// the ETag of the current version of the record, as returned by GetRecord, is
+// one of etags, or etags contains "*" and the record exists. It checks the
+// version only once it has the exclusive lock. Returns ErrPrecondition if the
+// record does not exist or its ETag does not match.
+func (table *Table) DeleteIfMatch(key string, etags ...string) error {
+	return table.deleteIf(key, ifMatch(etags))
+}
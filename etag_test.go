@@ -0,0 +1,183 @@
+package flockd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func (s *TS) TestGetRecord() {
+	tbl, err := s.db.Table("etag")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	_, err = tbl.GetRecord("foo")
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist for missing record")
+	_, err = tbl.GetRecord(filepath.Join("a", "b"))
+	s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for bad key")
+
+	// Raw records use the file modification time.
+	s.Nil(tbl.Set("foo", []byte("foo")), "Should set foo")
+	rec, err := tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.Equal("foo", string(rec.Value), "Should have value")
+	s.Nil(rec.Meta, "Should have no meta")
+	s.Regexp(`^"[0-9a-f]{32}"$`, rec.ETag, "Should have quoted ETag")
+	info, err := os.Stat(filepath.Join(tbl.path, "foo"+recExt))
+	s.Nil(err, "Should stat foo")
+	s.Equal(info.ModTime(), rec.Modified, "Should have file modification time")
+
+	// The ETag should be stable until the record changes, even to the same value.
+	again, err := tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.Equal(rec.ETag, again.ETag, "Should have same ETag")
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should configure envelopes")
+	s.Nil(tbl.Set("foo", []byte("foo")), "Should set foo again")
+	again, err = tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.NotEqual(rec.ETag, again.ETag, "Should have new ETag")
+	s.NotNil(again.Meta, "Should have meta")
+	s.Equal(again.Meta.Modified, again.Modified, "Should have meta modification time")
+
+	// Tombstones don't exist.
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true}), "Should configure tombstones")
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	_, err = tbl.GetRecord("foo")
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist for tombstone")
+}
+
+func (s *TS) TestSetIfMatch() {
+	tbl, err := s.db.Table("etag")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	file := filepath.Join(tbl.path, "foo"+recExt)
+
+	// Nothing to match.
+	_, err = tbl.SetIfMatch("foo", []byte("x"), "*")
+	s.Equal(ErrPrecondition, err, "Should have ErrPrecondition for missing record")
+	s.fileNotExists(file)
+	s.Equal(ErrPrecondition, tbl.DeleteIfMatch("foo", "*"), "Should have ErrPrecondition from DeleteIfMatch")
+
+	s.Nil(tbl.Set("foo", []byte("one")), "Should set foo")
+	rec, err := tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+
+	// Match the current version.
+	tag, err := tbl.SetIfMatch("foo", []byte("two"), `"nope"`, rec.ETag)
+	s.Nil(err, "Should have no error from SetIfMatch")
+	cur, err := tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.Equal("two", string(cur.Value), "Should have set value")
+	s.Equal(cur.ETag, tag, "Should return new ETag")
+
+	// The old version no longer matches.
+	_, err = tbl.SetIfMatch("foo", []byte("three"), rec.ETag)
+	s.Equal(ErrPrecondition, err, "Should have ErrPrecondition for old ETag")
+	s.Equal(ErrPrecondition, tbl.DeleteIfMatch("foo", rec.ETag), "Should not delete old ETag")
+	val, err := tbl.Get("foo")
+	s.Nil(err, "Should get foo")
+	s.Equal("two", string(val), "Should keep value")
+
+	// Weak ETags and wildcards match.
+	_, err = tbl.SetIfMatch("foo", []byte("three"), "W/"+tag)
+	s.Nil(err, "Should match weak ETag")
+	_, err = tbl.SetIfMatch("foo", []byte("four"), "*")
+	s.Nil(err, "Should match wildcard")
+	s.Nil(tbl.DeleteIfMatch("foo", "*"), "Should delete with wildcard")
+	s.fileNotExists(file)
+
+	// Write metadata.
+	s.Nil(tbl.Set("foo", []byte("one")), "Should set foo")
+	rec, err = tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	meta := &Meta{Headers: map[string]string{"a": "b"}}
+	_, err = tbl.SetWithMetaIfMatch("foo", []byte("two"), meta, `"nope"`)
+	s.Equal(ErrPrecondition, err, "Should have ErrPrecondition from SetWithMetaIfMatch")
+	tag, err = tbl.SetWithMetaIfMatch("foo", []byte("two"), meta, rec.ETag)
+	s.Nil(err, "Should have no error from SetWithMetaIfMatch")
+	cur, err = tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.Equal(tag, cur.ETag, "Should return new ETag")
+	s.Equal("two", string(cur.Value), "Should have set value")
+	if s.NotNil(cur.Meta, "Should have meta") {
+		s.Equal(meta.Headers, cur.Meta.Headers, "Should have headers")
+	}
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+
+	// An empty value is a record like any other.
+	s.Nil(tbl.Set("foo", []byte{}), "Should set empty foo")
+	rec, err = tbl.GetRecord("foo")
+	s.Nil(err, "Should have no error from GetRecord for empty value")
+	_, err = tbl.SetIfMatch("foo", []byte("x"), `"nope"`)
+	s.Equal(ErrPrecondition, err, "Should have ErrPrecondition for empty value")
+	s.FileExists(file, "Should keep empty value")
+	s.Equal(ErrPrecondition, tbl.DeleteIfMatch("foo", `"nope"`), "Should not delete empty value")
+	s.FileExists(file, "Should keep empty value")
+	_, err = tbl.setIf("foo", ifNoneMatch([]string{"*"}), func() ([]byte, error) { return []byte("x"), nil })
+	s.Equal(ErrPrecondition, err, "Should have ErrPrecondition for existing empty value")
+	s.FileExists(file, "Should keep empty value")
+	tag, err = tbl.SetIfMatch("foo", []byte{}, rec.ETag)
+	s.Nil(err, "Should match empty value")
+	s.Equal(rec.ETag, tag, "Should have same ETag for same empty value")
+	s.Nil(tbl.DeleteIfMatch("foo", tag), "Should delete empty value")
+	s.fileNotExists(file)
+
+	// Lock timeouts.
+	s.Nil(tbl.Set("foo", []byte("one")), "Should set foo")
+	lock, err := lockFile(file, false, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("lockFile", err)
+	}
+	defer lock.Unlock()
+	_, err = tbl.SetIfMatch("foo", []byte("x"), "*")
+	s.NotNil(err, "Should time out")
+	s.NotEqual(ErrPrecondition, err, "Should not have ErrPrecondition")
+}
+
+func (s *TS) TestLostUpdate() {
+	tbl, err := s.db.Table("counter")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	tbl.timeout = 5 * time.Second
+	s.Nil(tbl.Set("n", []byte("0")), "Should set n")
+
+	// Increment the counter with optimistic concurrency.
+	const workers, incs = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < incs; {
+				rec, err := tbl.GetRecord("n")
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, _ := strconv.Atoi(string(rec.Value))
+				_, err = tbl.SetIfMatch("n", []byte(strconv.Itoa(n+1)), rec.ETag)
+				if err == ErrPrecondition {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				i++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		s.Nil(err, "Should have no error from worker")
+	}
+	val, err := tbl.Get("n")
+	s.Nil(err, "Should get n")
+	s.Equal(strconv.Itoa(workers*incs), string(val), "Should lose no updates")
+}
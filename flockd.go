@@ -1,5 +1,4 @@
 /*
-
 Package flockd provides a simple file system-based key/value database that uses
 file locking for concurrency safety. Keys correspond to files, values to their
 contents, and tables to directories. Files are share-locked on read (Get and
@@ -18,11 +17,11 @@ unlinking is atomic and flockd is used exclusively to access files. If not, then
 all bets are off, and you can expect occasional bad reads.
 
 All of this may turn out to be a bad idea. YMMV. Warranty not included.
-
 */
 package flockd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
@@ -31,6 +30,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -45,8 +45,14 @@ const (
 // DB defines a file system directory as the root for a simple key/value
 // database.
 type DB struct {
-	root   *Table
-	tables *sync.Map
+	root      *Table
+	tables    *sync.Map
+	writerID  string
+	verify    VerifyPolicy
+	keys      KeyProvider
+	readOnly  bool
+	conflicts []ConflictPattern
+	changeLog bool
 }
 
 // Table represents a diretory into which keys and values can be written.
@@ -54,22 +60,42 @@ type Table struct {
 	name    string
 	path    string
 	timeout time.Duration
+	db      *DB
+	mu      sync.RWMutex
+	cfg     TableConfig
 }
 
 // New creates a new key/value database, with the specified directory as the
 // root table. If the directory does not exist, it will be created. The timeout
 // sets the maximum time flockd will wait for a file lock when attempting to
-// read, write, or delete a file, in nanoseconds. Returns an error if the
+// read, write, or delete a file, in nanoseconds. Pass Options to configure
+// optional behavior. If the directory is a snapshot created by DB.Snapshot, the
+// database will be read-only; see WithReadOnly. Returns an error if the
 // directory creation fails or if the timeout is less than or equal to zero.
-func New(dir string, timeout time.Duration) (*DB, error) {
+func New(dir string, timeout time.Duration, opts ...Option) (*DB, error) {
 	if timeout <= 0 {
 		return nil, errors.New("Invalid lock timeout")
 	}
-	root, err := newTable("", dir, timeout)
+	db := &DB{
+		tables:    &sync.Map{},
+		writerID:  defaultWriterID(),
+		conflicts: DefaultConflictPatterns,
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err == nil {
+		db.readOnly = true
+	}
+	root, err := db.newTable("", dir, timeout)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{root: root, tables: &sync.Map{}}, nil
+	db.root = root
+	if err := db.initChangeLog(); err != nil {
+		return nil, err
+	}
+	return db, nil
 }
 
 // Path returns the root path of the database, as passed to New().
@@ -77,6 +103,12 @@ func (db *DB) Path() string {
 	return db.root.path
 }
 
+// Root returns the root table of the database, which corresponds to the root
+// directory. The methods of DB that read and write keys operate on it.
+func (db *DB) Root() *Table {
+	return db.root
+}
+
 // Table creates a table in the database. The table corresponds to a
 // subdirectory of the database root directory. Its name will be the table name
 // plus the extension ".tbl". Keys and values can be written directly to the
@@ -90,7 +122,7 @@ func (db *DB) Table(name string) (*Table, error) {
 		return table.(*Table), nil
 	}
 
-	table, err := newTable(
+	table, err := db.newTable(
 		name,
 		filepath.Join(db.root.path, name+tblExt),
 		db.root.timeout,
@@ -102,11 +134,24 @@ func (db *DB) Table(name string) (*Table, error) {
 	return table, nil
 }
 
-func newTable(name, path string, timeout time.Duration) (*Table, error) {
-	if err := os.MkdirAll(path, 0755); err != nil {
+func (db *DB) newTable(name, path string, timeout time.Duration) (*Table, error) {
+	if db.readOnly {
+		// Make sure the directory exists.
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOTDIR}
+		}
+	} else if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
-	return &Table{name: name, path: path, timeout: timeout}, nil
+	table := &Table{name: name, path: path, timeout: timeout, db: db}
+	if err := table.loadConfig(); err != nil {
+		return nil, err
+	}
+	return table, nil
 }
 
 // Get returns the value for the key by reading the file named for the key, plus
@@ -135,6 +180,12 @@ func (db *DB) Set(key string, val []byte) error {
 	return db.root.Set(key, val)
 }
 
+// CompareAndSwap sets the value for the key in the root directory to new, but
+// only if its current value is old.
+func (db *DB) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return db.root.CompareAndSwap(key, old, new)
+}
+
 // Delete deletes the key and its value by deleting the file named for the key,
 // plus the extension ".kv", in the root directory.
 func (db *DB) Delete(key string) error {
@@ -153,22 +204,30 @@ func (db *DB) ForEach(feFunc ForEachFunc) error {
 // actively walks the file system from the root directory to find the table
 // directories and does not cache the results.
 func (db *DB) Tables() ([]*Table, error) {
-	timeout := db.root.timeout
 	rootPath := db.root.path
 	prefix := rootPath + string(os.PathSeparator)
 	tables := []*Table{}
 	if err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			// Ignore files deleted while walking.
+			if os.IsNotExist(err) && path != rootPath {
+				return nil
+			}
 			return err
 		}
 		if !info.IsDir() || (filepath.Ext(path) != tblExt && path != rootPath) {
 			return nil
 		}
-		name := ""
-		if path != rootPath {
-			name = strings.TrimSuffix(strings.TrimPrefix(path, prefix), tblExt)
+		if path == rootPath {
+			tables = append(tables, db.root)
+			return nil
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(path, prefix), tblExt)
+		table, err := db.loadTable(name, path)
+		if err != nil {
+			return err
 		}
-		tables = append(tables, &Table{name: name, path: path, timeout: timeout})
+		tables = append(tables, table)
 		return nil
 	}); err != nil {
 		return nil, err
@@ -176,6 +235,19 @@ func (db *DB) Tables() ([]*Table, error) {
 	return tables, nil
 }
 
+// loadTable returns the table previously created by Table, or else loads the
+// table from the existing directory at path.
+func (db *DB) loadTable(name, path string) (*Table, error) {
+	if table, ok := db.tables.Load(name); ok {
+		return table.(*Table), nil
+	}
+	table := &Table{name: name, path: path, timeout: db.root.timeout, db: db}
+	if err := table.loadConfig(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
 // Name returns the name of the table, which corresponds to the name of the
 // subdirectory without the extension ".tbl".
 func (table *Table) Name() string {
@@ -189,136 +261,266 @@ func (table *Table) Name() string {
 // acquires a shared file system lock on the file before reading its contents.
 // If the file has an exclusive lock on it, Get will wait up to the timeout set
 // for the database for the shared lock before returning a
-// context.DeadlineExceeded error.
+// context.DeadlineExceeded error. If the record was written in the envelope
+// format, Get returns only its payload; use GetWithMeta to also get its
+// metadata. Get verifies the checksum in the envelope or, for a raw record, the
+// checksum stored when it was written, and handles a record that fails
+// verification according to the database VerifyPolicy.
 func (table *Table) Get(key string) ([]byte, error) {
+	val, _, err := table.get(key)
+	return val, err
+}
+
+func (table *Table) get(key string) ([]byte, *Meta, error) {
 	// Make sure there is no directory separator.
 	if strings.ContainsRune(key, os.PathSeparator) {
-		return nil, os.ErrInvalid
+		return nil, nil, os.ErrInvalid
+	}
+
+	// Read the file.
+	data, info, sum, err := table.readRecord(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return table.decodeRecord(key, data, info, sum)
+}
+
+// decodeRecord unwraps the envelope, if any, from data read from the file for
+// key, described by info, or verifies the checksum sum of a raw record. It
+// quarantines the file if it's corrupt and the database is configured with
+// VerifyQuarantine. Returns os.ErrNotExist for a tombstone.
+func (table *Table) decodeRecord(key string, data []byte, info os.FileInfo, sum *rawSum) ([]byte, *Meta, error) {
+	val, meta, err := table.decode(key, data)
+	if err == nil && meta == nil && table.db.verify != VerifyIgnore {
+		if _, err = sum.verify(data, info); err != nil {
+			val = nil
+		}
 	}
+	if isCorrupt(err) && table.db.verify == VerifyQuarantine {
+		if _, qerr := table.quarantine(key); qerr != nil {
+			return nil, nil, qerr
+		}
+	}
+	if meta != nil && meta.Tombstone {
+		return nil, nil, os.ErrNotExist
+	}
+	return val, meta, err
+}
+
+// read reads the contents of the record file at path under a shared lock.
+func (table *Table) read(path string) ([]byte, error) {
+	data, _, err := table.readInfo(path)
+	return data, err
+}
+
+// readInfo reads the file at path under a shared lock, just like read, and
+// also returns its FileInfo.
+func (table *Table) readInfo(path string) ([]byte, os.FileInfo, error) {
+	data, info, _, err := table.readFile(path, "")
+	return data, info, err
+}
 
+// readRecord reads the record file for key under a shared lock, just like
+// readInfo. While it holds the lock, it also reads the checksum of a raw record,
+// so that the checksum matches the data read. The checksum is nil for an
+// envelope or a raw record without one.
+func (table *Table) readRecord(key string) ([]byte, os.FileInfo, *rawSum, error) {
+	return table.readFile(filepath.Join(table.path, key+recExt), table.sumPath(key))
+}
+
+// readFile reads the file at path under a shared lock, along with its
+// FileInfo, and, if sumPath is not empty and the file is not an envelope, the
+// checksum at sumPath.
+func (table *Table) readFile(path, sumPath string) ([]byte, os.FileInfo, *rawSum, error) {
 	// Open the file.
-	file := filepath.Join(table.path, key+recExt)
-	fh, err := os.Open(file)
+	fh, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, os.ErrNotExist
+			return nil, nil, nil, os.ErrNotExist
 		}
-		return nil, err
+		return nil, nil, nil, err
 	}
 	defer fh.Close()
 
-	// Take a shared lock.
-	lock, err := lockFile(file, false, table.timeout)
+	// Take a shared lock on the open file.
+	unlock, err := lockOpen(fh, false, table.timeout)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	defer lock.Unlock()
+	defer unlock()
 
 	// Fetch the contents.
-	val, err := ioutil.ReadAll(fh)
+	info, err := fh.Stat()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	return val, nil
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sumPath == "" || hasEnvelope(data) {
+		return data, info, nil, nil
+	}
+	sum, err := readSum(sumPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, info, sum, nil
 }
 
 // Set sets the value for the key by writing it to the file named for key, plus
 // the extension ".kv", in the table directory. The key must not contain a path
 // separator character; if it does, os.ErrInvalid will be returned.
 //
-// To set the value, Set first creates a temporary file in the table directory
-// and tries to acquire an exclusive lock. If the temporary file already has
-// exclusive lock, Set will wait up to the timeout set for the database to
-// acquire the lock before returning a context.DeadlineExceeded error. Once it
-// has the lock, it writes the value to the temporary file.
+// To set the value, Set first tries to acquire an exclusive lock on the file
+// with the key name. If the file already has a lock, Set will wait up to the
+// timeout set for the database to acquire the lock before returning a
+// context.DeadlineExceeded error.
 //
-// Next, it tries to acquire an exclusive lock on the file with the key name,
-// again waiting up to the database timeout before returning a
-// context.DeadlineExceeded error. Once it has the lock, it moves the temporary
-// file to the new file.
+// Next, it creates a temporary file in the table directory and tries to
+// acquire an exclusive lock, again waiting up to the database timeout before
+// returning a context.DeadlineExceeded error. Once it has the lock, it writes
+// the value to the temporary file, wrapped in an envelope if the table is
+// configured to use envelopes, and moves the temporary file to the new file.
 func (table *Table) Set(key string, value []byte) error {
+	return table.set(key, func() ([]byte, error) {
+		return table.encode(key, value, nil)
+	})
+}
+
+// set writes the data returned by encode to the file for key, just like Set.
+// It calls encode only once it has the exclusive lock.
+func (table *Table) set(key string, encode func() ([]byte, error)) error {
+	_, err := table.setIf(key, nil, encode)
+	return err
+}
+
+// setIf writes the data returned by encode to the file for key, just like Set,
+// but only if check, if not nil, returns no error for the current contents of
+// the file. It calls check and encode only once it has the exclusive lock.
+// Returns the ETag of the data written.
+func (table *Table) setIf(key string, check checkFunc, encode func() ([]byte, error)) (string, error) {
 	// Make sure there is no directory separator.
 	if strings.ContainsRune(key, os.PathSeparator) {
-		return os.ErrInvalid
+		return "", os.ErrInvalid
 	}
 
-	// Write to a temporary file.
-	tmp, err := table.writeTemp(key, value)
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer tmp.Release()
+	defer dbLock.Unlock()
 
-	// XXX Is it necessary to lock the destination file?
-	// Open the key file.
-	// Take an exclusive lock on the key file.
+	// Take an exclusive lock on the key file. Unlock removes the file if the
+	// lock created it and nothing replaced it.
 	file := filepath.Join(table.path, key+recExt)
-	lock, err := lockFile(file, true, table.timeout)
+	lock, err := lockRecord(file, table.timeout)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer lock.Unlock()
 
-	// Move the file.
-	return os.Rename(tmp.file, file)
+	// Check the current version.
+	if check != nil {
+		if err := table.checkVersion(lock, check); err != nil {
+			return "", err
+		}
+	}
+
+	// Write to a temporary file.
+	data, err := encode()
+	if err != nil {
+		return "", err
+	}
+	tmp, err := table.writeTemp(key, data)
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Release()
+
+	// Keep the current value in history mode, unless locking created the file.
+	if lock.created == nil {
+		if err := table.archive(key); err != nil {
+			return "", err
+		}
+	}
+
+	// Move the file and log the change.
+	if err := table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	}); err != nil {
+		return "", err
+	}
+	return etag(data), nil
 }
 
 // Create creates the key/value pair by writing it to the file named for key,
 // plus the extension ".kv", in the table directory, but only if the file does
 // not already exist. The key must not contain a path separator character; if it
 // does, os.ErrInvalid will be returned. Returns os.ErrExist if the file already
-// exists.
+// exists, unless it contains a tombstone, which Create replaces under an
+// exclusive lock.
 //
-// To create the file, Create first opens it with the key name, but only if it
-// doesn't already exist. It then tries to acquire an exclusive lock on the
-// file. It tries only once, and doesn't wait for a lock, so that if any other
-// process first got a lock, the file would be considered to already exist.
+// To create the file, Create first creates an empty temporary file in the
+// table directory and acquires an exclusive lock on it. It then links it to
+// the key name, but only if that file doesn't already exist, so that no other
+// process can lock the new file before Create does.
 //
-// Create then creates a temporary file in the table directory and tries to
+// Create then creates another temporary file in the table directory and tries to
 // acquire an exclusive lock. If the temporary file already has exclusive lock,
 // Create will wait up to the timeout set for the database to acquire the lock
 // before returning a context.DeadlineExceeded error. Once it has the lock, it
 // writes the value to the temporary file, then moves the temporary file to the
 // new file.
 func (table *Table) Create(key string, value []byte) error {
+	return table.create(key, func() ([]byte, error) {
+		return table.encode(key, value, nil)
+	})
+}
+
+// create writes the data returned by encode to the file for key, just like
+// Create. It calls encode only once it has the exclusive lock.
+func (table *Table) create(key string, encode func() ([]byte, error)) error {
 	// Make sure there is no directory separator.
 	if strings.ContainsRune(key, os.PathSeparator) {
 		return os.ErrInvalid
 	}
 
-	// Open the destination file, but only if it doesn't already exist.
-	file := filepath.Join(table.path, key+recExt)
-	fh, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
 	if err != nil {
-		if os.IsExist(err) {
-			return os.ErrExist
-		}
 		return err
 	}
-	defer fh.Close()
+	defer dbLock.Unlock()
 
-	// Take an exclusive lock on the file, but don't wait for it. Yes, there is
-	// a race condition here.
-	lock := flock.NewFlock(file)
-	locked, err := lock.TryLock()
+	// Create and lock the destination file, but only if it doesn't already
+	// exist. Unlock removes the empty file on failure.
+	file := filepath.Join(table.path, key+recExt)
+	lock, err := createRecord(file, table.timeout)
 	if err != nil {
+		if os.IsExist(err) {
+			return table.replaceTombstone(key, encode)
+		}
 		return err
 	}
-	if !locked {
-		// Someone beat us to it?
-		return os.ErrExist
-	}
 	defer lock.Unlock()
 
 	// Write to a temporary file.
-	tmp, err := table.writeTemp(key, value)
+	data, err := encode()
+	if err != nil {
+		return err
+	}
+	tmp, err := table.writeTemp(key, data)
 	if err != nil {
 		return err
 	}
 	defer tmp.Release()
 
-	// Move the file.
-	return os.Rename(tmp.file, file)
+	// Move the file and log the change.
+	return table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	})
 }
 
 // Update updates the value for the key by writing it to an existing file named
@@ -330,21 +532,35 @@ func (table *Table) Create(key string, value []byte) error {
 // To update the file, Update first opens the file with the key name for
 // writing. If the file does not exist, os.ErrNotExist will be returned.
 //
-// Next, Update creates a temporary file in the table directory and tries to
-// acquire an exclusive lock. If the temporary file already has exclusive lock,
-// Update will wait up to the timeout set for the database to acquire the lock
-// before returning a context.DeadlineExceeded error. Once it has the lock, it
-// writes the value to the temporary file.
+// Next, it tries to acquire an exclusive lock on the opened file, waiting up to
+// the timeout set for the database before returning a context.DeadlineExceeded
+// error.
 //
-// Next, it tries to acquire an exclusive lock on the opened file, again waiting
-// up to the database timeout before returning a context.DeadlineExceeded error.
-// Once it has the lock, it moves the temporary file to the new file.
+// Once it has the lock, Update creates a temporary file in the table directory
+// and tries to acquire an exclusive lock, again waiting up to the database
+// timeout before returning a context.DeadlineExceeded error. Once it has the
+// lock, it writes the value to the temporary file and moves it to the new file.
 func (table *Table) Update(key string, value []byte) error {
+	return table.update(key, func() ([]byte, error) {
+		return table.encode(key, value, nil)
+	})
+}
+
+// update writes the data returned by encode to the existing file for key, just
+// like Update. It calls encode only once it has the exclusive lock.
+func (table *Table) update(key string, encode func() ([]byte, error)) error {
 	// Make sure there is no directory separator.
 	if strings.ContainsRune(key, os.PathSeparator) {
 		return os.ErrInvalid
 	}
 
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer dbLock.Unlock()
+
 	// Open the file.
 	file := filepath.Join(table.path, key+recExt)
 	fh, err := os.OpenFile(file, os.O_WRONLY, 0600)
@@ -356,22 +572,155 @@ func (table *Table) Update(key string, value []byte) error {
 	}
 	defer fh.Close()
 
+	// Take an exclusive lock on the key file. If locking created the file,
+	// another process deleted it in the meantime.
+	lock, err := lockRecord(file, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if lock.created != nil {
+		return os.ErrNotExist
+	}
+
+	// Treat a tombstone as nonexistent.
+	if tomb, err := isTombstone(file); err != nil || tomb {
+		if tomb {
+			return os.ErrNotExist
+		}
+		return err
+	}
+
 	// Write to a temporary file.
-	tmp, err := table.writeTemp(key, value)
+	data, err := encode()
+	if err != nil {
+		return err
+	}
+	tmp, err := table.writeTemp(key, data)
 	if err != nil {
 		return err
 	}
 	defer tmp.Release()
 
-	// Take an exclusive lock on the key file.
-	lock, err := lockFile(file, true, table.timeout)
+	// Keep the current value in history mode.
+	if err := table.archive(key); err != nil {
+		return err
+	}
+
+	// Move the file and log the change.
+	return table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	})
+}
+
+// CompareAndSwap sets the value for the key to new, but only if its current
+// value is old. Returns true if it set the value. The key must not contain a
+// path separator character; if it does, os.ErrInvalid will be returned. If the
+// file does not already exist, os.ErrNotExist will be returned.
+//
+// CompareAndSwap first tries to acquire an exclusive lock on the file with the
+// key name, waiting up to the timeout set for the database before returning a
+// context.DeadlineExceeded error. Once it has the lock, it reads the current
+// value and compares it to old. If they're equal, it writes new to a temporary
+// file and moves it to the key file, just like Update, preserving any metadata,
+// before releasing the lock.
+func (table *Table) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	swapped := false
+	err := table.modify(key, func(val []byte, meta *Meta) ([]byte, *Meta, error) {
+		if !bytes.Equal(val, old) {
+			return nil, nil, errNoChange
+		}
+		swapped = true
+		return new, meta, nil
+	})
+	return swapped, err
+}
+
+// errNoChange is returned by a function passed to modify to leave the record
+// unchanged.
+var errNoChange = errors.New("no change")
+
+// modify reads the value and metadata of the existing record for key under an
+// exclusive lock and passes them to fn. If fn returns errNoChange, modify
+// leaves the record unchanged and returns nil. Otherwise, if fn returns no
+// error, modify writes the value it returns, along with the Meta if it's not
+// nil, just like SetWithMeta. Returns os.ErrNotExist if the record does not
+// exist.
+func (table *Table) modify(key string, fn func(val []byte, meta *Meta) ([]byte, *Meta, error)) error {
+	// Make sure there is no directory separator.
+	if strings.ContainsRune(key, os.PathSeparator) {
+		return os.ErrInvalid
+	}
+
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer dbLock.Unlock()
+
+	// Make sure the file exists.
+	file := filepath.Join(table.path, key+recExt)
+	fh, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	fh.Close()
+
+	// Take an exclusive lock on the key file. If locking created the file,
+	// another process deleted it in the meantime.
+	lock, err := lockRecord(file, table.timeout)
 	if err != nil {
 		return err
 	}
 	defer lock.Unlock()
+	if lock.created != nil {
+		return os.ErrNotExist
+	}
+
+	// Read and decode the current value.
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	val, meta, err := table.decode(key, data)
+	if err != nil {
+		return err
+	}
+	if meta != nil && meta.Tombstone {
+		return os.ErrNotExist
+	}
 
-	// Move the file.
-	return os.Rename(tmp.file, file)
+	// Let fn decide what to write.
+	if val, meta, err = fn(val, meta); err != nil {
+		if err == errNoChange {
+			return nil
+		}
+		return err
+	}
+
+	// Write to a temporary file.
+	if data, err = table.encode(key, val, meta); err != nil {
+		return err
+	}
+	tmp, err := table.writeTemp(key, data)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+
+	// Keep the current value in history mode.
+	if err := table.archive(key); err != nil {
+		return err
+	}
+
+	// Move the file and log the change.
+	return table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	})
 }
 
 // Delete deletes the key and its value by deleting the file named for key, plus
@@ -380,20 +729,38 @@ func (table *Table) Update(key string, value []byte) error {
 // deleting the file, Delete tries to acquire an exclusive lock. If the file
 // already has exclusive lock, Delete will wait up to the timeout set for the
 // database to acquire the lock before returning a context.DeadlineExceeded
-// error. Once it has acquired the lock, it deletes the file.
+// error. Once it has acquired the lock, it deletes the file, or moves it to the
+// trash if the table is configured for trash mode. In tombstone mode, it then
+// replaces the file with a tombstone. Deleting a key that does not exist is not
+// an error, so that Delete can safely be retried, except in trash mode, where
+// Delete returns os.ErrNotExist to report that it moved nothing to the trash.
 func (table *Table) Delete(key string) error {
+	return table.deleteIf(key, nil)
+}
+
+// deleteIf deletes the record for key, just like Delete, but only if check, if
+// not nil, returns no error for the current contents of the file. It calls
+// check only once it has the exclusive lock.
+func (table *Table) deleteIf(key string, check checkFunc) error {
 	// Make sure there is no directory separator.
 	if strings.ContainsRune(key, os.PathSeparator) {
 		return os.ErrInvalid
 	}
 
+	// Block snapshots while writing.
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return err
+	}
+	defer dbLock.Unlock()
+
 	// Open the file.
 	file := filepath.Join(table.path, key+recExt)
 	fh, err := os.Open(file)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Already gone.
-			return nil
+			return table.missing(check)
 		}
 		return err
 	}
@@ -404,15 +771,81 @@ func (table *Table) Delete(key string) error {
 		return os.ErrInvalid
 	}
 
-	// Take an exclusive lock.
-	lock, err := lockFile(file, true, table.timeout)
+	// Take an exclusive lock. If locking created the file, another process
+	// deleted it in the meantime.
+	lock, err := lockRecord(file, table.timeout)
 	if err != nil {
 		return err
 	}
 	defer lock.Unlock()
+	if lock.created != nil {
+		return table.missing(check)
+	}
+
+	// Check the current version.
+	if check != nil {
+		if err := table.checkVersion(lock, check); err != nil {
+			return err
+		}
+	}
+
+	// Leave a tombstone alone.
+	tomb, err := isTombstone(file)
+	if err != nil {
+		return err
+	}
+	if tomb {
+		return table.missing(nil)
+	}
+	return table.drop(key, nil)
+}
+
+// missing returns the result of deleteIf when there is no record to delete:
+// the error from check, if it is not nil, or else os.ErrNotExist in trash mode
+// and nil otherwise.
+func (table *Table) missing(check checkFunc) error {
+	if check != nil {
+		return check(nil)
+	}
+	if table.Config().Trash {
+		return os.ErrNotExist
+	}
+	return nil
+}
 
-	// Remove the file.
-	return os.Remove(file)
+// drop deletes the record file for key, once deleteIf or resolve has decided
+// to. It archives the file in history mode and moves it to the trash in trash
+// mode, then replaces it with a tombstone, keeping tomb if it is not nil, in
+// tombstone mode, or else removes it. The caller must hold an exclusive lock on
+// the record file, which must contain a value.
+func (table *Table) drop(key string, tomb *Meta) error {
+	// Keep the current value in history mode.
+	if err := table.archive(key); err != nil {
+		return err
+	}
+
+	return table.logChange(key, OpDelete, func() error {
+		// Move the file to the trash in trash mode.
+		cfg := table.Config()
+		if cfg.Trash {
+			if err := table.trash(key); err != nil {
+				return err
+			}
+		}
+
+		// Replace the file with a tombstone in tombstone mode, or else
+		// remove it.
+		if cfg.Tombstones {
+			if err := table.tombstone(key, tomb); err != nil {
+				return err
+			}
+		} else if !cfg.Trash {
+			if err := os.Remove(filepath.Join(table.path, key+recExt)); err != nil {
+				return err
+			}
+		}
+		return removeFile(table.sumPath(key))
+	})
 }
 
 // ForEachFunc is the type of the function called for each record fetched by
@@ -422,29 +855,49 @@ type ForEachFunc func(key string, value []byte) error
 
 // ForEach executes a function for each key/value pair in the table. Internally,
 // ForEach reads the table directory to find record files, fetches its contents
-// via Get(), and passes the key and retrieved value to feFunc. An error
+// via Get(), and passes the key and retrieved value to feFunc. Conflict files
+// left by file synchronization tools are skipped; see Conflicts. An error
 // returned by any of these steps, including from the feFunc function, causes
-// ForEach to halt the search and return the error. The feFunc function must not
-// modify the table; doing so results in undefined behavior.
+// ForEach to halt the search and return the error. Records deleted by another
+// process while ForEach runs are skipped. The feFunc function must not modify
+// the table; doing so results in undefined behavior.
 func (table *Table) ForEach(feFunc ForEachFunc) error {
+	return table.eachKey(func(key string) error {
+		val, err := table.Get(key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return feFunc(key, val)
+	})
+}
+
+// eachKey reads the table directory to find record files and calls fn for the
+// key of each, skipping conflict files. An error returned by fn halts the
+// search and is returned.
+func (table *Table) eachKey(fn func(key string) error) error {
 	dh, err := os.Open(table.path)
 	if err != nil {
 		return err
 	}
-	var files []os.FileInfo
+	defer dh.Close()
+
+	// Use ReadDir rather than Readdir, which fails on files deleted while
+	// reading the directory.
+	var entries []os.DirEntry
 	for err != io.EOF {
-		files, err = dh.Readdir(readNum)
+		entries, err = dh.ReadDir(readNum)
 		if err != nil && err != io.EOF {
 			return err
 		}
-		for _, dir := range files {
+		for _, dir := range entries {
 			if filepath.Ext(dir.Name()) == recExt && !dir.IsDir() {
-				key := strings.TrimSuffix(dir.Name(), recExt)
-				val, err := table.Get(key)
-				if err != nil {
-					return err
+				if _, ok := table.db.matchConflict(dir.Name()); ok {
+					continue
 				}
-				if err := feFunc(key, val); err != nil {
+				if err := fn(strings.TrimSuffix(dir.Name(), recExt)); err != nil {
 					return err
 				}
 			}
@@ -471,6 +924,109 @@ func lockFile(path string, exclusive bool, timeout time.Duration) (*flock.Flock,
 	return flock, nil
 }
 
+// recordLock is an exclusive lock on a record file. Locking a record that does
+// not exist creates an empty file to hold the lock, so the lock remembers the
+// file it created, if any, and Unlock removes that file unless something has
+// since replaced it. This keeps a failed write from leaving behind an empty
+// record.
+type recordLock struct {
+	fh      *os.File
+	unlock  func()
+	path    string
+	created os.FileInfo
+}
+
+// lockRecord takes an exclusive lock on the record file at path, waiting up to
+// timeout for the lock. If the file does not exist, it creates it. Unlike
+// lockFile, it locks the file it opened, and then makes sure that the path still
+// refers to that file, trying again if another process replaced or deleted it
+// in the meantime. Thus it never recreates a record deleted while it waited.
+func lockRecord(path string, timeout time.Duration) (*recordLock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fh, err := os.Open(path)
+		if os.IsNotExist(err) {
+			lock, err := createRecord(path, time.Until(deadline))
+			if os.IsExist(err) {
+				continue
+			}
+			return lock, err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		unlock, err := lockOpen(fh, true, time.Until(deadline))
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		info, err := fh.Stat()
+		if err != nil {
+			unlock()
+			fh.Close()
+			return nil, err
+		}
+		cur, err := os.Lstat(path)
+		if err == nil && os.SameFile(info, cur) {
+			return &recordLock{fh: fh, unlock: unlock, path: path}, nil
+		}
+		unlock()
+		fh.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// createRecord creates an empty record file at path and takes an exclusive
+// lock on it, or returns an error satisfying os.IsExist if the file already
+// exists. It locks a temporary file before linking it to path, so that no other
+// process can lock the new file first and mistake it for a record with an
+// empty value.
+func createRecord(path string, timeout time.Duration) (*recordLock, error) {
+	fh, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fh.Name())
+	unlock, err := lockOpen(fh, true, timeout)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err == nil {
+		err = os.Link(fh.Name(), path)
+	}
+	if err != nil {
+		unlock()
+		fh.Close()
+		return nil, err
+	}
+	return &recordLock{fh: fh, unlock: unlock, path: path, created: info}, nil
+}
+
+// Unlock removes the file created by locking it, if it is still there and
+// still empty, and releases the lock.
+func (rl *recordLock) Unlock() error {
+	if rl.created != nil {
+		removeEmpty(rl.path, rl.created)
+	}
+	rl.unlock()
+	return rl.fh.Close()
+}
+
+// removeEmpty removes the file at path, but only if it is still the file
+// described by info, and it is empty. It ignores errors, since the file is
+// merely left behind if it cannot be removed.
+func removeEmpty(path string, info os.FileInfo) {
+	cur, err := os.Lstat(path)
+	if err == nil && os.SameFile(cur, info) && cur.Size() == 0 {
+		os.Remove(path)
+	}
+}
+
 type tmpFile struct {
 	file string
 	lock *flock.Flock
@@ -483,8 +1039,14 @@ func (tmp *tmpFile) Release() {
 }
 
 func (table *Table) writeTemp(key string, value []byte) (*tmpFile, error) {
+	return writeTemp(table.path, key+recExt, value, table.timeout)
+}
+
+// writeTemp writes value to a new, exclusively-locked temporary file in dir,
+// with a name starting with prefix. The caller must Release the file.
+func writeTemp(dir, prefix string, value []byte, timeout time.Duration) (*tmpFile, error) {
 	// Create a temporary file to write to.
-	tf, err := ioutil.TempFile(table.path, key+recExt)
+	tf, err := ioutil.TempFile(dir, prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -492,7 +1054,7 @@ func (table *Table) writeTemp(key string, value []byte) (*tmpFile, error) {
 	tmp := &tmpFile{file: tf.Name()}
 
 	// Take an exclusive lock on the temp file.
-	lock, err := lockFile(tmp.file, true, table.timeout)
+	lock, err := lockFile(tmp.file, true, timeout)
 	if err != nil {
 		os.Remove(tmp.file)
 		return nil, err
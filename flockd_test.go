@@ -317,6 +317,112 @@ func (s *TS) TestLock() {
 	s.FileExists(path, "The file should still be present")
 }
 
+// Locking a record file deleted by another process should not leave behind an
+// empty record.
+func (s *TS) TestDeleteRace() {
+	key := "racy"
+	path := filepath.Join(s.db.root.path, key+recExt)
+	s.Nil(s.db.Set(key, []byte("hi")), "Should set %v", key)
+
+	// A reader locks the file it opened.
+	fh, err := os.Open(path)
+	if err != nil {
+		s.T().Fatal("Open", err)
+	}
+	s.Nil(os.Remove(path), "Should remove file")
+	unlock, err := lockOpen(fh, false, time.Millisecond)
+	s.Nil(err, "Should lock open file")
+	unlock()
+	fh.Close()
+	s.fileNotExists(path)
+
+	// A writer removes the file it created by locking.
+	lock, err := lockRecord(path, time.Millisecond)
+	s.Nil(err, "Should lock record")
+	s.NotNil(lock.created, "Should have created file")
+	s.Nil(lock.Unlock(), "Should unlock record")
+	s.fileNotExists(path)
+	s.Nil(s.db.Set(key, []byte("hi")), "Should set %v", key)
+	lock, err = lockRecord(path, time.Millisecond)
+	s.Nil(err, "Should lock record")
+	s.Nil(lock.created, "Should not have created file")
+	s.Nil(lock.Unlock(), "Should unlock record")
+	s.FileExists(path, "Should keep existing file")
+
+	// Hammer it, with a timeout long enough that the writes never time out.
+	db, err := New(s.dir, 5*time.Second)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	done := make(chan struct{})
+	readers := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { readers <- struct{}{} }()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				db.Get(key)
+				db.Update(key, []byte("updated"))
+				db.CompareAndSwap(key, []byte("hi"), []byte("swapped"))
+			}
+		}()
+	}
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if db.Set(key, []byte("hi")) != nil || db.Delete(key) != nil {
+			failed++
+		}
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		<-readers
+	}
+	s.Zero(failed, "Should have no errors from Set and Delete")
+	s.fileNotExists(path)
+}
+
+// Create should not give up on a new file because another process locked it
+// first.
+func (s *TS) TestCreateRace() {
+	key := "racy"
+	db, err := New(s.dir, 5*time.Second)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	done := make(chan struct{})
+	readers := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { readers <- struct{}{} }()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				db.Get(key)
+				db.Update(key, []byte("updated"))
+			}
+		}()
+	}
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if db.Create(key, []byte("hi")) != nil || db.Delete(key) != nil {
+			failed++
+		}
+	}
+	close(done)
+	for i := 0; i < 4; i++ {
+		<-readers
+	}
+	s.Zero(failed, "Should have created and deleted the record every time")
+	s.fileNotExists(filepath.Join(s.dir, key+recExt))
+}
+
 func (s *TS) TestKeyPathErrors() {
 	badKey := filepath.Join("foo", "bar")
 	val, err := s.db.Get(badKey)
@@ -655,6 +761,31 @@ func (s *TS) TestBigForEach() {
 	s.Equal(readNum+10, n, "Should have found all the records")
 }
 
+func (s *TS) TestForEachDeleted() {
+	for _, key := range []string{"a", "b"} {
+		if err := s.db.Set(key, []byte(key)); err != nil {
+			s.T().Fatal("Set", err)
+		}
+	}
+
+	// Delete the other record from another instance while iterating.
+	other, err := New(s.dir, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	seen := []string{}
+	s.Nil(s.db.ForEach(func(key string, _ []byte) error {
+		seen = append(seen, key)
+		for _, k := range []string{"a", "b"} {
+			if k != key {
+				return other.Delete(k)
+			}
+		}
+		return nil
+	}), "Should get no error from ForEach for deleted record")
+	s.Len(seen, 1, "Should have skipped the deleted record")
+}
+
 func (s *TS) fileContains(path string, data []byte) bool {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
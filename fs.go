@@ -0,0 +1,333 @@
+package flockd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DB and Table implement read-only file systems.
+var (
+	_ fs.ReadDirFS = (*DB)(nil)
+	_ fs.StatFS    = (*DB)(nil)
+	_ fs.ReadDirFS = (*Table)(nil)
+	_ fs.StatFS    = (*Table)(nil)
+)
+
+// errIsDir is returned by Read on a directory.
+var errIsDir = errors.New("is a directory")
+
+// Open opens the named file or directory for reading in the root table,
+// implementing fs.FS. See Table.Open.
+func (db *DB) Open(name string) (fs.File, error) {
+	return db.root.Open(name)
+}
+
+// ReadDir reads the named directory in the root table, implementing
+// fs.ReadDirFS. See Table.ReadDir.
+func (db *DB) ReadDir(name string) ([]fs.DirEntry, error) {
+	return db.root.ReadDir(name)
+}
+
+// Stat returns a FileInfo describing the named file or directory in the root
+// table, implementing fs.StatFS. See Table.Stat.
+func (db *DB) Stat(name string) (fs.FileInfo, error) {
+	return db.root.Stat(name)
+}
+
+// Open opens the named file or directory for reading, implementing fs.FS, so
+// that the table can be used with fs.WalkDir, template.ParseFS, http.FS, and the
+// like. The file system is read-only, and maps keys to files and nested tables
+// to directories, named without the ".kv" and ".tbl" extensions. Where a key and
+// a nested table have the same name, the table hides the key. Tombstones,
+// conflict files, and internal files do not appear.
+//
+// Open reads the value for a key just like GetRecord, under a shared lock, and
+// the returned file reads from that copy. The size of the file is the size of
+// the value, and its modification time the Modified time of the record.
+func (table *Table) Open(name string) (fs.File, error) {
+	info, rec, err := table.fsStat("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		return &fsFile{Reader: bytes.NewReader(rec.Value), info: info}, nil
+	}
+	entries, err := table.fsReadDir("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return &fsDir{path: name, info: info, entries: entries}, nil
+}
+
+// ReadDir reads the named directory, implementing fs.ReadDirFS, and returns
+// its entries sorted by name. See Open.
+func (table *Table) ReadDir(name string) ([]fs.DirEntry, error) {
+	return table.fsReadDir("readdir", name)
+}
+
+// Stat returns a FileInfo describing the named file or directory, implementing
+// fs.StatFS. Like Open, it reads the value of a key under a shared lock, in
+// order to report its size. See Open.
+func (table *Table) Stat(name string) (fs.FileInfo, error) {
+	info, _, err := table.fsStat("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// fsName returns the slash-separated name, relative to the database root
+// directory, of the file system path name in the table.
+func (table *Table) fsName(name string) string {
+	base := filepath.ToSlash(table.name)
+	switch {
+	case name == ".":
+		return base
+	case base == "":
+		return name
+	}
+	return base + "/" + name
+}
+
+// fsStat returns a FileInfo describing the file system path name in the table,
+// and, for a key, its record. The record is nil for a directory.
+func (table *Table) fsStat(op, name string) (*fileInfo, *Record, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	full := table.fsName(name)
+	_, dirInfo, err := table.db.fsDir(full)
+	if err == nil {
+		return &fileInfo{
+			name:    fsBase(name),
+			mode:    fs.ModeDir | 0555,
+			modTime: dirInfo.ModTime(),
+		}, nil, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// Not a directory, so look for the key in its parent table.
+	var parent, key string
+	if i := strings.LastIndexByte(full, '/'); i >= 0 {
+		parent, key = full[:i], full[i+1:]
+	} else {
+		key = full
+	}
+	t, err := table.db.findTable(parent)
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	rec, err := t.GetRecord(key)
+	if err != nil {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return recordInfo(key, rec), rec, nil
+}
+
+// fsReadDir returns the sorted entries in the file system directory name in the
+// table: the nested tables, and the keys not hidden by a table of the same name.
+func (table *Table) fsReadDir(op, name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	full := table.fsName(name)
+	t, _, err := table.db.fsDir(full)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	// Nested tables live in the directory named for the table, which for the
+	// root table is the root directory itself.
+	entries := []fs.DirEntry{}
+	dirs := map[string]bool{}
+	files, err := os.ReadDir(filepath.Join(table.db.root.path, filepath.FromSlash(full)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		dir := strings.TrimSuffix(f.Name(), tblExt)
+		if dirs[dir] || (dir == f.Name() && internalDirs[dir]) {
+			continue
+		}
+		info, _, err := table.fsStat(op, pathJoin(name, dir))
+		if err != nil {
+			return nil, err
+		}
+		dirs[dir] = true
+		entries = append(entries, info)
+	}
+
+	// Keys live in the table directory.
+	if t != nil {
+		keys, err := t.Keys()
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		for _, key := range keys {
+			if !dirs[key] {
+				entries = append(entries, &keyEntry{table: t, key: key})
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// fsDir returns the table for the slash-separated directory name relative to
+// the database root, and information about its directory. The table is nil for
+// a directory that contains only nested tables. Returns os.ErrNotExist if there
+// is no such directory.
+func (db *DB) fsDir(name string) (*Table, os.FileInfo, error) {
+	table, err := db.findTable(name)
+	if err == nil {
+		info, err := os.Stat(table.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return table, info, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	// Look for a directory of nested tables.
+	for _, elem := range strings.Split(name, "/") {
+		if internalDirs[elem] || strings.HasSuffix(elem, tblExt) {
+			return nil, nil, os.ErrNotExist
+		}
+	}
+	info, err := os.Stat(filepath.Join(db.root.path, filepath.FromSlash(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil, os.ErrNotExist
+	}
+	return nil, info, nil
+}
+
+// fsBase returns the last element of the file system path name.
+func fsBase(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// pathJoin joins the file system directory path dir and the name of an entry.
+func pathJoin(dir, name string) string {
+	if dir == "." {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// recordInfo returns a FileInfo describing the record for key.
+func recordInfo(key string, rec *Record) *fileInfo {
+	return &fileInfo{
+		name:    key,
+		size:    int64(len(rec.Value)),
+		mode:    0444,
+		modTime: rec.Modified,
+	}
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}           { return nil }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// keyEntry implements fs.DirEntry for a key. Info reads the record.
+type keyEntry struct {
+	table *Table
+	key   string
+}
+
+func (e *keyEntry) Name() string      { return e.key }
+func (e *keyEntry) IsDir() bool       { return false }
+func (e *keyEntry) Type() fs.FileMode { return 0 }
+
+func (e *keyEntry) Info() (fs.FileInfo, error) {
+	rec, err := e.table.GetRecord(e.key)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: e.key, Err: err}
+	}
+	return recordInfo(e.key, rec), nil
+}
+
+// fsFile implements fs.File, io.Seeker, and io.ReaderAt for the value of a key.
+type fsFile struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *fsFile) Close() error               { return nil }
+
+// fsDir implements fs.ReadDirFile for a table.
+type fsDir struct {
+	path    string
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *fsDir) Close() error               { return nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errIsDir}
+}
+
+// Seek supports rewinding the directory, as http.FileServer does.
+func (d *fsDir) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, &fs.PathError{Op: "seek", Path: d.path, Err: fs.ErrInvalid}
+	}
+	d.offset = 0
+	return 0, nil
+}
+
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
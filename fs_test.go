@@ -0,0 +1,180 @@
+package flockd
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing/fstest"
+	"time"
+)
+
+func (s *TS) TestFS() {
+	s.Nil(s.db.Set("top", []byte("top")), "Should set top")
+	s.Nil(s.db.Set("dup", []byte("hidden")), "Should set dup")
+	for name, keys := range map[string][]string{
+		"dup":       {"x"},
+		"a":         {"one", "two"},
+		"a/b":       {"three"},
+		"c/d":       {"four"},
+		"empty":     {},
+		"compacted": {"five"},
+	} {
+		tbl, err := s.db.Table(filepath.FromSlash(name))
+		if err != nil {
+			s.T().Fatal("Table", err)
+		}
+		for _, key := range keys {
+			s.Nil(tbl.Set(key, []byte(name+":"+key)), "Should set %v in %v", key, name)
+		}
+	}
+
+	// Encoded records should read as their values.
+	tbl, err := s.db.Table("compacted")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Compression: "gzip", Tombstones: true}), "Should configure table")
+	s.Nil(tbl.Set("six", []byte(strings.Repeat("six", 100))), "Should set six")
+	s.Nil(tbl.Set("gone", []byte("gone")), "Should set gone")
+	s.Nil(tbl.Delete("gone"), "Should delete gone")
+
+	err = fstest.TestFS(
+		s.db,
+		"top", "a/one", "a/two", "a/b/three", "c/d/four", "dup/x", "compacted/five", "compacted/six",
+	)
+	s.Nil(err, "Should pass TestFS for DB")
+	a, err := s.db.Table("a")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(fstest.TestFS(a, "one", "two", "b/three"), "Should pass TestFS for table")
+
+	// Check directory listings.
+	names := func(fsys fs.ReadDirFS, dir string) []string {
+		entries, err := fsys.ReadDir(dir)
+		s.Nil(err, "Should read %v", dir)
+		names := []string{}
+		for _, e := range entries {
+			if e.IsDir() {
+				names = append(names, e.Name()+"/")
+			} else {
+				names = append(names, e.Name())
+			}
+		}
+		return names
+	}
+	s.Equal(
+		[]string{"a/", "c/", "compacted/", "dup/", "empty/", "top"},
+		names(s.db, "."),
+		"Should list root directory without hidden key",
+	)
+	s.Equal([]string{"b/", "one", "two"}, names(s.db, "a"), "Should list table")
+	s.Equal([]string{"b/", "one", "two"}, names(a, "."), "Should list table from table")
+	s.Equal([]string{"d/"}, names(s.db, "c"), "Should list directory of nested tables")
+	s.Equal([]string{}, names(s.db, "empty"), "Should list empty table")
+	s.Equal([]string{"five", "six"}, names(s.db, "compacted"), "Should skip tombstone")
+
+	// Read files.
+	val, err := fs.ReadFile(s.db, "compacted/six")
+	s.Nil(err, "Should read compressed file")
+	s.Equal(strings.Repeat("six", 100), string(val), "Should have decompressed value")
+	info, err := fs.Stat(s.db, "compacted/six")
+	s.Nil(err, "Should stat compressed file")
+	s.Equal(int64(300), info.Size(), "Should have size of value")
+	rec, err := tbl.GetRecord("six")
+	s.Nil(err, "Should have no error from GetRecord")
+	s.Equal(rec.Modified, info.ModTime(), "Should have record modified time")
+	s.Equal(fs.FileMode(0444), info.Mode(), "Should be read-only")
+	info, err = fs.Stat(s.db, "a/b")
+	s.Nil(err, "Should stat directory")
+	s.True(info.IsDir(), "Should be a directory")
+
+	// Missing and invalid paths.
+	for _, name := range []string{"nope", "a/nope", "nope/x", "compacted/gone", "top/x", ".history", "a.tbl"} {
+		_, err := s.db.Open(name)
+		s.True(errors.Is(err, fs.ErrNotExist), "Should have ErrNotExist for %v", name)
+		_, err = s.db.Stat(name)
+		s.True(errors.Is(err, fs.ErrNotExist), "Should have ErrNotExist from Stat for %v", name)
+	}
+	_, err = s.db.ReadDir("top")
+	s.True(errors.Is(err, fs.ErrNotExist), "Should have ErrNotExist reading file as directory")
+	for _, name := range []string{"../x", "/top", "a/", ""} {
+		_, err := s.db.Open(name)
+		s.True(errors.Is(err, fs.ErrInvalid), "Should have ErrInvalid for %q", name)
+	}
+
+	// Reading should not create tables.
+	s.fileNotExists(filepath.Join(s.dir, "nope"+tblExt))
+}
+
+func (s *TS) TestFSLock() {
+	s.Nil(s.db.Set("foo", []byte("foo")), "Should set foo")
+	lock, err := lockFile(filepath.Join(s.dir, "foo"+recExt), true, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("lockFile", err)
+	}
+	defer lock.Unlock()
+
+	// Reads should wait for the shared lock.
+	_, err = fs.ReadFile(s.db, "foo")
+	s.True(errors.Is(err, context.DeadlineExceeded), "Should time out reading locked file")
+}
+
+func (s *TS) TestFSHTTP() {
+	tbl, err := s.db.Table("static")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Set("index.html", []byte("<h1>Hello</h1>")), "Should set index.html")
+	s.Nil(tbl.Set("hello.txt", []byte("hello")), "Should set hello.txt")
+	s.Nil(tbl.Set("page.tmpl", []byte("<p>{{.}}</p>")), "Should set page.tmpl")
+
+	srv := httptest.NewServer(http.FileServer(http.FS(tbl)))
+	defer srv.Close()
+	for path, exp := range map[string]string{
+		"/":          "<h1>Hello</h1>",
+		"/hello.txt": "hello",
+	} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			s.T().Fatal("Get", err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		s.Nil(err, "Should read body for %v", path)
+		s.Equal(http.StatusOK, res.StatusCode, "Should have 200 for %v", path)
+		s.Equal(exp, string(body), "Should have body for %v", path)
+	}
+	res, err := http.Get(srv.URL + "/nope")
+	if err != nil {
+		s.T().Fatal("Get", err)
+	}
+	res.Body.Close()
+	s.Equal(http.StatusNotFound, res.StatusCode, "Should have 404 for missing key")
+
+	// Parse templates.
+	tmpl, err := template.ParseFS(tbl, "*.tmpl")
+	s.Nil(err, "Should parse templates")
+	var b strings.Builder
+	s.Nil(tmpl.Execute(&b, "hi"), "Should execute template")
+	s.Equal("<p>hi</p>", b.String(), "Should have template output")
+
+	// Walk.
+	walked := []string{}
+	err = fs.WalkDir(s.db, ".", func(path string, d fs.DirEntry, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	s.Nil(err, "Should walk")
+	s.Equal(
+		[]string{".", "static", "static/hello.txt", "static/index.html", "static/page.tmpl"},
+		walked,
+		"Should walk tables and keys",
+	)
+}
@@ -1,12 +1,15 @@
 module github.com/iovation/flockd
 
-go 1.13
+go 1.18
 
 require (
-	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/gofrs/flock v0.7.1
+	github.com/stretchr/testify v1.2.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.2.1
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 )
@@ -0,0 +1,241 @@
+package flockd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyDir is the name of the subdirectory of a table directory in which
+// previous values of records are kept in history mode.
+const historyDir = ".history"
+
+// Version describes a previous value of a record kept in history mode.
+type Version struct {
+	// ID identifies the version. Pass it to Restore to restore the value.
+	ID int64
+
+	// Modified is the time the value was written, as recorded in its
+	// metadata, or the modification time of its file for a raw record.
+	Modified time.Time
+
+	// Replaced is the time the value was replaced or deleted.
+	Replaced time.Time
+
+	// Size is the size of the record file.
+	Size int64
+}
+
+// historyPath returns the path to the directory containing the versions of
+// the record for key.
+func (table *Table) historyPath(key string) string {
+	return filepath.Join(table.path, historyDir, key+recExt)
+}
+
+// archive keeps the current value of the record for key as a version, if the
+// table is configured for history mode, and prunes versions that are no longer
+// to be kept. The caller must hold an exclusive lock on the record file and
+// replace or delete it after archive returns, and must not call it for a file
+// created by locking it. Tombstones are not kept.
+func (table *Table) archive(key string) error {
+	cfg := table.Config()
+	if !cfg.history() {
+		return nil
+	}
+
+	file := filepath.Join(table.path, key+recExt)
+	if _, err := os.Stat(file); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if tomb, err := isTombstone(file); err != nil || tomb {
+		return err
+	}
+
+	// Link the file into the history directory.
+	dir := table.historyPath(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	id := time.Now().UnixNano()
+	for {
+		err := os.Link(file, filepath.Join(dir, strconv.FormatInt(id, 10)))
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		id++
+	}
+
+	return table.prune(key, cfg)
+}
+
+// prune removes the versions of the record for key that cfg no longer keeps.
+func (table *Table) prune(key string, cfg TableConfig) error {
+	versions, err := table.versions(key)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, v := range versions {
+		if cfg.HistoryKeep > 0 && i < cfg.HistoryKeep {
+			continue
+		}
+		if cfg.HistoryMaxAge > 0 && now.Sub(v.Replaced) < cfg.HistoryMaxAge {
+			continue
+		}
+		err := os.Remove(filepath.Join(table.historyPath(key), strconv.FormatInt(v.ID, 10)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the previous values of the record for key kept in history
+// mode, newest first. Configure a table for history mode by setting
+// TableConfig.HistoryKeep or TableConfig.HistoryMaxAge. The key must not
+// contain a path separator character; if it does, os.ErrInvalid will be
+// returned. Returns an empty slice if there are no previous values.
+func (table *Table) History(key string) ([]Version, error) {
+	if strings.ContainsRune(key, os.PathSeparator) {
+		return nil, os.ErrInvalid
+	}
+	versions, err := table.versions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the modification times recorded in envelopes.
+	dir := table.historyPath(key)
+	for i, v := range versions {
+		data, err := table.read(filepath.Join(dir, strconv.FormatInt(v.ID, 10)))
+		if err != nil {
+			if err == os.ErrNotExist {
+				// Pruned since we read the directory.
+				continue
+			}
+			return nil, err
+		}
+		if _, meta, err := decodeEnvelope(data); err == nil && meta != nil && !meta.Modified.IsZero() {
+			versions[i].Modified = meta.Modified
+		}
+	}
+	return versions, nil
+}
+
+// versions lists the versions of the record for key, newest first, with the
+// modification times of their files.
+func (table *Table) versions(key string) ([]Version, error) {
+	dh, err := os.Open(table.historyPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Version{}, nil
+		}
+		return nil, err
+	}
+	defer dh.Close()
+
+	versions := []Version{}
+	for err != io.EOF {
+		var files []os.FileInfo
+		files, err = dh.Readdir(readNum)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, info := range files {
+			id, perr := strconv.ParseInt(info.Name(), 10, 64)
+			if perr != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			versions = append(versions, Version{
+				ID:       id,
+				Modified: info.ModTime(),
+				Replaced: time.Unix(0, id),
+				Size:     info.Size(),
+			})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// GetVersion returns the value of the version of the record for key with the
+// ID, as returned by History. Returns os.ErrNotExist if there is no such
+// version.
+func (table *Table) GetVersion(key string, id int64) ([]byte, error) {
+	val, _, err := table.getVersion(key, id)
+	return val, err
+}
+
+func (table *Table) getVersion(key string, id int64) ([]byte, *Meta, error) {
+	if strings.ContainsRune(key, os.PathSeparator) {
+		return nil, nil, os.ErrInvalid
+	}
+	data, err := table.read(filepath.Join(table.historyPath(key), strconv.FormatInt(id, 10)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, os.ErrNotExist
+		}
+		return nil, nil, err
+	}
+	return table.decode(key, data)
+}
+
+// GetAt returns the value the record for key had at time t: the current value,
+// if it was written at or before t, or else the previous value that was
+// written at or before t and replaced after t. The times values were written
+// are the Modified times recorded in their metadata, so GetAt is precise for
+// tables that use envelopes; for raw records, it relies on the modification
+// times of their files. Returns os.ErrNotExist if the record did not exist at
+// t, or if its value at t is no longer kept.
+func (table *Table) GetAt(key string, t time.Time) ([]byte, error) {
+	versions, err := table.History(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the oldest version replaced after t.
+	i := sort.Search(len(versions), func(i int) bool { return !versions[i].Replaced.After(t) })
+	if i > 0 {
+		v := versions[i-1]
+		if v.Modified.After(t) {
+			return nil, os.ErrNotExist
+		}
+		return table.GetVersion(key, v.ID)
+	}
+
+	// Fall back on the current value.
+	rec, err := table.GetRecord(key)
+	if err != nil {
+		return nil, err
+	}
+	if rec.Modified.After(t) {
+		return nil, os.ErrNotExist
+	}
+	return rec.Value, nil
+}
+
+// Restore sets the value of the record for key to the value of the version
+// with the ID, as returned by History, just like Set. If the table is in
+// history mode, the current value is kept as a version. The metadata of the
+// version, if any, is restored along with its value, except for its Created
+// and Modified times, which are handled as for Set. Returns os.ErrNotExist if
+// there is no such version.
+func (table *Table) Restore(key string, id int64) error {
+	val, meta, err := table.getVersion(key, id)
+	if err != nil {
+		return err
+	}
+	return table.set(key, func() ([]byte, error) {
+		return table.encode(key, val, meta)
+	})
+}
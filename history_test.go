@@ -0,0 +1,157 @@
+package flockd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) historyTable(name string, cfg TableConfig) *Table {
+	tbl, err := s.db.Table(name)
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	if err := tbl.Configure(cfg); err != nil {
+		s.T().Fatal("Configure", err)
+	}
+	return tbl
+}
+
+// historyValues returns the values of the versions of key, newest first.
+func (s *TS) historyValues(tbl *Table, key string) ([]string, []Version) {
+	versions, err := tbl.History(key)
+	s.Nil(err, "Should have no error from History")
+	vals := make([]string, len(versions))
+	for i, v := range versions {
+		val, err := tbl.GetVersion(key, v.ID)
+		s.Nil(err, "Should have no error from GetVersion")
+		vals[i] = string(val)
+	}
+	return vals, versions
+}
+
+func (s *TS) TestHistory() {
+	// No history by default.
+	s.Nil(s.db.Set("foo", []byte("one")), "Should set foo")
+	s.Nil(s.db.Set("foo", []byte("two")), "Should set foo again")
+	versions, err := s.db.root.History("foo")
+	s.Nil(err, "Should have no error from History")
+	s.Empty(versions, "Should have no history by default")
+	s.fileNotExists(filepath.Join(s.dir, historyDir))
+
+	tbl := s.historyTable("hist", TableConfig{Envelope: true, HistoryKeep: 2})
+	s.Nil(tbl.SetWithMeta("foo", []byte("one"), &Meta{ContentType: "text/plain"}), "Should set one")
+	s.Nil(tbl.Set("foo", []byte("two")), "Should set two")
+	s.Nil(tbl.Update("foo", []byte("three")), "Should update three")
+	ok, err := tbl.CompareAndSwap("foo", []byte("three"), []byte("four"))
+	s.Nil(err, "Should have no error from CompareAndSwap")
+	s.True(ok, "Should have swapped")
+
+	vals, versions := s.historyValues(tbl, "foo")
+	s.Equal([]string{"three", "two"}, vals, "Should have kept two previous values")
+	s.True(versions[0].Replaced.After(versions[1].Replaced), "Should be newest first")
+	s.True(versions[1].Modified.Before(versions[1].Replaced), "Should be modified before replaced")
+	s.True(versions[0].Size > 0, "Should have size")
+
+	// Restore a previous value.
+	s.Nil(tbl.Restore("foo", versions[1].ID), "Should restore two")
+	val, err := tbl.Get("foo")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("two", string(val), "Should have restored value")
+	vals, versions = s.historyValues(tbl, "foo")
+	s.Equal([]string{"four", "three"}, vals, "Should have kept replaced value")
+
+	// Deleting keeps the value, too.
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	vals, versions = s.historyValues(tbl, "foo")
+	s.Equal([]string{"two", "four"}, vals, "Should have kept deleted value")
+	s.Nil(tbl.Restore("foo", versions[0].ID), "Should restore deleted value")
+	val, err = tbl.Get("foo")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("two", string(val), "Should have restored deleted value")
+
+	// Errors.
+	s.Equal(os.ErrNotExist, tbl.Restore("foo", 42), "Should have ErrNotExist for unknown version")
+	_, err = tbl.GetVersion("bar", 42)
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist for unknown key")
+	_, err = tbl.History("a/b")
+	s.Equal(os.ErrInvalid, err, "Should have ErrInvalid from History")
+	_, err = tbl.GetVersion("a/b", 42)
+	s.Equal(os.ErrInvalid, err, "Should have ErrInvalid from GetVersion")
+
+	// History should not trip up Check.
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems")
+}
+
+func (s *TS) TestHistoryMaxAge() {
+	tbl := s.historyTable("age", TableConfig{HistoryMaxAge: 100 * time.Millisecond})
+	for _, val := range []string{"one", "two", "three"} {
+		s.Nil(tbl.Set("foo", []byte(val)), "Should set %v", val)
+	}
+	vals, _ := s.historyValues(tbl, "foo")
+	s.Equal([]string{"two", "one"}, vals, "Should have kept young values")
+
+	time.Sleep(110 * time.Millisecond)
+	s.Nil(tbl.Set("foo", []byte("four")), "Should set four")
+	vals, _ = s.historyValues(tbl, "foo")
+	s.Equal([]string{"three"}, vals, "Should have pruned old values")
+
+	// Keep wins if either applies.
+	tbl = s.historyTable("both", TableConfig{HistoryKeep: 1, HistoryMaxAge: time.Hour})
+	for _, val := range []string{"one", "two", "three"} {
+		s.Nil(tbl.Set("foo", []byte(val)), "Should set %v", val)
+	}
+	vals, _ = s.historyValues(tbl, "foo")
+	s.Equal([]string{"two", "one"}, vals, "Should have kept young values")
+}
+
+func (s *TS) TestGetAt() {
+	// Envelopes record when values were written, independent of file system
+	// timestamp granularity.
+	tbl := s.historyTable("at", TableConfig{Envelope: true, HistoryKeep: 10})
+	pause := func() time.Time {
+		time.Sleep(5 * time.Millisecond)
+		t := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		return t
+	}
+
+	before := pause()
+	s.Nil(tbl.Set("foo", []byte("one")), "Should set one")
+	one := pause()
+	s.Nil(tbl.Set("foo", []byte("two")), "Should set two")
+	two := pause()
+	s.Nil(tbl.Delete("foo"), "Should delete")
+	deleted := pause()
+	s.Nil(tbl.Create("foo", []byte("three")), "Should create three")
+	three := pause()
+
+	// File modification times should not matter.
+	files, _ := filepath.Glob(filepath.Join(tbl.historyPath("foo"), "*"))
+	files = append(files, filepath.Join(tbl.path, "foo"+recExt))
+	for _, file := range files {
+		old := before.Add(-time.Hour)
+		if err := os.Chtimes(file, old, old); err != nil {
+			s.T().Fatal("Chtimes", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		t   time.Time
+		exp string
+	}{{one, "one"}, {two, "two"}, {three, "three"}, {time.Now(), "three"}} {
+		val, err := tbl.GetAt("foo", tc.t)
+		s.Nil(err, "Should have no error from GetAt for %v", tc.exp)
+		s.Equal(tc.exp, string(val), "Should have value at time for %v", tc.exp)
+	}
+	for _, t := range []time.Time{before, deleted} {
+		_, err := tbl.GetAt("foo", t)
+		s.Equal(os.ErrNotExist, err, "Should have ErrNotExist when record did not exist")
+	}
+	_, err := tbl.GetAt("nonesuch", time.Now())
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist for nonexistent record")
+	_, err = tbl.GetAt("a/b", time.Now())
+	s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for invalid key")
+}
@@ -0,0 +1,216 @@
+package flockd
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// leaderExt is the extension of the lock file for a LeaderElector.
+const leaderExt = ".leader"
+
+// LeaderTable is the name of the table in which the leader of each election
+// records its identity, as the value for the key named for the election.
+const LeaderTable = ".leaders"
+
+// LeaderElector elects a single leader among the processes using the database
+// directory, for example to choose the primary among processes that share it.
+// A process campaigns for leadership by taking an exclusive lock on a file in
+// the ".locks" subdirectory of the root directory, and remains leader until it
+// resigns or exits. Because the operating system releases the lock when the
+// leader process dies, another process campaigning for leadership then takes
+// over.
+//
+// The leader records its identity as the value for the key named for the
+// election in the table LeaderTable, so that any process can read it with Get,
+// including one with a read-only database, which cannot campaign. When a leader
+// dies, the key retains its identity until another process takes over; use
+// Identity or Leader to find out whether a process holds leadership, and
+// Changes to watch for changes of leadership.
+type LeaderElector struct {
+	name     string
+	identity []byte
+	table    *Table
+	mutex    *Mutex
+	mu       sync.Mutex
+	leader   bool
+}
+
+// LeaderChange describes a change of leadership reported by Changes.
+type LeaderChange struct {
+	// IsLeader is true if the elector is the leader.
+	IsLeader bool
+
+	// Lease is the lease of the process that holds leadership, or nil if
+	// there is no leader. See Mutex.Holder.
+	Lease *Lease
+}
+
+// LeaderElector returns a LeaderElector for the election with the name, which
+// records identity in the key name of LeaderTable when it becomes the leader.
+// The name must not contain a path separator character; if it does, or it is
+// empty, os.ErrInvalid will be returned. Returns ErrReadOnly for a read-only
+// database.
+func (db *DB) LeaderElector(name string, identity []byte) (*LeaderElector, error) {
+	path, err := db.root.lockPath(name, leaderExt)
+	if err != nil {
+		return nil, err
+	}
+	table, err := db.Table(LeaderTable)
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{
+		name:     name,
+		identity: identity,
+		table:    table,
+		mutex:    newMutex(db, path),
+	}, nil
+}
+
+// Campaign waits until ctx is done to become the leader, then records the
+// identity. Returns nil immediately if the elector is already the leader, and
+// the context error if it did not become the leader.
+func (le *LeaderElector) Campaign(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if le.IsLeader() {
+			return nil
+		}
+		ok, err := le.mutex.TryLock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := le.table.Set(le.name, le.identity); err != nil {
+				le.mutex.Unlock()
+				return err
+			}
+			le.setLeader(true)
+			return nil
+		}
+		timer.Reset(lockRetryDelay)
+	}
+}
+
+// Resign gives up leadership, deleting the identity key so that other
+// processes do not mistake the elector for the leader. Returns ErrNotLocked if
+// the elector is not the leader.
+func (le *LeaderElector) Resign() error {
+	le.mu.Lock()
+	leader := le.leader
+	le.mu.Unlock()
+	if !leader {
+		return ErrNotLocked
+	}
+	if err := le.table.Delete(le.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := le.mutex.Unlock(); err != nil {
+		return err
+	}
+	le.setLeader(false)
+	return nil
+}
+
+// IsLeader returns true if the elector is the leader.
+func (le *LeaderElector) IsLeader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leader
+}
+
+// Changes returns a channel that receives the current state of leadership,
+// and then a LeaderChange each time it changes, whether because the elector
+// becomes the leader or resigns, or because another process takes over or
+// gives up leadership. Changes detects the changes by polling the holder of the
+// lock, as returned by Leader, until ctx is done, and then closes the channel.
+// The channel holds only the latest change, so a slow receiver sees the current
+// state rather than every transition.
+func (le *LeaderElector) Changes(ctx context.Context) <-chan LeaderChange {
+	changes := make(chan LeaderChange, 1)
+	go func() {
+		defer close(changes)
+		ticker := time.NewTicker(lockRetryDelay)
+		defer ticker.Stop()
+		var last *LeaderChange
+		for {
+			if cur, ok := le.poll(); ok && (last == nil || !cur.same(last)) {
+				last = &cur
+				select {
+				case <-changes:
+				default:
+				}
+				changes <- cur
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return changes
+}
+
+// poll returns the current state of leadership. Returns false if it cannot
+// tell, because reading the lease failed or the leader has yet to record it.
+func (le *LeaderElector) poll() (LeaderChange, bool) {
+	leader := le.IsLeader()
+	lease, err := le.Leader()
+	if err != nil || (lease != nil && lease.PID == 0) {
+		return LeaderChange{}, false
+	}
+	return LeaderChange{IsLeader: leader, Lease: lease}, true
+}
+
+// same returns true if lc and other describe the same leadership.
+func (lc *LeaderChange) same(other *LeaderChange) bool {
+	if lc.IsLeader != other.IsLeader || (lc.Lease == nil) != (other.Lease == nil) {
+		return false
+	}
+	return lc.Lease == nil || (lc.Lease.PID == other.Lease.PID &&
+		lc.Lease.Hostname == other.Lease.Hostname &&
+		lc.Lease.WriterID == other.Lease.WriterID &&
+		lc.Lease.Acquired.Equal(other.Lease.Acquired))
+}
+
+// Leader returns the lease of the process that holds leadership, which may be
+// the current process, or nil if there is no leader. See Mutex.Holder.
+func (le *LeaderElector) Leader() (*Lease, error) {
+	return le.mutex.Holder()
+}
+
+// Identity returns the identity recorded by the leader in LeaderTable, which
+// may be the current process, or nil if there is no leader. Unlike Get, it
+// ignores the identity left by a leader that died. Just after another process
+// takes over leadership, it may briefly return the identity of the previous
+// leader, until the new leader records its own.
+func (le *LeaderElector) Identity() ([]byte, error) {
+	lease, err := le.Leader()
+	if err != nil || lease == nil {
+		return nil, err
+	}
+	id, err := le.table.Get(le.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return id, nil
+}
+
+// setLeader records whether the elector is the leader.
+func (le *LeaderElector) setLeader(leader bool) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.leader = leader
+}
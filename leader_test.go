@@ -0,0 +1,200 @@
+package flockd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// leaderHelper campaigns for the leadership named by the environment for
+// TestMutexHelper, with the identity "child", and exits after resigning, or
+// without resigning if crash is true.
+func leaderHelper(db *DB, crash bool) {
+	le, err := db.LeaderElector(os.Getenv(helperNameEnv), []byte("child"))
+	if err == nil {
+		err = le.Campaign(context.Background())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Println("locked")
+	io.Copy(ioutil.Discard, os.Stdin)
+	if crash {
+		os.Exit(1)
+	}
+	if err := le.Resign(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func (s *TS) TestLeaderElectorName() {
+	for _, name := range []string{"", filepath.Join("a", "b")} {
+		_, err := s.db.LeaderElector(name, []byte("me"))
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for %q", name)
+	}
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	_, err = ro.LeaderElector("primary", []byte("me"))
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from LeaderElector")
+}
+
+// waitLeader waits for a change on changes that reports whether the elector is
+// the leader and the PID of the leader, or 0 for no leader.
+func (s *TS) waitLeader(changes <-chan LeaderChange, leader bool, pid int) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-changes:
+			if c.IsLeader != leader {
+				continue
+			}
+			if (pid == 0 && c.Lease == nil) || (c.Lease != nil && c.Lease.PID == pid) {
+				return
+			}
+		case <-timeout:
+			s.T().Fatalf("No change to leader %v with PID %v", leader, pid)
+		}
+	}
+}
+
+func (s *TS) TestLeaderElector() {
+	le, err := s.db.LeaderElector("primary", []byte("one"))
+	if err != nil {
+		s.T().Fatal("LeaderElector", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := le.Changes(ctx)
+	s.waitLeader(changes, false, 0)
+	s.False(le.IsLeader(), "Should not start as leader")
+	s.Equal(ErrNotLocked, le.Resign(), "Should have ErrNotLocked resigning before campaign")
+	lease, err := le.Leader()
+	s.Nil(err, "Should have no error from Leader")
+	s.Nil(lease, "Should have no leader")
+	id, err := le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Nil(id, "Should have no identity")
+
+	// Win the election.
+	s.Nil(le.Campaign(context.Background()), "Should win campaign")
+	s.True(le.IsLeader(), "Should be leader")
+	s.waitLeader(changes, true, os.Getpid())
+	s.Nil(le.Campaign(context.Background()), "Should campaign again as leader")
+	id, err = le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Equal("one", string(id), "Should record identity")
+	_, err = s.db.Get("primary")
+	s.True(os.IsNotExist(err), "Should not write a root record")
+
+	// Read-only processes can read the identity from the leader table.
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	roTable, err := ro.Table(LeaderTable)
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	id, err = roTable.Get("primary")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("one", string(id), "Should read identity with Get")
+	lease, err = le.Leader()
+	s.Nil(err, "Should have no error from Leader")
+	if s.NotNil(lease, "Should have leader") {
+		s.Equal(os.Getpid(), lease.PID, "Should be leader process")
+	}
+
+	// Another elector waits.
+	other, err := s.db.LeaderElector("primary", []byte("two"))
+	if err != nil {
+		s.T().Fatal("LeaderElector", err)
+	}
+	otherChanges := other.Changes(ctx)
+	s.waitLeader(otherChanges, false, os.Getpid())
+	tctx, tcancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer tcancel()
+	s.Equal(context.DeadlineExceeded, other.Campaign(tctx), "Should time out campaigning")
+	s.False(other.IsLeader(), "Other should not be leader")
+	id, err = other.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Equal("one", string(id), "Other should see leader identity")
+
+	// Resign to hand over leadership.
+	done := make(chan error)
+	go func() { done <- other.Campaign(context.Background()) }()
+	s.Nil(le.Resign(), "Should resign")
+	s.False(le.IsLeader(), "Should no longer be leader")
+	s.Nil(<-done, "Other should win campaign")
+	s.waitLeader(otherChanges, true, os.Getpid())
+	s.waitLeader(changes, false, os.Getpid())
+	id, err = le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Equal("two", string(id), "Should record new identity")
+
+	s.Nil(other.Resign(), "Other should resign")
+	s.waitLeader(changes, false, 0)
+	id, err = le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Nil(id, "Should delete identity on resignation")
+	_, err = roTable.Get("primary")
+	s.True(os.IsNotExist(err), "Should delete identity key on resignation")
+
+	// Changes closes the channel when the context is done.
+	cancel()
+	for range changes {
+	}
+}
+
+func (s *TS) TestLeaderElectorProcesses() {
+	le, err := s.db.LeaderElector("primary", []byte("parent"))
+	if err != nil {
+		s.T().Fatal("LeaderElector", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := le.Changes(ctx)
+
+	// A child process leads.
+	child := s.startLocker("primary", "lead")
+	s.waitLeader(changes, false, child.cmd.Process.Pid)
+	id, err := le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Equal("child", string(id), "Should have child identity")
+	lease, err := le.Leader()
+	s.Nil(err, "Should have no error from Leader")
+	if s.NotNil(lease, "Should have leader") {
+		s.Equal(child.cmd.Process.Pid, lease.PID, "Should have child PID")
+	}
+	s.Nil(child.release(), "Child should exit cleanly")
+	s.waitLeader(changes, false, 0)
+	id, err = le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Nil(id, "Should delete identity when child resigns")
+
+	// Fail over when the leader dies.
+	child = s.startLocker("primary", "lead-crash")
+	s.waitLeader(changes, false, child.cmd.Process.Pid)
+	done := make(chan error)
+	go func() { done <- le.Campaign(context.Background()) }()
+	select {
+	case err := <-done:
+		s.T().Fatal("Should not lead while child leads", err)
+	case <-time.After(30 * time.Millisecond):
+	}
+	s.NotNil(child.release(), "Child should exit with an error")
+	s.Nil(<-done, "Should win campaign after child dies")
+	s.waitLeader(changes, true, os.Getpid())
+	id, err = le.Identity()
+	s.Nil(err, "Should have no error from Identity")
+	s.Equal("parent", string(id), "Should have parent identity")
+	s.Nil(le.Resign(), "Should resign")
+}
@@ -0,0 +1,37 @@
+//go:build !windows
+
+package flockd
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockOpen acquires a shared or exclusive lock on the open file fh, waiting up
+// to timeout for the lock, and returns a function that releases it. Unlike
+// lockFile, it locks the open file rather than opening the path again, which
+// would create an empty file if another process deleted the record in the
+// meantime.
+func lockOpen(fh *os.File, exclusive bool, timeout time.Duration) (func(), error) {
+	fd := int(fh.Fd())
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(fd, how|syscall.LOCK_NB)
+		if err == nil {
+			return func() { syscall.Flock(fd, syscall.LOCK_UN) }, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		time.Sleep(timeout / 100)
+	}
+}
@@ -0,0 +1,35 @@
+package flockd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// lockOpen acquires a shared or exclusive lock on the file fh, waiting up to
+// timeout for the lock, and returns a function that releases it. On Windows,
+// it falls back on locking the path, as lockFile does.
+func lockOpen(fh *os.File, exclusive bool, timeout time.Duration) (func(), error) {
+	if timeout <= 0 {
+		lock := flock.NewFlock(fh.Name())
+		try := lock.TryRLock
+		if exclusive {
+			try = lock.TryLock
+		}
+		locked, err := try()
+		if err != nil {
+			return nil, err
+		}
+		if !locked {
+			return nil, context.DeadlineExceeded
+		}
+		return func() { lock.Unlock() }, nil
+	}
+	lock, err := lockFile(fh.Name(), exclusive, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return func() { lock.Unlock() }, nil
+}
@@ -0,0 +1,444 @@
+/*
+Package memcache implements a server for the memcached text protocol backed by
+a flockd table, so that existing memcached clients can share a flockd store. It
+supports these commands:
+
+	get <key>*
+	gets <key>*
+	set <key> <flags> <exptime> <bytes> [noreply]
+	add <key> <flags> <exptime> <bytes> [noreply]
+	replace <key> <flags> <exptime> <bytes> [noreply]
+	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+	delete <key> [noreply]
+	version
+	quit
+
+The add command creates the key, like Table.Create, and replace updates it,
+like Table.Update. The cas unique value returned by gets is derived from the
+record's ETag, and cas sets the value only if the record's ETag still matches,
+as checked under the exclusive lock by Table.SetIfMatch.
+
+Nonzero flags are stored in the record's metadata under the header FlagsHeader,
+which requires an envelope; records with zero flags are written like Set.
+Records never expire: the server accepts but ignores exptime.
+*/
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iovation/flockd"
+)
+
+const (
+	// FlagsHeader is the name of the metadata header in which the server
+	// stores nonzero flags.
+	FlagsHeader = "Memcached-Flags"
+
+	// Version is the version reported by the version command.
+	Version = "flockd"
+
+	// maxKey is the maximum length of a key.
+	maxKey = 250
+
+	// maxValue is the maximum size of a value.
+	maxValue = 1 << 20
+)
+
+// ErrServerClosed is returned by Serve after a call to Close.
+var ErrServerClosed = errors.New("memcache: Server closed")
+
+// Server serves memcached requests for a flockd table.
+type Server struct {
+	table     *flockd.Table
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer creates a Server for table.
+func NewServer(table *flockd.Table) *Server {
+	return &Server{
+		table:     table,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections on ln and serves each in a new goroutine until
+// Accept fails or Close is called. It always returns a non-nil error; after
+// Close, it returns ErrServerClosed.
+func (srv *Server) Serve(ln net.Listener) error {
+	if !srv.track(ln, nil) {
+		return ErrServerClosed
+	}
+	defer srv.untrack(ln, nil)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests on conn until the client disconnects or sends
+// quit, then closes conn.
+func (srv *Server) ServeConn(conn net.Conn) {
+	if !srv.track(nil, conn) {
+		conn.Close()
+		return
+	}
+	defer srv.untrack(nil, conn)
+	defer conn.Close()
+
+	c := &client{
+		table: srv.table,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriter(conn),
+	}
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if err != nil {
+			if err == bufio.ErrBufferFull {
+				c.reply("CLIENT_ERROR line too long")
+				c.w.Flush()
+			}
+			return
+		}
+		quit, err := c.exec(strings.Fields(string(line)))
+		if err != nil {
+			// The connection is out of sync with the client.
+			c.w.Flush()
+			return
+		}
+
+		// Flush once there are no more pipelined requests.
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Close closes all listeners passed to Serve and all active connections.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// track records a listener or connection. Returns false if the server is
+// closed.
+func (srv *Server) track(ln net.Listener, conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if ln != nil {
+		srv.listeners[ln] = struct{}{}
+	}
+	if conn != nil {
+		srv.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+// untrack removes a listener or connection.
+func (srv *Server) untrack(ln net.Listener, conn net.Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, ln)
+	delete(srv.conns, conn)
+}
+
+// isClosed returns true if Close has been called.
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// client represents the state of a connection.
+type client struct {
+	table *flockd.Table
+	r     *bufio.Reader
+	w     *bufio.Writer
+}
+
+// reply writes a line.
+func (c *client) reply(line string) {
+	c.w.WriteString(line + "\r\n")
+}
+
+// replyErr writes the reply for err.
+func (c *client) replyErr(err error) {
+	if errors.Is(err, os.ErrInvalid) {
+		c.reply("CLIENT_ERROR invalid key")
+		return
+	}
+	c.reply("SERVER_ERROR " + err.Error())
+}
+
+// exec executes the command in args and writes the reply. Returns true if the
+// connection should be closed, or an error if the connection can no longer be
+// used.
+func (c *client) exec(args []string) (bool, error) {
+	if len(args) == 0 {
+		c.reply("ERROR")
+		return false, nil
+	}
+	switch args[0] {
+	case "get", "gets":
+		c.get(args[1:], args[0] == "gets")
+	case "set", "add", "replace", "cas":
+		return false, c.store(args[0], args[1:])
+	case "delete":
+		c.delete(args[1:])
+	case "version":
+		c.reply("VERSION " + Version)
+	case "quit":
+		return true, nil
+	default:
+		c.reply("ERROR")
+	}
+	return false, nil
+}
+
+// validKey returns true if key is a valid memcached key.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKey {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// casUnique returns the cas unique value for an ETag.
+func casUnique(etag string) uint64 {
+	n, _ := strconv.ParseUint(strings.Trim(etag, `"`)[:16], 16, 64)
+	return n
+}
+
+// flags returns the flags stored in meta.
+func flags(meta *flockd.Meta) uint32 {
+	if meta == nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(meta.Headers[FlagsHeader], 10, 32)
+	return uint32(n)
+}
+
+func (c *client) get(keys []string, cas bool) {
+	if len(keys) == 0 {
+		c.reply("ERROR")
+		return
+	}
+	for _, key := range keys {
+		if !validKey(key) {
+			c.reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+	for _, key := range keys {
+		rec, err := c.table.GetRecord(key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			c.replyErr(err)
+			return
+		}
+		line := fmt.Sprintf("VALUE %s %d %d", key, flags(rec.Meta), len(rec.Value))
+		if cas {
+			line += " " + strconv.FormatUint(casUnique(rec.ETag), 10)
+		}
+		c.reply(line)
+		c.w.Write(rec.Value)
+		c.reply("")
+	}
+	c.reply("END")
+}
+
+// store implements the storage commands. Returns an error if it could not read
+// the data block.
+func (c *client) store(cmd string, args []string) error {
+	nargs := 4
+	if cmd == "cas" {
+		nargs = 5
+	}
+	noreply := len(args) == nargs+1 && args[nargs] == "noreply"
+	if len(args) != nargs && !noreply {
+		c.reply("ERROR")
+		return nil
+	}
+	key := args[0]
+	flagVal, ferr := strconv.ParseUint(args[1], 10, 32)
+	_, eerr := strconv.ParseInt(args[2], 10, 64)
+	size, serr := strconv.Atoi(args[3])
+	var cas uint64
+	var cerr error
+	if cmd == "cas" {
+		cas, cerr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !validKey(key) || ferr != nil || eerr != nil || serr != nil || size < 0 || cerr != nil {
+		c.reply("CLIENT_ERROR bad command line format")
+		// Without a valid size there is no way to find the next command.
+		if serr != nil || size < 0 {
+			return errors.New("memcache: bad data size")
+		}
+		_, err := c.r.Discard(size + 2)
+		return err
+	}
+
+	// Read the data block.
+	if size > maxValue {
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return err
+		}
+		c.reply("SERVER_ERROR object too large for cache")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		c.reply("CLIENT_ERROR bad data chunk")
+		return errors.New("memcache: bad data chunk")
+	}
+	value := data[:size]
+
+	var meta *flockd.Meta
+	if flagVal != 0 {
+		meta = &flockd.Meta{Headers: map[string]string{
+			FlagsHeader: strconv.FormatUint(flagVal, 10),
+		}}
+	}
+
+	var err error
+	switch cmd {
+	case "set":
+		if meta == nil {
+			err = c.table.Set(key, value)
+		} else {
+			err = c.table.SetWithMeta(key, value, meta)
+		}
+	case "add":
+		if meta == nil {
+			err = c.table.Create(key, value)
+		} else {
+			err = c.table.CreateWithMeta(key, value, meta)
+		}
+	case "replace":
+		if meta == nil {
+			err = c.table.Update(key, value)
+		} else {
+			err = c.table.UpdateWithMeta(key, value, meta)
+		}
+	case "cas":
+		err = c.cas(key, value, meta, cas)
+	}
+
+	reply := "STORED"
+	switch {
+	case err == nil:
+	case errors.Is(err, flockd.ErrPrecondition):
+		reply = "EXISTS"
+	case os.IsNotExist(err) && cmd == "cas":
+		reply = "NOT_FOUND"
+	case os.IsExist(err), os.IsNotExist(err):
+		reply = "NOT_STORED"
+	default:
+		if !noreply {
+			c.replyErr(err)
+		}
+		return nil
+	}
+	if !noreply {
+		c.reply(reply)
+	}
+	return nil
+}
+
+// cas sets the value for key if its cas unique value is cas. Returns
+// os.ErrNotExist if the record does not exist, or flockd.ErrPrecondition if
+// the cas unique value does not match.
+func (c *client) cas(key string, value []byte, meta *flockd.Meta, cas uint64) error {
+	rec, err := c.table.GetRecord(key)
+	if err != nil {
+		return err
+	}
+	if casUnique(rec.ETag) != cas {
+		return flockd.ErrPrecondition
+	}
+
+	// Set the value only if the record hasn't changed since we read it.
+	if meta == nil {
+		_, err = c.table.SetIfMatch(key, value, rec.ETag)
+	} else {
+		_, err = c.table.SetWithMetaIfMatch(key, value, meta, rec.ETag)
+	}
+	return err
+}
+
+func (c *client) delete(args []string) {
+	noreply := len(args) > 1 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+	// Old clients may send a zero hold time.
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 {
+		c.reply("CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]")
+		return
+	}
+	if !validKey(args[0]) {
+		c.reply("CLIENT_ERROR bad command line format")
+		return
+	}
+
+	reply := "DELETED"
+	if err := c.table.DeleteIfMatch(args[0], "*"); err != nil {
+		if !errors.Is(err, flockd.ErrPrecondition) {
+			if !noreply {
+				c.replyErr(err)
+			}
+			return
+		}
+		reply = "NOT_FOUND"
+	}
+	if !noreply {
+		c.reply(reply)
+	}
+}
@@ -0,0 +1,358 @@
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iovation/flockd"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClient is a minimal memcached client.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes raw request text.
+func (c *testClient) send(text string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, text); err != nil {
+		c.t.Fatal("write", err)
+	}
+}
+
+// line reads a reply line without its terminator.
+func (c *testClient) line() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal("read", err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+// do sends a request and returns the first reply line.
+func (c *testClient) do(text string) string {
+	c.t.Helper()
+	c.send(text)
+	return c.line()
+}
+
+// item is a value returned by get or gets.
+type item struct {
+	flags uint32
+	value string
+	cas   uint64
+}
+
+// get sends a get or gets command and returns the values by key.
+func (c *testClient) get(cmd string, keys ...string) map[string]item {
+	c.t.Helper()
+	c.send(cmd + " " + strings.Join(keys, " ") + "\r\n")
+	items := map[string]item{}
+	for {
+		line := c.line()
+		if line == "END" {
+			return items
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			c.t.Fatalf("unexpected reply %q", line)
+		}
+		flags, _ := strconv.ParseUint(fields[2], 10, 32)
+		size, _ := strconv.Atoi(fields[3])
+		it := item{flags: uint32(flags)}
+		if len(fields) > 4 {
+			it.cas, _ = strconv.ParseUint(fields[4], 10, 64)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal("read value", err)
+		}
+		it.value = string(buf[:size])
+		items[fields[1]] = it
+	}
+}
+
+// setup creates a database in a temporary directory, starts a server for its
+// root table on a loopback listener, and returns the table and the address of
+// the listener.
+func setup(t *testing.T) (*flockd.Table, string) {
+	dir, err := ioutil.TempDir("", "flockd-memcache")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := flockd.New(dir, time.Second)
+	if err != nil {
+		t.Fatal("New", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	srv := NewServer(db.Root())
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		assert.Equal(t, ErrServerClosed, <-done, "Serve should return ErrServerClosed")
+	})
+	return db.Root(), ln.Addr().String()
+}
+
+// dial connects a new client to addr.
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestBasics(t *testing.T) {
+	_, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, "VERSION "+Version, c.do("version\r\n"), "Should have version")
+	assert.Equal(t, "ERROR", c.do("nope\r\n"), "Should reject unknown command")
+	assert.Equal(t, "ERROR", c.do("\r\n"), "Should reject empty command")
+	assert.Equal(t, "ERROR", c.do("get\r\n"), "Should reject get without keys")
+	assert.Equal(t, "ERROR", c.do("set foo 0 0\r\n"), "Should reject short set")
+	assert.Equal(
+		t,
+		"CLIENT_ERROR bad command line format",
+		c.do("set foo x 0 3\r\nbar\r\n"),
+		"Should reject bad flags",
+	)
+	assert.Equal(t, "VERSION "+Version, c.do("version\r\n"), "Should skip data after bad command")
+	assert.Equal(
+		t,
+		"CLIENT_ERROR invalid key",
+		c.do("set a"+string(os.PathSeparator)+"b 0 0 1\r\nx\r\n"),
+		"Should reject key with path separator",
+	)
+	assert.Equal(
+		t,
+		"CLIENT_ERROR bad command line format",
+		c.do("get "+strings.Repeat("x", maxKey+1)+"\r\n"),
+		"Should reject long key",
+	)
+
+	c.send("quit\r\n")
+	_, err := c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on quit")
+
+	// Bad data blocks close the connection.
+	c = dial(t, addr)
+	assert.Equal(t, "CLIENT_ERROR bad data chunk", c.do("set foo 0 0 3\r\nbarbaz\r\n"), "Should reject bad chunk")
+	_, err = c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on bad chunk")
+
+	// Oversize values are discarded.
+	c = dial(t, addr)
+	big := strings.Repeat("x", maxValue+1)
+	assert.Equal(
+		t,
+		"SERVER_ERROR object too large for cache",
+		c.do("set big 0 0 "+strconv.Itoa(len(big))+"\r\n"+big+"\r\n"),
+		"Should reject oversize value",
+	)
+	assert.Equal(t, map[string]item{}, c.get("get", "big"), "Should not store oversize value")
+}
+
+func TestGetSet(t *testing.T) {
+	table, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, map[string]item{}, c.get("get", "foo"), "Should have no values")
+	assert.Equal(t, "STORED", c.do("set foo 0 0 3\r\nbar\r\n"), "Should set foo")
+	assert.Equal(t, "STORED", c.do("set bin 0 60 4\r\na\r\nb\r\n"), "Should set binary value")
+	assert.Equal(t, "STORED", c.do("set empty 0 0 0\r\n\r\n"), "Should set empty value")
+	assert.Equal(
+		t,
+		map[string]item{"foo": {value: "bar"}, "bin": {value: "a\r\nb"}, "empty": {}},
+		c.get("get", "foo", "bin", "empty", "missing"),
+		"Should get values",
+	)
+
+	// Records with zero flags are raw.
+	val, meta, err := table.GetWithMeta("foo")
+	assert.Nil(t, err, "Should get foo from table")
+	assert.Equal(t, "bar", string(val), "Should have value in table")
+	assert.Nil(t, meta, "Should have raw record")
+
+	// Flags are stored in metadata.
+	assert.Equal(t, "STORED", c.do("set foo 42 0 3\r\nbaz\r\n"), "Should set foo with flags")
+	assert.Equal(t, map[string]item{"foo": {flags: 42, value: "baz"}}, c.get("get", "foo"), "Should get flags")
+	val, meta, err = table.GetWithMeta("foo")
+	assert.Nil(t, err, "Should get foo from table")
+	assert.Equal(t, "baz", string(val), "Should have value in table")
+	if assert.NotNil(t, meta, "Should have metadata") {
+		assert.Equal(t, map[string]string{FlagsHeader: "42"}, meta.Headers, "Should have flags header")
+	}
+	assert.Equal(t, "STORED", c.do("set foo 0 0 3\r\nbar\r\n"), "Should set foo without flags")
+	assert.Equal(t, map[string]item{"foo": {value: "bar"}}, c.get("get", "foo"), "Should clear flags")
+
+	// noreply.
+	c.send("set quiet 0 0 1 noreply\r\nq\r\n")
+	assert.Equal(t, map[string]item{"quiet": {value: "q"}}, c.get("get", "quiet"), "Should set without reply")
+}
+
+func TestAddReplace(t *testing.T) {
+	_, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, "NOT_STORED", c.do("replace foo 0 0 1\r\nx\r\n"), "Should not replace missing key")
+	assert.Equal(t, map[string]item{}, c.get("get", "foo"), "Should not create key")
+	assert.Equal(t, "STORED", c.do("add foo 1 0 3\r\nbar\r\n"), "Should add foo")
+	assert.Equal(t, "NOT_STORED", c.do("add foo 0 0 1\r\nx\r\n"), "Should not add existing key")
+	assert.Equal(t, map[string]item{"foo": {flags: 1, value: "bar"}}, c.get("get", "foo"), "Should keep value")
+	assert.Equal(t, "STORED", c.do("replace foo 2 0 3\r\nbaz\r\n"), "Should replace foo")
+	assert.Equal(t, map[string]item{"foo": {flags: 2, value: "baz"}}, c.get("get", "foo"), "Should replace value")
+	assert.Equal(t, "STORED", c.do("replace foo 0 0 3\r\nbiz\r\n"), "Should replace foo without flags")
+	assert.Equal(t, map[string]item{"foo": {value: "biz"}}, c.get("get", "foo"), "Should clear flags")
+}
+
+func TestCas(t *testing.T) {
+	table, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, "NOT_FOUND", c.do("cas foo 0 0 1 1\r\nx\r\n"), "Should not find missing key")
+	assert.Equal(t, "STORED", c.do("set foo 0 0 3\r\nbar\r\n"), "Should set foo")
+
+	items := c.get("gets", "foo")
+	cas := items["foo"].cas
+	assert.NotZero(t, cas, "Should have cas unique")
+	assert.Equal(t, items, c.get("gets", "foo"), "Should have stable cas unique")
+	rec, err := table.GetRecord("foo")
+	assert.Nil(t, err, "Should get record")
+	assert.Equal(t, casUnique(rec.ETag), cas, "Should derive cas unique from ETag")
+
+	assert.Equal(
+		t,
+		"EXISTS",
+		c.do("cas foo 0 0 1 "+strconv.FormatUint(cas+1, 10)+"\r\nx\r\n"),
+		"Should not store with wrong cas unique",
+	)
+	assert.Equal(
+		t,
+		"STORED",
+		c.do("cas foo 7 0 3 "+strconv.FormatUint(cas, 10)+"\r\nbaz\r\n"),
+		"Should store with cas unique",
+	)
+	items = c.get("gets", "foo")
+	assert.Equal(t, "baz", items["foo"].value, "Should have new value")
+	assert.Equal(t, uint32(7), items["foo"].flags, "Should have new flags")
+	assert.NotEqual(t, cas, items["foo"].cas, "Should have new cas unique")
+	assert.Equal(
+		t,
+		"EXISTS",
+		c.do("cas foo 0 0 1 "+strconv.FormatUint(cas, 10)+"\r\nx\r\n"),
+		"Should not store with old cas unique",
+	)
+
+	// Empty values have cas uniques, too.
+	assert.Equal(t, "STORED", c.do("set empty 0 0 0\r\n\r\n"), "Should set empty value")
+	items = c.get("gets", "empty")
+	assert.Equal(t, "", items["empty"].value, "Should have empty value")
+	cas = items["empty"].cas
+	assert.NotZero(t, cas, "Should have cas unique for empty value")
+	assert.Equal(
+		t,
+		"EXISTS",
+		c.do("cas empty 0 0 1 "+strconv.FormatUint(cas+1, 10)+"\r\nx\r\n"),
+		"Should not store empty value with wrong cas unique",
+	)
+	assert.Equal(t, items, c.get("gets", "empty"), "Should keep empty value")
+	assert.Equal(
+		t,
+		"STORED",
+		c.do("cas empty 0 0 1 "+strconv.FormatUint(cas, 10)+"\r\nx\r\n"),
+		"Should store over empty value with cas unique",
+	)
+	assert.Equal(t, "x", c.get("get", "empty")["empty"].value, "Should have new value")
+}
+
+func TestCasContention(t *testing.T) {
+	_, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, "STORED", c.do("set n 0 0 1\r\n0\r\n"), "Should set n")
+
+	// Increment the counter from several connections with cas.
+	const workers, incs = 4, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wc := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < incs; {
+				it := wc.get("gets", "n")["n"]
+				n, _ := strconv.Atoi(it.value)
+				val := strconv.Itoa(n + 1)
+				reply := wc.do("cas n 0 0 " + strconv.Itoa(len(val)) + " " +
+					strconv.FormatUint(it.cas, 10) + "\r\n" + val + "\r\n")
+				if reply == "STORED" {
+					i++
+				} else if reply != "EXISTS" {
+					t.Errorf("unexpected reply %q", reply)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(
+		t,
+		map[string]item{"n": {value: strconv.Itoa(workers * incs)}},
+		c.get("get", "n"),
+		"Should lose no updates",
+	)
+}
+
+func TestDelete(t *testing.T) {
+	_, addr := setup(t)
+	c := dial(t, addr)
+	assert.Equal(t, "NOT_FOUND", c.do("delete foo\r\n"), "Should not find missing key")
+	c.do("set foo 0 0 3\r\nbar\r\n")
+	assert.Equal(t, "DELETED", c.do("delete foo\r\n"), "Should delete foo")
+	assert.Equal(t, map[string]item{}, c.get("get", "foo"), "Should have deleted foo")
+	c.do("set foo 0 0 3\r\nbar\r\n")
+	assert.Equal(t, "DELETED", c.do("delete foo 0\r\n"), "Should delete with zero hold time")
+	c.do("set foo 0 0 3\r\nbar\r\n")
+	c.send("delete foo noreply\r\n")
+	assert.Equal(t, map[string]item{}, c.get("get", "foo"), "Should delete without reply")
+	c.do("set foo 0 0 0\r\n\r\n")
+	assert.Equal(t, "DELETED", c.do("delete foo\r\n"), "Should delete empty value")
+	assert.Equal(t, map[string]item{}, c.get("get", "foo"), "Should have deleted empty value")
+	assert.Equal(
+		t,
+		"CLIENT_ERROR bad command line format.  Usage: delete <key> [noreply]",
+		c.do("delete foo 10\r\n"),
+		"Should reject hold time",
+	)
+}
+
+func TestPipeline(t *testing.T) {
+	_, addr := setup(t)
+	c := dial(t, addr)
+	const n = 100
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		val := strconv.Itoa(i)
+		b.WriteString("set k" + val + " 0 0 " + strconv.Itoa(len(val)) + "\r\n" + val + "\r\n")
+	}
+	c.send(b.String())
+	for i := 0; i < n; i++ {
+		assert.Equal(t, "STORED", c.line(), "Should set k%d", i)
+	}
+}
@@ -0,0 +1,295 @@
+package flockd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	// locksDir is the name of the directory in a table directory that holds
+	// the lock files for Mutex, RWMutex, Semaphore, LeaderElector, and Queue.
+	// The database-wide locks live in the root directory.
+	locksDir = ".locks"
+
+	// lockExt is the extension of lock files.
+	lockExt = ".lock"
+
+	// leaseExt is the extension appended to the name of a lock file to name
+	// the file that records its Lease.
+	leaseExt = ".lease"
+
+	// lockRetryDelay is the interval at which LockContext and RLockContext
+	// retry a lock.
+	lockRetryDelay = 10 * time.Millisecond
+)
+
+// ErrNotLocked is returned by Unlock and RUnlock when the lock is not held.
+var ErrNotLocked = errors.New("flockd: not locked")
+
+// Lease describes the process holding the exclusive lock on a Mutex or
+// RWMutex. The operating system releases the lock when the process exits, so a
+// lease lasts only as long as its holder.
+type Lease struct {
+	// PID is the ID of the holding process.
+	PID int `json:"pid"`
+
+	// Hostname is the name of the host on which the holding process runs.
+	Hostname string `json:"hostname"`
+
+	// WriterID is the writer ID of the database in the holding process. See
+	// WithWriterID.
+	WriterID string `json:"writer_id,omitempty"`
+
+	// Acquired is the time the process acquired the lock.
+	Acquired time.Time `json:"acquired"`
+}
+
+// Mutex is a named mutual exclusion lock shared by all processes using the
+// database directory, and by all Mutexes with the same name in a process. It
+// is implemented with an exclusive lock on a file in the ".locks" subdirectory
+// of the root directory, which the operating system releases if the holding
+// process exits without unlocking it. Once it has the lock, a Mutex records a
+// Lease describing the holder in a file next to the lock file, with the same
+// name plus the extension ".lease", which other processes can read with Holder.
+// The lease lives in a separate file because on Windows locks are mandatory, so
+// no other handle could read or write the locked file itself.
+//
+// Unlike sync.Mutex, a Mutex is not associated with a particular goroutine;
+// one goroutine may lock it and another unlock it. A Mutex must not be copied.
+type Mutex struct {
+	db    *DB
+	path  string
+	lease string
+	mu    sync.Mutex
+	held  *flock.Flock
+}
+
+// Mutex returns the Mutex with the name. The name must not contain a path
+// separator character; if it does, or it is empty, os.ErrInvalid will be
+// returned. Returns ErrReadOnly for a read-only database, since locking
+// requires writing the lock file.
+func (db *DB) Mutex(name string) (*Mutex, error) {
+	path, err := db.root.lockPath(name, lockExt)
+	if err != nil {
+		return nil, err
+	}
+	return newMutex(db, path), nil
+}
+
+// newMutex returns a Mutex that locks the file at path.
+func newMutex(db *DB, path string) *Mutex {
+	return &Mutex{db: db, path: path, lease: path + leaseExt}
+}
+
+// lockPath returns the path to the lock file or directory for name, with the
+// extension ext, in the locks directory of the table, creating the locks
+// directory if necessary.
+func (table *Table) lockPath(name, ext string) (string, error) {
+	if name == "" || strings.ContainsRune(name, os.PathSeparator) {
+		return "", os.ErrInvalid
+	}
+	if table.db.readOnly {
+		return "", ErrReadOnly
+	}
+	dir := filepath.Join(table.path, locksDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+ext), nil
+}
+
+// Lock locks the mutex, waiting as long as necessary for the lock.
+func (m *Mutex) Lock() error {
+	_, err := m.acquire(func(fl *flock.Flock) (bool, error) {
+		return true, fl.Lock()
+	})
+	return err
+}
+
+// TryLock tries to lock the mutex without waiting, and returns true if it
+// succeeded.
+func (m *Mutex) TryLock() (bool, error) {
+	return m.acquire((*flock.Flock).TryLock)
+}
+
+// LockContext locks the mutex, waiting until ctx is done for the lock. Returns
+// the context error if it did not get the lock.
+func (m *Mutex) LockContext(ctx context.Context) error {
+	_, err := m.acquire(func(fl *flock.Flock) (bool, error) {
+		return fl.TryLockContext(ctx, lockRetryDelay)
+	})
+	return err
+}
+
+// acquire uses lock to take an exclusive lock on the file, then records the
+// lease. Returns false if lock did not get the lock.
+func (m *Mutex) acquire(lock func(fl *flock.Flock) (bool, error)) (bool, error) {
+	fl := flock.NewFlock(m.path)
+	locked, err := lock(fl)
+	if err != nil || !locked {
+		return false, err
+	}
+	if err := m.writeLease(); err != nil {
+		fl.Unlock()
+		return false, err
+	}
+	m.mu.Lock()
+	m.held = fl
+	m.mu.Unlock()
+	return true, nil
+}
+
+// writeLease records the lease for the current process in the lease file,
+// replacing it atomically so that Holder never reads a partial lease. The
+// caller must hold the exclusive lock.
+func (m *Mutex) writeLease() error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(&Lease{
+		PID:      os.Getpid(),
+		Hostname: host,
+		WriterID: m.db.writerID,
+		Acquired: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(filepath.Dir(m.lease), filepath.Base(m.lease), data, m.db.root.timeout)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	return os.Rename(tmp.file, m.lease)
+}
+
+// Unlock removes the lease and unlocks the mutex. Returns ErrNotLocked if the
+// mutex is not locked.
+func (m *Mutex) Unlock() error {
+	m.mu.Lock()
+	fl := m.held
+	m.held = nil
+	m.mu.Unlock()
+	if fl == nil {
+		return ErrNotLocked
+	}
+	if err := removeFile(m.lease); err != nil {
+		fl.Unlock()
+		return err
+	}
+	return fl.Unlock()
+}
+
+// Holder returns the lease of the process that holds the exclusive lock, which
+// may be the current process, or nil if no process holds it. If the holder has
+// not yet recorded its lease, Holder returns an empty Lease, or, if the
+// previous holder exited without unlocking, briefly returns its lease.
+func (m *Mutex) Holder() (*Lease, error) {
+	fl := flock.NewFlock(m.path)
+	free, err := fl.TryRLock()
+	if err != nil {
+		return nil, err
+	}
+	if free {
+		fl.Unlock()
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(m.lease)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Lease{}, nil
+		}
+		return nil, err
+	}
+	lease := &Lease{}
+	if err := json.Unmarshal(data, lease); err != nil {
+		return &Lease{}, nil
+	}
+	return lease, nil
+}
+
+// RWMutex is a named reader/writer mutual exclusion lock shared by all
+// processes using the database directory. The lock can be held by any number
+// of readers or a single writer. It embeds a Mutex, whose methods lock it for
+// writing and report the writer's Lease; readers record no leases. Like Mutex,
+// it uses a file in the ".locks" subdirectory of the root directory, so an
+// RWMutex and a Mutex with the same name exclude each other.
+type RWMutex struct {
+	Mutex
+	readers []*flock.Flock
+}
+
+// RWMutex returns the RWMutex with the name. The name must not contain a path
+// separator character; if it does, or it is empty, os.ErrInvalid will be
+// returned. Returns ErrReadOnly for a read-only database.
+func (db *DB) RWMutex(name string) (*RWMutex, error) {
+	path, err := db.root.lockPath(name, lockExt)
+	if err != nil {
+		return nil, err
+	}
+	return &RWMutex{Mutex: Mutex{db: db, path: path, lease: path + leaseExt}}, nil
+}
+
+// RLock locks the mutex for reading, waiting as long as necessary for the
+// lock.
+func (rw *RWMutex) RLock() error {
+	_, err := rw.racquire(func(fl *flock.Flock) (bool, error) {
+		return true, fl.RLock()
+	})
+	return err
+}
+
+// TryRLock tries to lock the mutex for reading without waiting, and returns
+// true if it succeeded.
+func (rw *RWMutex) TryRLock() (bool, error) {
+	return rw.racquire((*flock.Flock).TryRLock)
+}
+
+// RLockContext locks the mutex for reading, waiting until ctx is done for the
+// lock. Returns the context error if it did not get the lock.
+func (rw *RWMutex) RLockContext(ctx context.Context) error {
+	_, err := rw.racquire(func(fl *flock.Flock) (bool, error) {
+		return fl.TryRLockContext(ctx, lockRetryDelay)
+	})
+	return err
+}
+
+// racquire uses lock to take a shared lock on the file. Returns false if lock
+// did not get the lock.
+func (rw *RWMutex) racquire(lock func(fl *flock.Flock) (bool, error)) (bool, error) {
+	fl := flock.NewFlock(rw.path)
+	locked, err := lock(fl)
+	if err != nil || !locked {
+		return false, err
+	}
+	rw.mu.Lock()
+	rw.readers = append(rw.readers, fl)
+	rw.mu.Unlock()
+	return true, nil
+}
+
+// RUnlock undoes a single RLock. Returns ErrNotLocked if the mutex is not
+// locked for reading.
+func (rw *RWMutex) RUnlock() error {
+	rw.mu.Lock()
+	n := len(rw.readers)
+	if n == 0 {
+		rw.mu.Unlock()
+		return ErrNotLocked
+	}
+	fl := rw.readers[n-1]
+	rw.readers = rw.readers[:n-1]
+	rw.mu.Unlock()
+	return fl.Unlock()
+}
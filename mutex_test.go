@@ -0,0 +1,348 @@
+package flockd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Environment variables that configure TestMutexHelper.
+const (
+	helperEnv     = "FLOCKD_MUTEX_HELPER"
+	helperDirEnv  = "FLOCKD_MUTEX_DIR"
+	helperNameEnv = "FLOCKD_MUTEX_NAME"
+)
+
+// TestMutexHelper is not a real test, but a child process started by the
+// Mutex, Semaphore, and LeaderElector tests. It locks the RWMutex named by the
+// environment in the mode set by helperEnv, "lock", "rlock", or "crash",
+// acquires a slot of the Semaphore with semSlots slots in mode "acquire", or
+// campaigns for leadership in modes "lead" and "lead-crash". It writes
+// "locked" to stdout, and waits for stdin to close. It then unlocks the mutex,
+// releases the slot, or resigns, unless the mode is "crash" or "lead-crash", in
+// which case it exits without unlocking.
+func TestMutexHelper(t *testing.T) {
+	mode := os.Getenv(helperEnv)
+	if mode == "" {
+		return
+	}
+	db, err := New(os.Getenv(helperDirEnv), time.Second, WithWriterID("child"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	switch mode {
+	case "acquire":
+		semaphoreHelper(db)
+	case "lead", "lead-crash":
+		leaderHelper(db, mode == "lead-crash")
+	}
+	rw, err := db.RWMutex(os.Getenv(helperNameEnv))
+	if err == nil {
+		if mode == "rlock" {
+			err = rw.RLock()
+		} else {
+			err = rw.Lock()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Println("locked")
+	io.Copy(ioutil.Discard, os.Stdin)
+	if mode == "crash" {
+		os.Exit(1)
+	}
+	if mode == "rlock" {
+		err = rw.RUnlock()
+	} else {
+		err = rw.Unlock()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// locker is a child process holding a lock.
+type locker struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// startLocker starts a child process that locks the mutex name in mode, and
+// waits until it has the lock. See TestMutexHelper.
+func (s *TS) startLocker(name, mode string) *locker {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMutexHelper$")
+	cmd.Env = append(
+		os.Environ(),
+		helperEnv+"="+mode,
+		helperDirEnv+"="+s.dir,
+		helperNameEnv+"="+name,
+	)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.T().Fatal("StdinPipe", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		s.T().Fatal("StdoutPipe", err)
+	}
+	if err := cmd.Start(); err != nil {
+		s.T().Fatal("Start", err)
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		s.T().Fatalf("child did not lock: %q, %v", line, err)
+	}
+	go io.Copy(ioutil.Discard, stdout)
+	return &locker{cmd: cmd, stdin: stdin}
+}
+
+// release tells the child process to exit and waits for it.
+func (l *locker) release() error {
+	l.stdin.Close()
+	return l.cmd.Wait()
+}
+
+func (s *TS) TestMutexName() {
+	for _, name := range []string{"", filepath.Join("a", "b")} {
+		_, err := s.db.Mutex(name)
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid from Mutex for %q", name)
+		_, err = s.db.RWMutex(name)
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid from RWMutex for %q", name)
+	}
+
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	_, err = ro.Mutex("foo")
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from Mutex")
+	_, err = ro.RWMutex("foo")
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from RWMutex")
+}
+
+func (s *TS) TestMutex() {
+	db, err := New(s.dir, time.Second, WithWriterID("parent"))
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	m1, err := db.Mutex("job")
+	if err != nil {
+		s.T().Fatal("Mutex", err)
+	}
+	m2, err := db.Mutex("job")
+	if err != nil {
+		s.T().Fatal("Mutex", err)
+	}
+	lease, err := m1.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	s.Nil(lease, "Should have no holder")
+	s.Equal(ErrNotLocked, m1.Unlock(), "Should have ErrNotLocked from Unlock")
+
+	// Mutexes with the same name exclude each other.
+	s.Nil(m1.Lock(), "Should lock")
+	file := filepath.Join(s.dir, locksDir, "job"+lockExt)
+	s.FileExists(file, "Should create lock file")
+	s.FileExists(file+leaseExt, "Should create lease file")
+	if info, err := os.Stat(file); s.Nil(err, "Should stat lock file") {
+		s.Zero(info.Size(), "Should not write to the locked file")
+	}
+	ok, err := m2.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get lock")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, m2.LockContext(ctx), "Should time out")
+
+	// Both should report the lease.
+	host, _ := os.Hostname()
+	for _, m := range []*Mutex{m1, m2} {
+		lease, err := m.Holder()
+		s.Nil(err, "Should have no error from Holder")
+		if s.NotNil(lease, "Should have holder") {
+			s.Equal(os.Getpid(), lease.PID, "Should have PID")
+			s.Equal(host, lease.Hostname, "Should have hostname")
+			s.Equal("parent", lease.WriterID, "Should have writer ID")
+			s.WithinDuration(time.Now(), lease.Acquired, time.Minute, "Should have acquired time")
+		}
+	}
+
+	// Lock should wait for Unlock.
+	done := make(chan error)
+	go func() { done <- m2.Lock() }()
+	select {
+	case err := <-done:
+		s.T().Fatal("Lock did not wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.Nil(m1.Unlock(), "Should unlock")
+	s.Nil(<-done, "Should lock after unlock")
+	s.Equal(ErrNotLocked, m1.Unlock(), "Should not unlock again")
+
+	// Another goroutine may unlock.
+	go func() { done <- m2.Unlock() }()
+	s.Nil(<-done, "Should unlock from another goroutine")
+	s.fileNotExists(file + leaseExt)
+	lease, err = m1.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	s.Nil(lease, "Should have no holder after unlock")
+	ok, err = m1.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.True(ok, "Should get lock")
+	s.Nil(m1.Unlock(), "Should unlock")
+}
+
+func (s *TS) TestRWMutex() {
+	r1, err := s.db.RWMutex("data")
+	if err != nil {
+		s.T().Fatal("RWMutex", err)
+	}
+	r2, err := s.db.RWMutex("data")
+	if err != nil {
+		s.T().Fatal("RWMutex", err)
+	}
+	s.Equal(ErrNotLocked, r1.RUnlock(), "Should have ErrNotLocked from RUnlock")
+
+	// Readers share.
+	s.Nil(r1.RLock(), "Should read lock")
+	s.Nil(r1.RLock(), "Should read lock again")
+	ok, err := r2.TryRLock()
+	s.Nil(err, "Should have no error from TryRLock")
+	s.True(ok, "Should share read lock")
+	lease, err := r1.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	s.Nil(lease, "Should have no lease for readers")
+
+	// Writers wait for readers.
+	ok, err = r2.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get write lock")
+	s.Nil(r2.RUnlock(), "Should read unlock")
+	s.Nil(r1.RUnlock(), "Should read unlock")
+	ok, err = r2.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get write lock with a reader")
+	s.Nil(r1.RUnlock(), "Should read unlock again")
+	s.Equal(ErrNotLocked, r1.RUnlock(), "Should have no more read locks")
+
+	// Readers wait for writers.
+	s.Nil(r2.Lock(), "Should write lock")
+	ok, err = r1.TryRLock()
+	s.Nil(err, "Should have no error from TryRLock")
+	s.False(ok, "Should not get read lock")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, r1.RLockContext(ctx), "Should time out")
+	lease, err = r1.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	if s.NotNil(lease, "Should have writer lease") {
+		s.Equal(os.Getpid(), lease.PID, "Should have PID")
+	}
+
+	// A Mutex with the same name excludes it.
+	m, err := s.db.Mutex("data")
+	if err != nil {
+		s.T().Fatal("Mutex", err)
+	}
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Mutex should not get lock")
+	s.Nil(r2.Unlock(), "Should write unlock")
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.True(ok, "Mutex should get lock")
+	s.Nil(m.Unlock(), "Should unlock")
+}
+
+func (s *TS) TestMutexProcesses() {
+	m, err := s.db.Mutex("job")
+	if err != nil {
+		s.T().Fatal("Mutex", err)
+	}
+
+	// Another process holds the lock.
+	child := s.startLocker("job", "lock")
+	ok, err := m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get lock held by child")
+	lease, err := m.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	host, _ := os.Hostname()
+	if s.NotNil(lease, "Should have holder") {
+		s.Equal(child.cmd.Process.Pid, lease.PID, "Should have child PID")
+		s.Equal(host, lease.Hostname, "Should have hostname")
+		s.Equal("child", lease.WriterID, "Should have child writer ID")
+	}
+
+	// Wait for the child to unlock.
+	done := make(chan error)
+	go func() { done <- m.Lock() }()
+	s.Nil(child.release(), "Child should exit cleanly")
+	s.Nil(<-done, "Should lock after child unlocks")
+	lease, err = m.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	if s.NotNil(lease, "Should have holder") {
+		s.Equal(os.Getpid(), lease.PID, "Should hold lock")
+	}
+	s.Nil(m.Unlock(), "Should unlock")
+
+	// The lock is released when the holder dies.
+	child = s.startLocker("job", "crash")
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get lock held by child")
+	s.NotNil(child.release(), "Child should exit with an error")
+	lease, err = m.Holder()
+	s.Nil(err, "Should have no error from Holder")
+	s.Nil(lease, "Should have no holder after child dies")
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.True(ok, "Should get lock after child dies")
+	s.Nil(m.Unlock(), "Should unlock")
+
+	// Readers in different processes share.
+	rw, err := s.db.RWMutex("job")
+	if err != nil {
+		s.T().Fatal("RWMutex", err)
+	}
+	child = s.startLocker("job", "rlock")
+	ok, err = rw.TryRLock()
+	s.Nil(err, "Should have no error from TryRLock")
+	s.True(ok, "Should share read lock with child")
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.False(ok, "Should not get write lock")
+	s.Nil(rw.RUnlock(), "Should read unlock")
+	s.Nil(child.release(), "Child should exit cleanly")
+	ok, err = m.TryLock()
+	s.Nil(err, "Should have no error from TryLock")
+	s.True(ok, "Should get write lock")
+	s.Nil(m.Unlock(), "Should unlock")
+}
+
+// The mutex lock directory should not bother Check.
+func (s *TS) TestMutexCheck() {
+	m, err := s.db.Mutex("job")
+	if err != nil {
+		s.T().Fatal("Mutex", err)
+	}
+	s.Nil(m.Lock(), "Should lock")
+	defer m.Unlock()
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems")
+}
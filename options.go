@@ -0,0 +1,27 @@
+package flockd
+
+import (
+	"fmt"
+	"os"
+)
+
+// Option configures optional behavior of a DB. Pass options to New.
+type Option func(*DB)
+
+// WithWriterID sets the writer ID recorded in the envelope of every record
+// written by the database. Defaults to the host name and process ID, joined by a
+// colon.
+func WithWriterID(id string) Option {
+	return func(db *DB) {
+		db.writerID = id
+	}
+}
+
+// defaultWriterID returns the host name and process ID, joined by a colon.
+func defaultWriterID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("%v:%v", host, os.Getpid())
+}
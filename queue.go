@@ -0,0 +1,366 @@
+package flockd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// queueLockFile is the name of the file in the locks directory of a table
+	// that serializes queue operations.
+	queueLockFile = "queue" + lockExt
+
+	// queueSeqFile is the name of the file in the locks directory of a table
+	// that records the last sequence number. It is separate from the lock
+	// file because on Windows locks are mandatory, so no other handle could
+	// read or write the locked file.
+	queueSeqFile = "queue.seq"
+
+	// queueClaimsDir is the name of the directory in the locks directory of a
+	// table that holds the claims on dequeued items.
+	queueClaimsDir = "queue.claims"
+)
+
+var (
+	// ErrQueueEmpty is returned by Dequeue and Peek when the queue has no
+	// visible items.
+	ErrQueueEmpty = errors.New("flockd: queue empty")
+
+	// ErrClaimExpired is returned by Ack and Nack when an item's visibility
+	// timeout has passed and another consumer has claimed it, or it has already
+	// been acknowledged.
+	ErrClaimExpired = errors.New("flockd: queue claim expired")
+)
+
+// Queue is a durable FIFO queue stored in a table, and shared by all processes
+// using the database directory. Each item is a record whose key is a sequence
+// number derived from the time it was enqueued, so that keys sort in the order
+// the items were enqueued. The queue owns the table: every key in the table is
+// an item.
+//
+// Dequeue claims an item for a visibility timeout, during which no other
+// consumer can dequeue it. The consumer then calls Ack to remove the item, or
+// Nack to return it to the queue. If it does neither before the timeout, the
+// item becomes visible again. Enqueue, Dequeue, Ack, and Nack hold an exclusive
+// lock on a file in the ".locks" subdirectory of the table directory, so that
+// no two consumers, in any process, claim the same item.
+//
+// Claims are files in the locks directory, one per dequeued item. The queue
+// keeps no index or head cursor: every Dequeue, Peek, and Len lists every key
+// in the table, checking each record for a tombstone, and Dequeue and Peek also
+// list the claims directory and read each outstanding claim until they find a
+// visible item. They therefore take time proportional to the number of items
+// plus the number of outstanding claims, which suits queues of thousands of
+// items rather than millions. Dequeue also removes claims left for items no
+// longer in the queue, such as by a consumer that exited while acknowledging an
+// item.
+type Queue struct {
+	table  *Table
+	lock   string
+	seq    string
+	claims string
+}
+
+// QueueItem is an item returned by Dequeue or Peek.
+type QueueItem struct {
+	// Key is the key of the item's record in the table.
+	Key string
+
+	// Value is the item's value.
+	Value []byte
+
+	// Enqueued is the time the item was enqueued.
+	Enqueued time.Time
+
+	// Deadline is the time the visibility timeout expires for an item
+	// returned by Dequeue, and zero for an item returned by Peek.
+	Deadline time.Time
+
+	token string
+}
+
+// queueClaim records the claim on a dequeued item.
+type queueClaim struct {
+	Token    string    `json:"token"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// Queue returns the Queue stored in the table. Returns ErrReadOnly for a
+// read-only database.
+func (table *Table) Queue() (*Queue, error) {
+	if table.db.readOnly {
+		return nil, ErrReadOnly
+	}
+	dir := filepath.Join(table.path, locksDir)
+	claims := filepath.Join(dir, queueClaimsDir)
+	if err := os.MkdirAll(claims, 0755); err != nil {
+		return nil, err
+	}
+	return &Queue{
+		table:  table,
+		lock:   filepath.Join(dir, queueLockFile),
+		seq:    filepath.Join(dir, queueSeqFile),
+		claims: claims,
+	}, nil
+}
+
+// Enqueue adds an item with the value to the end of the queue and returns its
+// key. The key is the time in nanoseconds since the Unix epoch, as 16
+// hexadecimal digits, or one more than the key of the last item enqueued if
+// that is greater, so that keys always increase.
+func (q *Queue) Enqueue(val []byte) (string, error) {
+	lock, err := lockFile(q.lock, true, q.table.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	// Read the last sequence number.
+	data, err := ioutil.ReadFile(q.seq)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	seq := uint64(time.Now().UnixNano())
+	if s := strings.TrimSpace(string(data)); s != "" {
+		last, err := strconv.ParseUint(s, 16, 64)
+		if err != nil {
+			return "", fmt.Errorf("flockd: invalid queue sequence %q: %w", s, err)
+		}
+		if last >= seq {
+			seq = last + 1
+		}
+	}
+
+	key := fmt.Sprintf("%016x", seq)
+	if err := q.table.Create(key, val); err != nil {
+		return "", err
+	}
+	if err := q.writeSeq(key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// writeSeq records key as the last sequence number, replacing the file
+// atomically so that a failed write never loses the sequence. The caller must
+// hold the exclusive queue lock.
+func (q *Queue) writeSeq(key string) error {
+	tmp, err := writeTemp(filepath.Dir(q.seq), queueSeqFile, []byte(key), q.table.timeout)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	return os.Rename(tmp.file, q.seq)
+}
+
+// Dequeue claims the first visible item in the queue for the visibility
+// timeout, and returns it. Returns ErrQueueEmpty if there are no visible items,
+// or os.ErrInvalid if timeout is not positive.
+func (q *Queue) Dequeue(timeout time.Duration) (*QueueItem, error) {
+	if timeout <= 0 {
+		return nil, os.ErrInvalid
+	}
+	lock, err := lockFile(q.lock, true, q.table.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	item, err := q.first(true)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	claim := &queueClaim{
+		Token:    hex.EncodeToString(buf),
+		Deadline: time.Now().Add(timeout).UTC(),
+	}
+	data, err := json.Marshal(claim)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(q.claims, item.Key), data, 0600); err != nil {
+		return nil, err
+	}
+	item.Deadline = claim.Deadline
+	item.token = claim.Token
+	return item, nil
+}
+
+// Peek returns the first visible item in the queue without claiming it.
+// Returns ErrQueueEmpty if there are no visible items.
+func (q *Queue) Peek() (*QueueItem, error) {
+	lock, err := lockFile(q.lock, false, q.table.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	return q.first(false)
+}
+
+// Len returns the number of items in the queue, including those claimed by
+// Dequeue but not yet acknowledged. Like Peek, it holds a shared lock on the
+// queue, so that it never counts an item being acknowledged.
+func (q *Queue) Len() (int, error) {
+	lock, err := lockFile(q.lock, false, q.table.timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	keys, err := q.table.Keys()
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// Ack acknowledges an item returned by Dequeue, removing it from the queue.
+// Returns ErrClaimExpired if the item's visibility timeout has passed and
+// another consumer has since claimed it, or if it was already acknowledged.
+func (q *Queue) Ack(item *QueueItem) error {
+	return q.release(item, func() error { return q.table.Delete(item.Key) })
+}
+
+// Nack returns an item returned by Dequeue to the queue, where it is again
+// visible in its original position. Returns ErrClaimExpired if the item's
+// visibility timeout has passed and another consumer has since claimed it, or
+// if it was already acknowledged.
+func (q *Queue) Nack(item *QueueItem) error {
+	return q.release(item, nil)
+}
+
+// release checks that the claim on item is still the one made by Dequeue,
+// calls fn, if not nil, and removes the claim.
+func (q *Queue) release(item *QueueItem, fn func() error) error {
+	if item.token == "" {
+		return ErrClaimExpired
+	}
+	lock, err := lockFile(q.lock, true, q.table.timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	claim, err := q.claim(item.Key)
+	if err != nil {
+		return err
+	}
+	if claim == nil || claim.Token != item.token {
+		return ErrClaimExpired
+	}
+	if fn != nil {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(filepath.Join(q.claims, item.Key))
+}
+
+// first returns the first item with no current claim. If prune is true, it
+// also removes the claims on items no longer in the table. The caller must hold
+// the queue lock, exclusively to prune.
+func (q *Queue) first(prune bool) (*QueueItem, error) {
+	keys, err := q.table.Keys()
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := q.claimed()
+	if err != nil {
+		return nil, err
+	}
+	if prune {
+		if err := q.prune(keys, claimed); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if claimed[key] {
+			claim, err := q.claim(key)
+			if err != nil {
+				return nil, err
+			}
+			if claim != nil && claim.Deadline.After(now) {
+				continue
+			}
+		}
+		val, err := q.table.Get(key)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted since listing.
+				continue
+			}
+			return nil, err
+		}
+		item := &QueueItem{Key: key, Value: val}
+		if seq, err := strconv.ParseUint(key, 16, 64); err == nil {
+			item.Enqueued = time.Unix(0, int64(seq))
+		}
+		return item, nil
+	}
+	return nil, ErrQueueEmpty
+}
+
+// claimed returns the set of keys that have claim files.
+func (q *Queue) claimed() (map[string]bool, error) {
+	files, err := ioutil.ReadDir(q.claims)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make(map[string]bool, len(files))
+	for _, info := range files {
+		if info.Mode().IsRegular() {
+			claimed[info.Name()] = true
+		}
+	}
+	return claimed, nil
+}
+
+// prune removes the claims in claimed on items whose keys are not in keys. The
+// caller must hold the exclusive queue lock.
+func (q *Queue) prune(keys []string, claimed map[string]bool) error {
+	items := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		items[key] = true
+	}
+	for key := range claimed {
+		if items[key] {
+			continue
+		}
+		if err := removeFile(filepath.Join(q.claims, key)); err != nil {
+			return err
+		}
+		delete(claimed, key)
+	}
+	return nil
+}
+
+// claim returns the claim on the item with key, or nil if it has none.
+func (q *Queue) claim(key string) (*queueClaim, error) {
+	data, err := ioutil.ReadFile(filepath.Join(q.claims, key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	claim := &queueClaim{}
+	if err := json.Unmarshal(data, claim); err != nil {
+		// Treat a corrupt claim as expired.
+		return nil, nil
+	}
+	return claim, nil
+}
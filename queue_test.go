@@ -0,0 +1,212 @@
+package flockd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func (s *TS) queue(name string) *Queue {
+	tbl, err := s.db.Table(name)
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	q, err := tbl.Queue()
+	if err != nil {
+		s.T().Fatal("Queue", err)
+	}
+	return q
+}
+
+func (s *TS) TestQueue() {
+	q := s.queue("jobs")
+	_, err := q.Dequeue(time.Minute)
+	s.Equal(ErrQueueEmpty, err, "Should have ErrQueueEmpty from Dequeue")
+	_, err = q.Peek()
+	s.Equal(ErrQueueEmpty, err, "Should have ErrQueueEmpty from Peek")
+	n, err := q.Len()
+	s.Nil(err, "Should have no error from Len")
+	s.Equal(0, n, "Should be empty")
+
+	// Keys increase in enqueue order.
+	keys := []string{}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		key, err := q.Enqueue([]byte(fmt.Sprintf("job%v", i)))
+		s.Nil(err, "Should enqueue job%v", i)
+		if len(keys) > 0 {
+			s.True(key > keys[len(keys)-1], "Key %v should sort after %v", key, keys[len(keys)-1])
+		}
+		keys = append(keys, key)
+	}
+	n, err = q.Len()
+	s.Nil(err, "Should have no error from Len")
+	s.Equal(3, n, "Should have three items")
+
+	// Peek does not claim.
+	item, err := q.Peek()
+	s.Nil(err, "Should peek")
+	s.Equal("job0", string(item.Value), "Should peek first item")
+	s.Equal(keys[0], item.Key, "Should have first key")
+	s.False(item.Enqueued.Before(start.Add(-time.Second)), "Should have enqueue time")
+	s.Equal(ErrClaimExpired, q.Ack(item), "Should not ack peeked item")
+
+	// Dequeue claims in order.
+	first, err := q.Dequeue(time.Minute)
+	s.Nil(err, "Should dequeue")
+	s.Equal("job0", string(first.Value), "Should dequeue first item")
+	s.False(first.Deadline.IsZero(), "Should have deadline")
+	second, err := q.Dequeue(time.Minute)
+	s.Nil(err, "Should dequeue")
+	s.Equal("job1", string(second.Value), "Should dequeue second item")
+	item, err = q.Peek()
+	s.Nil(err, "Should peek")
+	s.Equal("job2", string(item.Value), "Should peek first unclaimed item")
+	n, err = q.Len()
+	s.Nil(err, "Should have no error from Len")
+	s.Equal(3, n, "Should count claimed items")
+
+	// Ack removes, Nack returns.
+	s.Nil(q.Ack(first), "Should ack first item")
+	s.Equal(ErrClaimExpired, q.Ack(first), "Should not ack twice")
+	s.Nil(q.Nack(second), "Should nack second item")
+	s.Equal(ErrClaimExpired, q.Nack(second), "Should not nack twice")
+	item, err = q.Dequeue(time.Minute)
+	s.Nil(err, "Should dequeue")
+	s.Equal("job1", string(item.Value), "Should dequeue nacked item again")
+	s.Nil(q.Ack(item), "Should ack item")
+	n, err = q.Len()
+	s.Nil(err, "Should have no error from Len")
+	s.Equal(1, n, "Should have one item left")
+
+	// The queue files should not bother Check.
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems")
+}
+
+func (s *TS) TestQueueVisibility() {
+	q := s.queue("jobs")
+	_, err := q.Enqueue([]byte("job"))
+	s.Nil(err, "Should enqueue")
+	item, err := q.Dequeue(20 * time.Millisecond)
+	s.Nil(err, "Should dequeue")
+	_, err = q.Dequeue(time.Minute)
+	s.Equal(ErrQueueEmpty, err, "Should not dequeue claimed item")
+
+	// The item reappears once the timeout passes.
+	time.Sleep(30 * time.Millisecond)
+	again, err := q.Dequeue(time.Minute)
+	s.Nil(err, "Should dequeue item after timeout")
+	s.Equal(item.Key, again.Key, "Should dequeue same item")
+	s.Equal(ErrClaimExpired, q.Ack(item), "Should not ack expired claim")
+	s.Equal(ErrClaimExpired, q.Nack(item), "Should not nack expired claim")
+	s.Nil(q.Ack(again), "Should ack current claim")
+	n, err := q.Len()
+	s.Nil(err, "Should have no error from Len")
+	s.Equal(0, n, "Should be empty")
+
+	// The timeout must be positive.
+	_, err = q.Enqueue([]byte("job"))
+	s.Nil(err, "Should enqueue")
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		_, err = q.Dequeue(timeout)
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for timeout %v", timeout)
+	}
+
+	// Dequeue prunes claims on items removed from the table.
+	item, err = q.Dequeue(time.Minute)
+	s.Nil(err, "Should dequeue")
+	claim := filepath.Join(q.claims, item.Key)
+	s.FileExists(claim, "Should have claim file")
+	s.Nil(q.table.Delete(item.Key), "Should delete item from table")
+	_, err = q.Dequeue(time.Minute)
+	s.Equal(ErrQueueEmpty, err, "Should have ErrQueueEmpty")
+	s.fileNotExists(claim)
+}
+
+func (s *TS) TestQueueSequence() {
+	q := s.queue("jobs")
+
+	// Keys increase even if the clock goes backwards.
+	future := fmt.Sprintf("%016x", time.Now().Add(time.Hour).UnixNano())
+	seq := filepath.Join(s.dir, "jobs"+tblExt, locksDir, queueSeqFile)
+	s.Nil(ioutil.WriteFile(seq, []byte(future), 0600), "Should write sequence")
+	key, err := q.Enqueue([]byte("job"))
+	s.Nil(err, "Should enqueue")
+	s.True(key > future, "Key %v should sort after %v", key, future)
+
+	info, err := os.Stat(filepath.Join(s.dir, "jobs"+tblExt, locksDir, queueLockFile))
+	if s.Nil(err, "Should stat lock file") {
+		s.Zero(info.Size(), "Should not write to the locked file")
+	}
+	s.Nil(ioutil.WriteFile(seq, []byte("nope"), 0600), "Should write bad sequence")
+	_, err = q.Enqueue([]byte("job"))
+	s.NotNil(err, "Should have error for invalid sequence")
+
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	tbl, err := ro.Table("jobs")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	_, err = tbl.Queue()
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from Queue")
+}
+
+// Consumers with separate databases, and so separate file locks, as in
+// separate processes, should never dequeue the same item.
+func (s *TS) TestQueueConsumers() {
+	q := s.queue("jobs")
+	const items = 50
+	for i := 0; i < items; i++ {
+		_, err := q.Enqueue([]byte(fmt.Sprintf("job%v", i)))
+		s.Nil(err, "Should enqueue job%v", i)
+	}
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		db, err := New(s.dir, 5*time.Second)
+		if err != nil {
+			s.T().Fatal("New", err)
+		}
+		tbl, err := db.Table("jobs")
+		if err != nil {
+			s.T().Fatal("Table", err)
+		}
+		cq, err := tbl.Queue()
+		if err != nil {
+			s.T().Fatal("Queue", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, err := cq.Dequeue(time.Minute)
+				if err == ErrQueueEmpty {
+					return
+				}
+				if !s.Nil(err, "Should dequeue") {
+					return
+				}
+				mu.Lock()
+				seen[string(item.Value)]++
+				mu.Unlock()
+				s.Nil(cq.Ack(item), "Should ack %v", item.Key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.Len(seen, items, "Should dequeue every item")
+	for val, count := range seen {
+		s.Equal(1, count, "Should dequeue %v once", val)
+	}
+}
@@ -0,0 +1,217 @@
+package flockd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// metaHeader is the HTTP header in which the replication handler sends
+	// the JSON-encoded Meta of a record.
+	metaHeader = "Flockd-Meta"
+
+	// missingHeader is the HTTP header the replication handler sets in a 404
+	// response for a record that doesn't exist, to distinguish it from a 404
+	// for an invalid URL.
+	missingHeader = "Flockd-Missing"
+
+	// defaultChangesLimit is the number of changes the replication handler
+	// serves when the request does not specify a limit.
+	defaultChangesLimit = 100
+
+	// maxChangesLimit is the maximum number of changes the replication
+	// handler serves at once.
+	maxChangesLimit = 1000
+)
+
+// ReplicationHandler returns an http.Handler that serves the change log and
+// records of db to secondaries using HTTPSource. It handles GET requests for
+// two paths:
+//
+//   - /changes?after=N&limit=M responds with a JSON array of up to M changes
+//     with sequence numbers greater than N. M defaults to 100 and may be no
+//     more than 1000; request more pages to read further.
+//   - /records?table=T&key=K responds with the value of the record for key K
+//     in table T, with forward slashes separating nested table names, and its
+//     JSON-encoded metadata in the Flockd-Meta header.
+//
+// Use http.StripPrefix to serve it under a prefix. It responds with 404 Not
+// Found for a record that doesn't exist, with the Flockd-Missing header set, or
+// when the change log is not enabled, and with 410 Gone when the changes after
+// N have been trimmed.
+//
+// The handler performs no authentication or authorization, and serves values
+// in plaintext, decrypted if their tables are encrypted. Serve it only behind
+// middleware that authenticates secondaries, over TLS.
+func ReplicationHandler(db *DB) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/changes", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		q := r.URL.Query()
+		after, err := queryUint(q, "after")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := queryUint(q, "limit")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit == 0 {
+			limit = defaultChangesLimit
+		} else if limit > maxChangesLimit {
+			limit = maxChangesLimit
+		}
+		changes, err := db.Changes(after, int(limit))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+	})
+	mux.HandleFunc("/records", func(w http.ResponseWriter, r *http.Request) {
+		if !allowGet(w, r) {
+			return
+		}
+		q := r.URL.Query()
+		val, meta, err := db.Fetch(q.Get("table"), q.Get("key"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				w.Header().Set(missingHeader, "true")
+			}
+			httpError(w, err)
+			return
+		}
+		if meta != nil {
+			data, err := json.Marshal(meta)
+			if err != nil {
+				httpError(w, err)
+				return
+			}
+			w.Header().Set(metaHeader, string(data))
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+		w.Write(val)
+	})
+	return mux
+}
+
+// allowGet responds with 405 Method Not Allowed and returns false unless the
+// request method is GET or HEAD.
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// queryUint parses the query parameter name as an unsigned integer. Returns
+// zero if it is not set.
+func queryUint(q url.Values, name string) (uint64, error) {
+	str := q.Get(name)
+	if str == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v: %q", name, str)
+	}
+	return n, nil
+}
+
+// HTTPSource is a ChangeSource that pulls changes and records from a
+// ReplicationHandler, so that a Replicator can replicate a database served by
+// another host.
+type HTTPSource struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPSource creates an HTTPSource that sends requests to the
+// ReplicationHandler served at the URL base using client. Pass a nil client to
+// use http.DefaultClient.
+func NewHTTPSource(base string, client *http.Client) *HTTPSource {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPSource{base: strings.TrimSuffix(base, "/"), client: client}
+}
+
+// Changes requests up to limit changes with sequence numbers greater than
+// after. Pass a limit less than one for the default of the handler. The handler
+// serves no more than 1000 changes at a time. Returns ErrTrimmed if the source
+// has trimmed the changes after after.
+func (src *HTTPSource) Changes(after uint64, limit int) ([]Change, error) {
+	q := url.Values{"after": {strconv.FormatUint(after, 10)}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	resp, err := src.get("/changes", q)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	changes := []Change{}
+	if err := json.NewDecoder(resp.Body).Decode(&changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// Fetch requests the value and metadata of the record for key in the table.
+// Returns os.ErrNotExist if it does not exist.
+func (src *HTTPSource) Fetch(table, key string) ([]byte, *Meta, error) {
+	resp, err := src.get("/records", url.Values{"table": {table}, "key": {key}})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	val, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var meta *Meta
+	if data := resp.Header.Get(metaHeader); data != "" {
+		meta = &Meta{}
+		if err := json.Unmarshal([]byte(data), meta); err != nil {
+			return nil, nil, err
+		}
+	}
+	return val, meta, nil
+}
+
+// get sends a GET request for path with the query q. Returns os.ErrNotExist
+// for a 404 response for a record that doesn't exist, ErrTrimmed for a 410
+// response, and an error for any other response but 200 OK.
+func (src *HTTPSource) get(path string, q url.Values) (*http.Response, error) {
+	u := src.base + path + "?" + q.Encode()
+	resp, err := src.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && resp.Header.Get(missingHeader) != "" {
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode == http.StatusGone {
+		return nil, ErrTrimmed
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return nil, fmt.Errorf("flockd: GET %v: %v: %v", u, resp.Status, strings.TrimSpace(string(msg)))
+}
@@ -0,0 +1,181 @@
+package flockd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (s *TS) TestReplicationHandler() {
+	src, err := New(s.dir, time.Second, WithChangeLog())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	tbl, err := src.Table(filepath.Join("a", "b"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true, Compression: "gzip"}), "Should configure table")
+	s.Nil(tbl.SetWithMeta("foo", []byte("foo"), &Meta{ContentType: "text/plain"}), "Should set foo")
+	s.Nil(src.Set("bar", []byte("bar")), "Should set bar")
+
+	srv := httptest.NewServer(http.StripPrefix("/repl", ReplicationHandler(src)))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"GET", "/repl/changes?after=1", 200, `[{"seq":2,"table":"","key":"bar","op":"set","time":`},
+		{"GET", "/repl/changes?after=2", 200, "[]"},
+		{"GET", "/repl/changes?after=x", 400, "invalid after"},
+		{"GET", "/repl/changes?limit=-1", 400, "invalid limit"},
+		{"POST", "/repl/changes", 405, "Method Not Allowed"},
+		{"GET", "/repl/records?key=bar", 200, "bar"},
+		{"GET", "/repl/records?table=a/b&key=foo", 200, "foo"},
+		{"GET", "/repl/records?table=a/b&key=nope", 404, ""},
+		{"GET", "/repl/records?table=../x&key=foo", 400, ""},
+		{"GET", "/repl/nope", 404, ""},
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		if err != nil {
+			s.T().Fatal("NewRequest", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.T().Fatal("Do", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.Nil(err, "Should read body for %v %v", tc.method, tc.path)
+		s.Equal(tc.status, resp.StatusCode, "Should have status for %v %v", tc.method, tc.path)
+		s.True(strings.HasPrefix(string(body), tc.body), "Should have body for %v %v: %s", tc.method, tc.path, body)
+	}
+
+	// Metadata should be in a header, without the storage fields.
+	resp, err := http.Get(srv.URL + "/repl/records?table=a/b&key=foo")
+	if err != nil {
+		s.T().Fatal("Get", err)
+	}
+	resp.Body.Close()
+	meta := &Meta{}
+	s.Nil(json.Unmarshal([]byte(resp.Header.Get(metaHeader)), meta), "Should decode meta header")
+	s.Equal("text/plain", meta.ContentType, "Should have content type")
+	s.Empty(meta.Encoding, "Should have no encoding")
+	s.Empty(meta.Checksum, "Should have no checksum")
+
+	// Pages of changes are limited.
+	for i := 0; i < maxChangesLimit+10; i++ {
+		s.Nil(src.Set("bar", []byte("bar")), "Should set bar")
+	}
+	hsrc := NewHTTPSource(srv.URL+"/repl", nil)
+	for _, tc := range []struct {
+		limit int
+		want  int
+	}{
+		{0, defaultChangesLimit},
+		{10, 10},
+		{maxChangesLimit + 1, maxChangesLimit},
+	} {
+		changes, err := hsrc.Changes(0, tc.limit)
+		s.Nil(err, "Should have no error from Changes with limit %v", tc.limit)
+		s.Len(changes, tc.want, "Should limit changes with limit %v", tc.limit)
+	}
+
+	// Changes without a change log.
+	noLog := httptest.NewServer(ReplicationHandler(s.db))
+	defer noLog.Close()
+	_, err = NewHTTPSource(noLog.URL, nil).Changes(0, 0)
+	s.NotNil(err, "Should have error without change log")
+	s.Contains(err.Error(), "404 Not Found", "Should have status in error")
+}
+
+func (s *TS) TestHTTPReplication() {
+	src, err := New(s.dir, time.Second, WithChangeLog())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/repl", ReplicationHandler(src)))
+	defer srv.Close()
+
+	destDir, err := ioutil.TempDir("", "replica")
+	if err != nil {
+		s.T().Fatal("TempDir", err)
+	}
+	defer os.RemoveAll(destDir)
+	dest, err := New(destDir, time.Second)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+
+	tbl, err := src.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should configure envelopes")
+	meta := &Meta{Headers: map[string]string{"a": "b"}}
+	s.Nil(tbl.SetWithMeta("foo", []byte("foo"), meta), "Should set foo")
+	s.Nil(src.Set("bar", []byte("bar")), "Should set bar")
+	s.Nil(src.Set("gone", []byte("gone")), "Should set gone")
+
+	httpSrc := NewHTTPSource(srv.URL+"/repl/", nil)
+	r, err := NewReplicator(httpSrc, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	n, err := r.Sync()
+	s.Nil(err, "Should have no error from Sync")
+	s.Equal(3, n, "Should apply three changes")
+
+	destTbl, err := dest.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, got, err := destTbl.GetWithMeta("foo")
+	s.Nil(err, "Should get foo from replica")
+	s.Equal("foo", string(val), "Should have replicated foo")
+	s.NotNil(got, "Should have replicated meta")
+	s.Equal(meta.Headers, got.Headers, "Should have replicated headers")
+	val, err = dest.Get("gone")
+	s.Nil(err, "Should get gone from replica")
+	s.Equal("gone", string(val), "Should have replicated gone")
+
+	// Deletes should replicate, and a new replicator should resume.
+	s.Nil(src.Delete("gone"), "Should delete gone")
+	s.Nil(src.Set("bar", []byte("new")), "Should set bar")
+	r, err = NewReplicator(httpSrc, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	n, err = r.Sync()
+	s.Nil(err, "Should have no error from Sync")
+	s.Equal(2, n, "Should apply two changes")
+	_, err = dest.Get("gone")
+	s.Equal(os.ErrNotExist, err, "Should have replicated delete")
+	val, err = dest.Get("bar")
+	s.Nil(err, "Should get bar from replica")
+	s.Equal("new", string(val), "Should have replicated new bar")
+
+	// A bad URL should fail rather than delete records.
+	s.Nil(src.Set("bar", []byte("newer")), "Should set bar")
+	r, err = NewReplicator(NewHTTPSource(srv.URL, nil), dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	_, err = r.Sync()
+	s.NotNil(err, "Should have error for bad URL")
+	val, err = dest.Get("bar")
+	s.Nil(err, "Should still have bar in replica")
+	s.Equal("new", string(val), "Should not have changed bar")
+	s.Equal(uint64(5), r.Position(), "Should not advance position")
+
+	// Trimmed changes should be reported.
+	s.Nil(src.Set("bar", []byte("newest")), "Should set bar")
+	_, err = src.TrimChanges(100)
+	s.Nil(err, "Should have no error from TrimChanges")
+	r, err = NewReplicator(httpSrc, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	_, err = r.Sync()
+	s.Equal(ErrTrimmed, err, "Should have ErrTrimmed from Sync")
+}
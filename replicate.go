@@ -0,0 +1,179 @@
+package flockd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// replicaFile is the name of the file in the root directory of a replica in
+// which a Replicator stores its position in the change log of its source.
+const replicaFile = ".flockd.replica"
+
+// replicaBatch is the number of changes a Replicator requests from its source
+// at a time.
+const replicaBatch = 100
+
+// ChangeSource defines the interface for the source of changes applied by a
+// Replicator. DB implements ChangeSource for a database with the change log
+// enabled.
+type ChangeSource interface {
+	// Changes returns up to limit changes with sequence numbers greater than
+	// after, in order.
+	Changes(after uint64, limit int) ([]Change, error)
+
+	// Fetch returns the current value and metadata of the record for key in
+	// the table, or os.ErrNotExist if it does not exist.
+	Fetch(table, key string) ([]byte, *Meta, error)
+}
+
+// replicaInfo is the content of the replica position file.
+type replicaInfo struct {
+	Seq     uint64    `json:"seq"`
+	Updated time.Time `json:"updated"`
+}
+
+// Replicator applies the changes from a ChangeSource to a database. Rather than
+// replaying each change, it copies the current state of each record named in
+// the change log from the source, so that the replica converges on the state
+// of the source even if the source has changed since the change was logged.
+// Replicator writes to the replica with the same locked writes as Set and
+// Delete, preserving the metadata of enveloped records, and compresses and
+// encrypts records as configured for the tables of the replica. It stores its
+// position in the change log in the replica, so that a new Replicator resumes
+// where the last one left off. Only one Replicator should write to a replica at
+// a time.
+type Replicator struct {
+	src  ChangeSource
+	dest *DB
+	seq  uint64
+}
+
+// NewReplicator creates a Replicator that applies changes from src to dest,
+// starting after the position stored in dest by a previous Replicator, if any.
+func NewReplicator(src ChangeSource, dest *DB) (*Replicator, error) {
+	if dest.readOnly {
+		return nil, ErrReadOnly
+	}
+	r := &Replicator{src: src, dest: dest}
+	data, err := ioutil.ReadFile(r.path())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	var info replicaInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	r.seq = info.Seq
+	return r, nil
+}
+
+// path returns the path to the replica position file.
+func (r *Replicator) path() string {
+	return filepath.Join(r.dest.root.path, replicaFile)
+}
+
+// Position returns the sequence number of the last change applied.
+func (r *Replicator) Position() uint64 {
+	return r.seq
+}
+
+// Sync applies all changes from the source after the current position and
+// stores the new position after each batch of changes. Returns the number of
+// changes applied. If applying a change fails, Sync returns the error, and the
+// next call to Sync starts with the change that failed. Returns ErrTrimmed if
+// the source has trimmed changes the replica has not applied; load a Dump or
+// Snapshot of the source into the replica and call Reset to resume from it.
+func (r *Replicator) Sync() (int, error) {
+	n := 0
+	for {
+		changes, err := r.src.Changes(r.seq, replicaBatch)
+		if err != nil {
+			return n, err
+		}
+		if len(changes) == 0 {
+			return n, nil
+		}
+		for _, c := range changes {
+			if err := r.apply(c); err != nil {
+				if serr := r.save(); serr != nil {
+					return n, serr
+				}
+				return n, err
+			}
+			r.seq = c.Seq
+			n++
+		}
+		if err := r.save(); err != nil {
+			return n, err
+		}
+	}
+}
+
+// Reset sets the position to seq and stores it, so that the next Sync applies
+// the changes after seq. Use it after loading a Dump or Snapshot of the source
+// into the replica, passing a seq no greater than the sequence number of the
+// last change the source logged before the dump started. Applying a change
+// again is harmless, since Replicator copies the current state of the record.
+func (r *Replicator) Reset(seq uint64) error {
+	r.seq = seq
+	return r.save()
+}
+
+// Run calls Sync every interval until ctx is done, and returns the error from
+// the context. It also returns any error from Sync.
+func (r *Replicator) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.Sync(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// apply copies the current state of the record named by c from the source to
+// the replica.
+func (r *Replicator) apply(c Change) error {
+	table, err := r.dest.TableFromSlash(c.Table)
+	if err != nil {
+		return err
+	}
+	val, meta, err := r.src.Fetch(c.Table, c.Key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := table.Delete(c.Key); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		return err
+	}
+	_, err = table.load(&dumpRecord{c.Table, c.Key, val, meta}, LoadOverwrite)
+	return err
+}
+
+// save writes the current position to the replica position file.
+func (r *Replicator) save() error {
+	data, err := json.Marshal(replicaInfo{r.seq, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	tmp, err := writeTemp(r.dest.root.path, replicaFile, data, r.dest.root.timeout)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	return os.Rename(tmp.file, r.path())
+}
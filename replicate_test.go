@@ -0,0 +1,324 @@
+package flockd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (s *TS) TestChangeLog() {
+	// Not enabled by default.
+	_, err := s.db.Changes(0, 0)
+	s.Equal(ErrNoChangeLog, err, "Should have ErrNoChangeLog")
+	s.Nil(s.db.Set("foo", []byte("foo")), "Should set without change log")
+	s.fileNotExists(filepath.Join(s.dir, changeLogFile))
+
+	db, err := New(s.dir, time.Second, WithChangeLog())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	s.FileExists(filepath.Join(s.dir, changeLogFile), "Should create change log")
+	changes, err := db.Changes(0, 0)
+	s.Nil(err, "Should have no error from Changes")
+	s.Empty(changes, "Should have no changes")
+
+	// Log some changes.
+	tbl, err := db.Table(filepath.Join("a", "b"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(db.Set("foo", []byte("bar")), "Should set foo")
+	s.Nil(tbl.Create("x", []byte("1")), "Should create x")
+	s.Nil(tbl.Update("x", []byte("2")), "Should update x")
+	_, err = tbl.CompareAndSwap("x", []byte("2"), []byte("3"))
+	s.Nil(err, "Should swap x")
+	s.Nil(db.Delete("foo"), "Should delete foo")
+	s.Nil(db.Delete("foo"), "Should delete foo again")
+
+	// Another instance should append to the same log.
+	other, err := New(s.dir, time.Second)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	s.Nil(other.Set("baz", []byte("baz")), "Should set baz")
+
+	changes, err = db.Changes(0, 0)
+	s.Nil(err, "Should have no error from Changes")
+	exp := []Change{
+		{Seq: 1, Table: "", Key: "foo", Op: OpSet},
+		{Seq: 2, Table: "a/b", Key: "x", Op: OpSet},
+		{Seq: 3, Table: "a/b", Key: "x", Op: OpSet},
+		{Seq: 4, Table: "a/b", Key: "x", Op: OpSet},
+		{Seq: 5, Table: "", Key: "foo", Op: OpDelete},
+		{Seq: 6, Table: "", Key: "baz", Op: OpSet},
+	}
+	for i := range changes {
+		s.False(changes[i].Time.IsZero(), "Should have time for change %v", i)
+		changes[i].Time = time.Time{}
+	}
+	s.Equal(exp, changes, "Should have logged changes")
+
+	// Fetch a page.
+	changes, err = db.Changes(2, 2)
+	s.Nil(err, "Should have no error from Changes")
+	s.Len(changes, 2, "Should have two changes")
+	s.Equal(uint64(3), changes[0].Seq, "Should start after seq 2")
+	s.Equal(uint64(4), changes[1].Seq, "Should end at seq 4")
+
+	// An incomplete last line should be ignored.
+	fh, err := os.OpenFile(filepath.Join(s.dir, changeLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		s.T().Fatal("OpenFile", err)
+	}
+	fh.WriteString(`{"seq":7,"tab`)
+	fh.Close()
+	changes, err = db.Changes(5, 0)
+	s.Nil(err, "Should have no error from Changes")
+	s.Len(changes, 1, "Should skip incomplete line")
+
+	// The next change should replace the incomplete line.
+	s.Nil(db.Set("qux", []byte("4")), "Should set qux")
+	changes, err = db.Changes(5, 0)
+	s.Nil(err, "Should have no error from Changes")
+	if s.Len(changes, 2, "Should have change after incomplete line") {
+		s.Equal(uint64(7), changes[1].Seq, "Should continue sequence")
+		s.Equal("qux", changes[1].Key, "Should log qux")
+	}
+
+	// Trim the log.
+	n, err := db.TrimChanges(4)
+	s.Nil(err, "Should have no error from TrimChanges")
+	s.Equal(4, n, "Should trim four changes")
+	changes, err = db.Changes(4, 0)
+	s.Nil(err, "Should have no error from Changes")
+	if s.Len(changes, 3, "Should have three changes left") {
+		s.Equal(uint64(5), changes[0].Seq, "Should start after trimmed changes")
+	}
+	for _, after := range []uint64{0, 3} {
+		changes, err = db.Changes(after, 0)
+		s.Equal(ErrTrimmed, err, "Should have ErrTrimmed after %v", after)
+		s.Nil(changes, "Should have no changes after %v", after)
+	}
+	n, err = db.TrimChanges(100)
+	s.Nil(err, "Should have no error from TrimChanges")
+	s.Equal(2, n, "Should trim all but the last change")
+	s.Nil(db.Delete("qux"), "Should delete qux")
+	_, err = db.Changes(5, 0)
+	s.Equal(ErrTrimmed, err, "Should have ErrTrimmed after trimmed change")
+	changes, err = db.Changes(6, 0)
+	s.Nil(err, "Should have no error from Changes")
+	if s.Len(changes, 2, "Should have kept last change") {
+		s.Equal(uint64(7), changes[0].Seq, "Should keep last change")
+		s.Equal(uint64(8), changes[1].Seq, "Should continue sequence after trim")
+	}
+
+	// A write that cannot lock the log should fail without committing.
+	fh, unlock, err := db.openChangeLog(true)
+	if err != nil {
+		s.T().Fatal("openChangeLog", err)
+	}
+	quick, err := New(s.dir, 10*time.Millisecond)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	s.NotNil(quick.Set("locked", []byte("x")), "Should have error from Set with log locked")
+	s.NotNil(quick.Delete("baz"), "Should have error from Delete with log locked")
+	unlock()
+	fh.Close()
+	_, err = db.Get("locked")
+	s.True(os.IsNotExist(err), "Should not have committed locked")
+	_, err = db.Get("baz")
+	s.Nil(err, "Should not have deleted baz")
+	changes, err = db.Changes(8, 0)
+	s.Nil(err, "Should have no error from Changes")
+	s.Empty(changes, "Should have logged no changes")
+
+	// Fetch should read records without creating tables.
+	val, meta, err := db.Fetch("a/b", "x")
+	s.Nil(err, "Should have no error from Fetch")
+	s.Equal("3", string(val), "Should fetch value")
+	s.Nil(meta, "Should have no meta")
+	_, _, err = db.Fetch("", "foo")
+	s.True(os.IsNotExist(err), "Should have not exist error for deleted record")
+	_, _, err = db.Fetch("nope", "x")
+	s.True(os.IsNotExist(err), "Should have not exist error for missing table")
+	s.fileNotExists(filepath.Join(s.dir, "nope"+tblExt))
+
+	report, err := db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should not report change log")
+}
+
+func (s *TS) TestScanChanges() {
+	fh, err := ioutil.TempFile(s.dir, "changes")
+	if err != nil {
+		s.T().Fatal("TempFile", err)
+	}
+	defer fh.Close()
+	seq, end, err := lastSeq(fh)
+	s.Nil(err, "Should have no error from lastSeq")
+	s.Equal(uint64(0), seq, "Should have no last seq for empty log")
+	s.Equal(int64(0), end, "Should have no end for empty log")
+
+	// Write enough changes to span several chunks.
+	offsets := []int64{0}
+	for i := 1; i <= 500; i++ {
+		data, err := json.Marshal(Change{Seq: uint64(i), Key: strings.Repeat("k", i%50), Op: OpSet})
+		if err != nil {
+			s.T().Fatal("Marshal", err)
+		}
+		if _, err := fh.Write(append(data, '\n')); err != nil {
+			s.T().Fatal("Write", err)
+		}
+		offsets = append(offsets, offsets[i-1]+int64(len(data))+1)
+	}
+	fh.WriteString(`{"seq":501`)
+
+	seq, end, err = lastSeq(fh)
+	s.Nil(err, "Should have no error from lastSeq")
+	s.Equal(uint64(500), seq, "Should have last complete seq")
+	s.Equal(offsets[500], end, "Should have end of last complete line")
+	for _, after := range []int{0, 1, 37, 250, 499, 500, 600} {
+		exp := offsets[500]
+		if after < 500 {
+			exp = offsets[after]
+		}
+		pos, err := seekAfter(fh, uint64(after))
+		s.Nil(err, "Should have no error from seekAfter %v", after)
+		s.Equal(exp, pos, "Should find line after %v", after)
+	}
+}
+
+func (s *TS) TestReplicator() {
+	src, err := New(s.dir, time.Second, WithChangeLog())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	destDir, err := ioutil.TempDir("", "replica")
+	if err != nil {
+		s.T().Fatal("TempDir", err)
+	}
+	defer os.RemoveAll(destDir)
+	dest, err := New(destDir, time.Second)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+
+	tbl, err := src.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Envelope: true}), "Should configure envelopes")
+	meta := &Meta{Headers: map[string]string{"a": "b"}}
+	s.Nil(tbl.SetWithMeta("foo", []byte("foo"), meta), "Should set foo")
+	s.Nil(src.Set("bar", []byte("bar")), "Should set bar")
+	s.Nil(src.Set("gone", []byte("gone")), "Should set gone")
+	s.Nil(src.Delete("gone"), "Should delete gone")
+
+	// Deleting records the replica never had should not fail in trash mode.
+	s.Nil(dest.Configure(TableConfig{Trash: true}), "Should configure trash")
+	r, err := NewReplicator(src, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	s.Equal(uint64(0), r.Position(), "Should start at zero")
+	n, err := r.Sync()
+	s.Nil(err, "Should have no error from Sync")
+	s.Equal(4, n, "Should apply four changes")
+	s.Equal(uint64(4), r.Position(), "Should be at position 4")
+
+	val, err := dest.Get("bar")
+	s.Nil(err, "Should get bar from replica")
+	s.Equal("bar", string(val), "Should have replicated bar")
+	_, err = dest.Get("gone")
+	s.Equal(os.ErrNotExist, err, "Should not have gone in replica")
+	destTbl, err := dest.Table("env")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, got, err := destTbl.GetWithMeta("foo")
+	s.Nil(err, "Should get foo from replica")
+	s.Equal("foo", string(val), "Should have replicated foo")
+	s.NotNil(got, "Should have replicated meta")
+	s.Equal(meta.Headers, got.Headers, "Should have replicated headers")
+	_, srcMeta, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should get foo from source")
+	s.Equal(srcMeta.Modified, got.Modified, "Should preserve modified time")
+
+	// Nothing more to do.
+	n, err = r.Sync()
+	s.Nil(err, "Should have no error from Sync")
+	s.Equal(0, n, "Should apply no changes")
+
+	// A new replicator should resume from the stored position.
+	s.Nil(src.Set("bar", []byte("new")), "Should set bar")
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	r, err = NewReplicator(src, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	s.Equal(uint64(4), r.Position(), "Should resume at position 4")
+	n, err = r.Sync()
+	s.Nil(err, "Should have no error from Sync")
+	s.Equal(2, n, "Should apply two changes")
+	val, err = dest.Get("bar")
+	s.Nil(err, "Should get bar from replica")
+	s.Equal("new", string(val), "Should have replicated new bar")
+	_, err = destTbl.Get("foo")
+	s.Equal(os.ErrNotExist, err, "Should have replicated delete")
+
+	// Run should sync until canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.Run(ctx, 5*time.Millisecond) }()
+	s.Nil(src.Set("run", []byte("run")), "Should set run")
+	for i := 0; i < 100; i++ {
+		if _, err := dest.Get("run"); err == nil {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	val, err = dest.Get("run")
+	s.Nil(err, "Should get run from replica")
+	s.Equal("run", string(val), "Should replicate while running")
+	cancel()
+	s.True(errors.Is(<-done, context.Canceled), "Should return context error")
+
+	// Trimmed changes should require a reset.
+	s.Nil(src.Set("bar", []byte("trimmed")), "Should set bar")
+	s.Nil(src.Set("run", []byte("trimmed")), "Should set run")
+	changes, err := src.Changes(r.Position(), 0)
+	if err != nil {
+		s.T().Fatal("Changes", err)
+	}
+	last := changes[len(changes)-1].Seq
+	_, err = src.TrimChanges(last)
+	s.Nil(err, "Should have no error from TrimChanges")
+	pos := r.Position()
+	n, err = r.Sync()
+	s.Equal(ErrTrimmed, err, "Should have ErrTrimmed from Sync")
+	s.Equal(0, n, "Should apply no changes")
+	s.Equal(pos, r.Position(), "Should not advance position")
+	s.Nil(r.Reset(last-1), "Should reset position")
+	r, err = NewReplicator(src, dest)
+	s.Nil(err, "Should have no error from NewReplicator")
+	s.Equal(last-1, r.Position(), "Should resume at reset position")
+	n, err = r.Sync()
+	s.Nil(err, "Should have no error from Sync after Reset")
+	s.Equal(1, n, "Should apply one change")
+
+	// No change log.
+	r, err = NewReplicator(dest, src)
+	s.Nil(err, "Should have no error from NewReplicator")
+	_, err = r.Sync()
+	s.Equal(ErrNoChangeLog, err, "Should have ErrNoChangeLog")
+
+	// Read-only destination.
+	ro, err := New(destDir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	_, err = NewReplicator(src, ro)
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly")
+}
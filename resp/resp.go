@@ -0,0 +1,560 @@
+/*
+Package resp implements a server for the Redis serialization protocol (RESP)
+backed by a flockd database, so that redis-cli and existing Redis clients can
+read and write a flockd directory. It supports a small subset of Redis
+commands:
+
+	PING [message]
+	ECHO message
+	SELECT table
+	GET key
+	SET key value [NX | XX]
+	DEL key [key ...]
+	EXISTS key [key ...]
+	KEYS pattern
+	SCAN cursor [MATCH pattern] [COUNT count]
+	QUIT
+
+Commands operate on the root table until a connection sends SELECT with the
+name of a table, creating it if it doesn't exist; nested table names use
+forward slashes, as in "SELECT a/b". "SELECT 0" selects the root table again.
+SET with NX creates the key, like Table.Create, and SET with XX updates it,
+like Table.Update. Patterns use the syntax of path.Match.
+*/
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/iovation/flockd"
+)
+
+// DefaultMaxBulk is the default maximum length of a bulk string in a request.
+const DefaultMaxBulk = 4 << 20
+
+const (
+	// maxArgs is the maximum number of arguments in a request.
+	maxArgs = 1 << 20
+
+	// defaultScanCount is the number of keys SCAN returns when the request
+	// does not specify a count.
+	defaultScanCount = 10
+)
+
+// ErrServerClosed is returned by Serve after a call to Close.
+var ErrServerClosed = errors.New("resp: Server closed")
+
+// Server serves RESP requests for a flockd database.
+type Server struct {
+	// MaxBulk is the maximum length of a bulk string, such as a value, in a
+	// request. A connection that sends a longer one gets a protocol error and
+	// is closed. NewServer sets it to DefaultMaxBulk; change it before calling
+	// Serve or ServeConn.
+	MaxBulk int
+
+	db        *flockd.DB
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer creates a Server for db.
+func NewServer(db *flockd.DB) *Server {
+	return &Server{
+		MaxBulk:   DefaultMaxBulk,
+		db:        db,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections on ln and serves each in a new goroutine until
+// Accept fails or Close is called. It always returns a non-nil error; after
+// Close, it returns ErrServerClosed.
+func (srv *Server) Serve(ln net.Listener) error {
+	if !srv.track(ln, nil) {
+		return ErrServerClosed
+	}
+	defer srv.untrack(ln, nil)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// ServeConn serves requests on conn until the client disconnects or sends
+// QUIT, then closes conn.
+func (srv *Server) ServeConn(conn net.Conn) {
+	if !srv.track(nil, conn) {
+		conn.Close()
+		return
+	}
+	defer srv.untrack(nil, conn)
+	defer conn.Close()
+
+	c := &client{
+		db:      srv.db,
+		table:   srv.db.Root(),
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		maxBulk: srv.MaxBulk,
+	}
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				c.writeError("ERR Protocol error: " + perr.msg)
+				c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.exec(args)
+
+		// Flush once there are no more pipelined requests.
+		if quit || c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// Close closes all listeners passed to Serve and all active connections.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closed = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// track records a listener or connection. Returns false if the server is
+// closed.
+func (srv *Server) track(ln net.Listener, conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return false
+	}
+	if ln != nil {
+		srv.listeners[ln] = struct{}{}
+	}
+	if conn != nil {
+		srv.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+// untrack removes a listener or connection.
+func (srv *Server) untrack(ln net.Listener, conn net.Conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	delete(srv.listeners, ln)
+	delete(srv.conns, conn)
+}
+
+// isClosed returns true if Close has been called.
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+// protocolError indicates a malformed request.
+type protocolError struct {
+	msg string
+}
+
+func (e protocolError) Error() string {
+	return "resp: protocol error: " + e.msg
+}
+
+// client represents the state of a connection.
+type client struct {
+	db      *flockd.DB
+	table   *flockd.Table
+	r       *bufio.Reader
+	w       *bufio.Writer
+	maxBulk int
+}
+
+// readLine reads a line terminated by CRLF or LF and returns it without the
+// terminator.
+func (c *client) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// readCommand reads a request, either a RESP array of bulk strings or an
+// inline command, and returns its arguments.
+func (c *client) readCommand() ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		// Inline command.
+		args := [][]byte{}
+		for _, f := range strings.Fields(line) {
+			args = append(args, []byte(f))
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, protocolError{"invalid multibulk length"}
+	}
+	if n <= 0 {
+		// A null or empty array, which Redis ignores.
+		return nil, nil
+	}
+
+	// Append the arguments as they arrive rather than allocating for the
+	// claimed count up front.
+	args := [][]byte{}
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, protocolError{fmt.Sprintf("expected '$', got '%.1s'", line)}
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > c.maxBulk {
+			return nil, protocolError{"invalid bulk length"}
+		}
+
+		// Read the string as it arrives rather than allocating the claimed
+		// length up front, so that a client must send the bytes it claims.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, c.r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		bulk := buf.Bytes()
+		if bulk[size] != '\r' || bulk[size+1] != '\n' {
+			return nil, protocolError{"invalid bulk terminator"}
+		}
+		args = append(args, bulk[:size])
+	}
+	return args, nil
+}
+
+func (c *client) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *client) writeError(s string) {
+	c.w.WriteString("-" + s + "\r\n")
+}
+
+func (c *client) writeInt(n int) {
+	c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *client) writeBulk(b []byte) {
+	if b == nil {
+		c.w.WriteString("$-1\r\n")
+		return
+	}
+	c.w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	c.w.Write(b)
+	c.w.WriteString("\r\n")
+}
+
+func (c *client) writeArray(items []string) {
+	c.w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		c.writeBulk([]byte(item))
+	}
+}
+
+// writeErr writes the error reply for err.
+func (c *client) writeErr(err error) {
+	switch {
+	case errors.Is(err, os.ErrInvalid):
+		c.writeError("ERR invalid key or table name")
+	default:
+		c.writeError("ERR " + err.Error())
+	}
+}
+
+// exec executes the command in args and writes the reply. Returns true if the
+// connection should be closed.
+func (c *client) exec(args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+	if len(args) < cmd.min || (cmd.max > 0 && len(args) > cmd.max) {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	return cmd.run(c, args[1:])
+}
+
+// command defines a command and its arity, including the command name. A max
+// of zero means no maximum.
+type command struct {
+	min, max int
+	run      func(c *client, args [][]byte) bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":    {1, 2, (*client).ping},
+		"ECHO":    {2, 2, (*client).echo},
+		"QUIT":    {1, 1, (*client).quit},
+		"COMMAND": {1, 0, (*client).command},
+		"SELECT":  {2, 2, (*client).selectTable},
+		"GET":     {2, 2, (*client).get},
+		"SET":     {3, 4, (*client).set},
+		"DEL":     {2, 0, (*client).del},
+		"EXISTS":  {2, 0, (*client).exists},
+		"KEYS":    {2, 2, (*client).keys},
+		"SCAN":    {2, 6, (*client).scan},
+	}
+}
+
+func (c *client) ping(args [][]byte) bool {
+	if len(args) == 1 {
+		c.writeBulk(args[0])
+	} else {
+		c.writeSimple("PONG")
+	}
+	return false
+}
+
+func (c *client) echo(args [][]byte) bool {
+	c.writeBulk(args[0])
+	return false
+}
+
+func (c *client) quit([][]byte) bool {
+	c.writeSimple("OK")
+	return true
+}
+
+// command replies with an empty array, so that clients that query the command
+// table on startup, such as redis-cli, carry on.
+func (c *client) command([][]byte) bool {
+	c.writeArray([]string{})
+	return false
+}
+
+func (c *client) selectTable(args [][]byte) bool {
+	name := string(args[0])
+	if name == "0" || name == "" {
+		c.table = c.db.Root()
+		c.writeSimple("OK")
+		return false
+	}
+	table, err := c.db.TableFromSlash(name)
+	if err != nil {
+		c.writeErr(err)
+		return false
+	}
+	c.table = table
+	c.writeSimple("OK")
+	return false
+}
+
+func (c *client) get(args [][]byte) bool {
+	val, err := c.table.Get(string(args[0]))
+	switch {
+	case err == nil:
+		if val == nil {
+			val = []byte{}
+		}
+		c.writeBulk(val)
+	case os.IsNotExist(err):
+		c.writeBulk(nil)
+	default:
+		c.writeErr(err)
+	}
+	return false
+}
+
+func (c *client) set(args [][]byte) bool {
+	key, val := string(args[0]), args[1]
+	var err error
+	if len(args) == 3 {
+		switch strings.ToUpper(string(args[2])) {
+		case "NX":
+			err = c.table.Create(key, val)
+		case "XX":
+			err = c.table.Update(key, val)
+		default:
+			c.writeError("ERR syntax error")
+			return false
+		}
+	} else {
+		err = c.table.Set(key, val)
+	}
+	switch {
+	case err == nil:
+		c.writeSimple("OK")
+	case os.IsExist(err), os.IsNotExist(err):
+		// The NX or XX condition was not met.
+		c.writeBulk(nil)
+	default:
+		c.writeErr(err)
+	}
+	return false
+}
+
+func (c *client) del(args [][]byte) bool {
+	n := 0
+	for _, arg := range args {
+		key := string(arg)
+		if _, err := c.table.Get(key); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			c.writeErr(err)
+			return false
+		}
+		if err := c.table.Delete(key); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			c.writeErr(err)
+			return false
+		}
+		n++
+	}
+	c.writeInt(n)
+	return false
+}
+
+func (c *client) exists(args [][]byte) bool {
+	n := 0
+	for _, arg := range args {
+		if _, err := c.table.Get(string(arg)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			c.writeErr(err)
+			return false
+		}
+		n++
+	}
+	c.writeInt(n)
+	return false
+}
+
+// matchKeys returns the sorted keys in the current table that match pattern.
+func (c *client) matchKeys(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	keys, err := c.table.Keys()
+	if err != nil {
+		return nil, err
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			matched = append(matched, key)
+		}
+	}
+	return matched, nil
+}
+
+func (c *client) keys(args [][]byte) bool {
+	keys, err := c.matchKeys(string(args[0]))
+	if err != nil {
+		c.writeErr(err)
+		return false
+	}
+	c.writeArray(keys)
+	return false
+}
+
+// scan implements SCAN. The cursor is the position in the sorted list of
+// matching keys, so keys created or deleted during a scan may cause others to
+// be returned twice or not at all.
+func (c *client) scan(args [][]byte) bool {
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		c.writeError("ERR invalid cursor")
+		return false
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.writeError("ERR syntax error")
+			return false
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				c.writeError("ERR value is not an integer or out of range")
+				return false
+			}
+		default:
+			c.writeError("ERR syntax error")
+			return false
+		}
+	}
+
+	keys, err := c.matchKeys(pattern)
+	if err != nil {
+		c.writeErr(err)
+		return false
+	}
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	next := end
+	if end >= len(keys) {
+		end, next = len(keys), 0
+	}
+	c.w.WriteString("*2\r\n")
+	c.writeBulk([]byte(strconv.Itoa(next)))
+	c.writeArray(keys[cursor:end])
+	return false
+}
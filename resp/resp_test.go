@@ -0,0 +1,367 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iovation/flockd"
+	"github.com/stretchr/testify/assert"
+)
+
+// testClient is a minimal RESP client.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send writes a command as a RESP array of bulk strings without reading the
+// reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		c.t.Fatal("write", err)
+	}
+}
+
+// do sends a command and returns its reply.
+func (c *testClient) do(args ...string) interface{} {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+// reply reads a reply. Simple strings are returned as strings prefixed with
+// "+", errors as strings prefixed with "-", integers as ints, bulk strings as
+// strings, null bulk strings as nil, and arrays as []interface{}.
+func (c *testClient) reply() interface{} {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal("read", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-':
+		return line
+	case ':':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			c.t.Fatal("integer", err)
+		}
+		return n
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			c.t.Fatal("bulk length", err)
+		}
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal("bulk", err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			c.t.Fatal("array length", err)
+		}
+		items := []interface{}{}
+		for i := 0; i < n; i++ {
+			items = append(items, c.reply())
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+// setup creates a database in a temporary directory, starts a server for it on
+// a loopback listener, and returns the database and a connected client.
+func setup(t *testing.T) (*flockd.DB, *testClient) {
+	dir, err := ioutil.TempDir("", "flockd-resp")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := flockd.New(dir, time.Second)
+	if err != nil {
+		t.Fatal("New", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	srv := NewServer(db)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		assert.Equal(t, ErrServerClosed, <-done, "Serve should return ErrServerClosed")
+	})
+
+	return db, dial(t, ln.Addr().String())
+}
+
+// dial connects a new client to addr.
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestBasics(t *testing.T) {
+	_, c := setup(t)
+	assert.Equal(t, "+PONG", c.do("PING"), "Should PONG")
+	assert.Equal(t, "hi", c.do("ping", "hi"), "Should echo PING message")
+	assert.Equal(t, "hello", c.do("ECHO", "hello"), "Should ECHO")
+	assert.Equal(t, []interface{}{}, c.do("COMMAND"), "Should have empty COMMAND reply")
+	assert.Equal(t, "-ERR unknown command 'nope'", c.do("nope"), "Should reject unknown command")
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command", c.do("GET"), "Should check arity")
+
+	// Inline commands.
+	io.WriteString(c.conn, "PING\r\n")
+	assert.Equal(t, "+PONG", c.reply(), "Should PONG inline")
+	io.WriteString(c.conn, "SET foo bar\r\nGET foo\n")
+	assert.Equal(t, "+OK", c.reply(), "Should SET inline")
+	assert.Equal(t, "bar", c.reply(), "Should GET inline")
+
+	assert.Equal(t, "+OK", c.do("QUIT"), "Should QUIT")
+	_, err := c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on QUIT")
+}
+
+func TestProtocolError(t *testing.T) {
+	_, c := setup(t)
+	io.WriteString(c.conn, "*1\r\n+PING\r\n")
+	assert.Equal(t, "-ERR Protocol error: expected '$', got '+'", c.reply(), "Should have protocol error")
+	_, err := c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on protocol error")
+
+	// Reject bulk strings longer than MaxBulk before reading them.
+	c = dial(t, c.conn.RemoteAddr().String())
+	io.WriteString(c.conn, "*1\r\n$"+strconv.Itoa(DefaultMaxBulk+1)+"\r\n")
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length", c.reply(), "Should reject long bulk string")
+	_, err = c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on long bulk string")
+
+	// Ignore null and empty arrays.
+	c = dial(t, c.conn.RemoteAddr().String())
+	io.WriteString(c.conn, "*-1\r\n*0\r\n*-2147483648\r\n")
+	assert.Equal(t, "+PONG", c.do("PING"), "Should ignore negative and zero counts")
+
+	// Don't trust huge counts.
+	io.WriteString(c.conn, "*"+strconv.Itoa(maxArgs)+"\r\n+PING\r\n")
+	assert.Equal(t, "-ERR Protocol error: expected '$', got '+'", c.reply(), "Should read arguments of huge count")
+	c = dial(t, c.conn.RemoteAddr().String())
+	io.WriteString(c.conn, "*"+strconv.Itoa(maxArgs+1)+"\r\n")
+	assert.Equal(t, "-ERR Protocol error: invalid multibulk length", c.reply(), "Should reject count over maximum")
+	_, err = c.r.ReadByte()
+	assert.Equal(t, io.EOF, err, "Should close connection on count over maximum")
+}
+
+func TestGetSet(t *testing.T) {
+	db, c := setup(t)
+	assert.Nil(t, c.do("GET", "foo"), "Should have null for missing key")
+	assert.Equal(t, "+OK", c.do("SET", "foo", "bar"), "Should SET")
+	assert.Equal(t, "bar", c.do("GET", "foo"), "Should GET")
+	val, err := db.Get("foo")
+	assert.Nil(t, err, "Should get foo from DB")
+	assert.Equal(t, "bar", string(val), "Should have value in DB")
+	assert.Equal(t, "+OK", c.do("SET", "empty", ""), "Should SET empty value")
+	assert.Equal(t, "", c.do("GET", "empty"), "Should GET empty value")
+	assert.Equal(t, "+OK", c.do("SET", "bin", "bin\r\nary"), "Should SET binary value")
+	assert.Equal(t, "bin\r\nary", c.do("GET", "bin"), "Should GET binary value")
+
+	// NX creates.
+	assert.Nil(t, c.do("SET", "foo", "baz", "NX"), "Should not SET NX existing key")
+	assert.Equal(t, "bar", c.do("GET", "foo"), "Should keep value")
+	assert.Equal(t, "+OK", c.do("SET", "new", "one", "nx"), "Should SET NX new key")
+	assert.Equal(t, "one", c.do("GET", "new"), "Should GET new key")
+
+	// XX updates.
+	assert.Nil(t, c.do("SET", "missing", "x", "XX"), "Should not SET XX missing key")
+	assert.Nil(t, c.do("GET", "missing"), "Should not create key")
+	assert.Equal(t, "+OK", c.do("SET", "foo", "baz", "XX"), "Should SET XX existing key")
+	assert.Equal(t, "baz", c.do("GET", "foo"), "Should GET updated value")
+
+	assert.Equal(t, "-ERR syntax error", c.do("SET", "foo", "x", "EX"), "Should reject other options")
+	bad := "a" + string(os.PathSeparator) + "b"
+	assert.Equal(t, "-ERR invalid key or table name", c.do("SET", bad, "x"), "Should reject bad key")
+	assert.Equal(t, "-ERR invalid key or table name", c.do("GET", bad), "Should reject bad key")
+}
+
+func TestDelExists(t *testing.T) {
+	_, c := setup(t)
+	c.do("SET", "a", "1")
+	c.do("SET", "b", "2")
+	assert.Equal(t, 2, c.do("EXISTS", "a", "b", "c"), "Should count existing keys")
+	assert.Equal(t, 2, c.do("EXISTS", "a", "a"), "Should count repeated keys")
+	assert.Equal(t, 1, c.do("DEL", "a", "c"), "Should count deleted keys")
+	assert.Nil(t, c.do("GET", "a"), "Should have deleted a")
+	assert.Equal(t, 0, c.do("EXISTS", "a"), "Should not find deleted key")
+	assert.Equal(t, 1, c.do("DEL", "b", "b"), "Should delete repeated key once")
+	assert.Equal(t, 0, c.do("DEL", "b"), "Should count no deleted keys")
+}
+
+func TestKeysScan(t *testing.T) {
+	_, c := setup(t)
+	assert.Equal(t, []interface{}{}, c.do("KEYS", "*"), "Should have no keys")
+	for _, key := range []string{"user:3", "user:1", "item:1", "user:2", "item:2"} {
+		c.do("SET", key, key)
+	}
+	assert.Equal(
+		t,
+		[]interface{}{"item:1", "item:2", "user:1", "user:2", "user:3"},
+		c.do("KEYS", "*"),
+		"Should have all keys",
+	)
+	assert.Equal(t, []interface{}{"user:1", "user:2", "user:3"}, c.do("KEYS", "user:*"), "Should match keys")
+	assert.Equal(t, []interface{}{"item:2", "user:2"}, c.do("KEYS", "*:[2]"), "Should match class")
+	assert.Regexp(t, "^-ERR ", c.do("KEYS", "["), "Should reject bad pattern")
+
+	// Scan all keys in pages.
+	assert.Equal(
+		t,
+		[]interface{}{"2", []interface{}{"item:1", "item:2"}},
+		c.do("SCAN", "0", "COUNT", "2"),
+		"Should have first page",
+	)
+	assert.Equal(
+		t,
+		[]interface{}{"4", []interface{}{"user:1", "user:2"}},
+		c.do("SCAN", "2", "COUNT", "2"),
+		"Should have second page",
+	)
+	assert.Equal(
+		t,
+		[]interface{}{"0", []interface{}{"user:3"}},
+		c.do("SCAN", "4", "COUNT", "2"),
+		"Should have last page",
+	)
+	assert.Equal(
+		t,
+		[]interface{}{"0", []interface{}{"user:1", "user:2", "user:3"}},
+		c.do("SCAN", "0", "MATCH", "user:*"),
+		"Should match keys in one page",
+	)
+	assert.Equal(
+		t,
+		[]interface{}{"0", []interface{}{}},
+		c.do("SCAN", "99"),
+		"Should have empty page past the end",
+	)
+	assert.Equal(t, "-ERR invalid cursor", c.do("SCAN", "x"), "Should reject bad cursor")
+	assert.Equal(t, "-ERR syntax error", c.do("SCAN", "0", "MATCH"), "Should reject missing option value")
+	assert.Equal(t, "-ERR syntax error", c.do("SCAN", "0", "TYPE", "string"), "Should reject unknown option")
+	assert.Equal(
+		t,
+		"-ERR value is not an integer or out of range",
+		c.do("SCAN", "0", "COUNT", "0"),
+		"Should reject bad count",
+	)
+}
+
+func TestSelect(t *testing.T) {
+	db, c := setup(t)
+	c.do("SET", "foo", "root")
+	assert.Equal(t, "+OK", c.do("SELECT", "things"), "Should SELECT table")
+	assert.Nil(t, c.do("GET", "foo"), "Should not see root key")
+	assert.Equal(t, "+OK", c.do("SET", "foo", "thing"), "Should SET in table")
+	assert.Equal(t, []interface{}{"foo"}, c.do("KEYS", "*"), "Should list table keys")
+
+	tbl, err := db.Table("things")
+	if err != nil {
+		t.Fatal("Table", err)
+	}
+	val, err := tbl.Get("foo")
+	assert.Nil(t, err, "Should get foo from table")
+	assert.Equal(t, "thing", string(val), "Should have table value")
+
+	// Other connections start in the root table.
+	c2 := dial(t, c.conn.RemoteAddr().String())
+	assert.Equal(t, "root", c2.do("GET", "foo"), "Should GET root value on new connection")
+
+	// Nested tables.
+	assert.Equal(t, "+OK", c.do("SELECT", "a/b"), "Should SELECT nested table")
+	c.do("SET", "x", "y")
+	nested, err := db.Table(filepath.Join("a", "b"))
+	if err != nil {
+		t.Fatal("Table", err)
+	}
+	val, err = nested.Get("x")
+	assert.Nil(t, err, "Should get x from nested table")
+	assert.Equal(t, "y", string(val), "Should have nested value")
+
+	for _, name := range []string{".", "..", "../x", "/x", "a/../b", "a/"} {
+		assert.Equal(t, "-ERR invalid key or table name", c.do("SELECT", name), "Should reject %q", name)
+	}
+	assert.Equal(t, "y", c.do("GET", "x"), "Should keep table after bad SELECT")
+
+	assert.Equal(t, "+OK", c.do("SELECT", "0"), "Should SELECT root table")
+	assert.Equal(t, "root", c.do("GET", "foo"), "Should GET root value")
+}
+
+func TestPipeline(t *testing.T) {
+	_, c := setup(t)
+	const n = 100
+	for i := 0; i < n; i++ {
+		c.send("SET", "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		c.send("GET", "k"+strconv.Itoa(i))
+	}
+	for i := 0; i < n; i++ {
+		assert.Equal(t, "+OK", c.reply(), "Should SET k%d", i)
+	}
+	for i := 0; i < n; i++ {
+		assert.Equal(t, strconv.Itoa(i), c.reply(), "Should GET k%d", i)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flockd-resp")
+	if err != nil {
+		t.Fatal("TempDir", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := flockd.New(dir, time.Second)
+	if err != nil {
+		t.Fatal("New", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Listen", err)
+	}
+	srv := NewServer(db)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	c := dial(t, ln.Addr().String())
+	assert.Equal(t, "+PONG", c.do("PING"), "Should PONG")
+	assert.Nil(t, srv.Close(), "Should close")
+	assert.Equal(t, ErrServerClosed, <-done, "Serve should return ErrServerClosed")
+	_, err = c.r.ReadByte()
+	assert.NotNil(t, err, "Should close connection")
+	assert.Equal(t, ErrServerClosed, srv.Serve(ln), "Should not serve after Close")
+}
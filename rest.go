@@ -0,0 +1,363 @@
+package flockd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultPageSize is the number of keys RESTHandler lists when the
+	// request does not specify a limit.
+	defaultPageSize = 100
+
+	// maxPageSize is the maximum number of keys RESTHandler lists at once.
+	maxPageSize = 1000
+
+	// maxBodySize is the maximum size of the body of a PUT or POST request to
+	// RESTHandler.
+	maxBodySize = 32 << 20
+)
+
+// KeyPage is the JSON response of RESTHandler to a request for the keys in a
+// table.
+type KeyPage struct {
+	// Keys lists the keys in the page, sorted.
+	Keys []string `json:"keys"`
+
+	// Next is the value of the "after" parameter to request the next page, or
+	// empty if there are no more keys.
+	Next string `json:"next,omitempty"`
+}
+
+// RESTHandler returns an http.Handler that exposes the tables and records in
+// db over HTTP. Table names containing slashes must be escaped in the path,
+// e.g., "a%2Fb" for the table "a/b". It handles these requests:
+//
+//   - GET /tables responds with a JSON array of the names of the tables other
+//     than the root table, with forward slashes separating nested table names.
+//   - GET /tables/{table}/keys responds with a KeyPage listing up to "limit"
+//     keys, 100 by default and at most 1000, after the key in the "after"
+//     query parameter.
+//   - GET /tables/{table}/keys/{key} responds with the value for the key,
+//     with its ETag and Last-Modified headers.
+//   - PUT /tables/{table}/keys/{key} sets the value for the key to the request
+//     body, like Set, and responds with the new ETag.
+//   - POST /tables/{table}/keys/{key} creates the key with the request body as
+//     its value, like Create.
+//   - DELETE /tables/{table}/keys/{key} deletes the key, like Delete.
+//
+// The paths /keys and /keys/{key} address the root table. PUT and POST create
+// the table if it doesn't exist. They accept values of up to 32 MiB, and
+// respond with 413 Request Entity Too Large to longer request bodies.
+//
+// GET and HEAD honor the If-Match, If-None-Match, and If-Modified-Since headers,
+// responding with 304 Not Modified or 412 Precondition Failed as appropriate.
+// PUT and DELETE honor If-Match and If-None-Match by checking the ETag of the
+// record under the exclusive lock, so that no other write can intervene between
+// the check and the write, and respond with 412 Precondition Failed if the
+// check fails. Thus "If-None-Match: *" makes PUT act like Create and
+// "If-Match: *" like Update, while If-Match with the ETag from a GET prevents
+// lost updates.
+//
+// Errors map to HTTP status codes: 404 Not Found for os.ErrNotExist, 409
+// Conflict for os.ErrExist, 412 Precondition Failed for ErrPrecondition, 503
+// Service Unavailable for lock timeouts, 400 Bad Request for os.ErrInvalid, and
+// 403 Forbidden for ErrReadOnly. Use http.StripPrefix to serve it under a
+// prefix.
+func RESTHandler(db *DB) http.Handler {
+	return &restHandler{db}
+}
+
+// restHandler implements RESTHandler.
+type restHandler struct {
+	db *DB
+}
+
+// ServeHTTP routes the request to the handler for the path.
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs, err := pathSegments(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(segs) == 1 && segs[0] == "tables":
+		h.tables(w, r)
+	case len(segs) == 1 && segs[0] == "keys":
+		h.keys(w, r, "")
+	case len(segs) == 2 && segs[0] == "keys":
+		h.record(w, r, "", segs[1])
+	case len(segs) == 3 && segs[0] == "tables" && segs[2] == "keys":
+		h.keys(w, r, segs[1])
+	case len(segs) == 4 && segs[0] == "tables" && segs[2] == "keys":
+		h.record(w, r, segs[1], segs[3])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// pathSegments splits an escaped path into unescaped segments, ignoring
+// leading and trailing slashes.
+func pathSegments(path string) ([]string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}, nil
+	}
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		var err error
+		if segs[i], err = url.PathUnescape(seg); err != nil {
+			return nil, err
+		}
+	}
+	return segs, nil
+}
+
+// tables responds with the names of the tables.
+func (h *restHandler) tables(w http.ResponseWriter, r *http.Request) {
+	if !allowGet(w, r) {
+		return
+	}
+	tables, err := h.db.Tables()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	names := []string{}
+	for _, table := range tables {
+		if table.name != "" {
+			names = append(names, filepath.ToSlash(table.name))
+		}
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+// keys responds with a page of the keys in the table.
+func (h *restHandler) keys(w http.ResponseWriter, r *http.Request, name string) {
+	if !allowGet(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	limit, err := queryUint(q, "limit")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultPageSize
+	} else if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	table, err := h.db.findTable(name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	keys, err := table.Keys()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	after := q.Get("after")
+	i := sort.SearchStrings(keys, after)
+	if i < len(keys) && keys[i] == after {
+		i++
+	}
+	page := KeyPage{Keys: keys[i:]}
+	if uint64(len(page.Keys)) > limit {
+		page.Keys = page.Keys[:limit]
+		page.Next = page.Keys[limit-1]
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// record handles a request for the record for key in the table.
+func (h *restHandler) record(w http.ResponseWriter, r *http.Request, name, key string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		table, err := h.db.findTable(name)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		rec, err := table.GetRecord(key)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("ETag", rec.ETag)
+		w.Header().Set("Last-Modified", rec.Modified.UTC().Format(http.TimeFormat))
+		if status := readCondition(r, rec); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		ctype := "application/octet-stream"
+		if rec.Meta != nil && rec.Meta.ContentType != "" {
+			ctype = rec.Meta.ContentType
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Length", strconv.Itoa(len(rec.Value)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(rec.Value)
+		}
+	case http.MethodPut, http.MethodPost:
+		table, err := h.db.TableFromSlash(name)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		val, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			status := http.StatusBadRequest
+			if len(val) >= maxBodySize {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if err := table.Create(key, val); err != nil {
+				httpError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		tag, err := table.setIf(key, writeCondition(r), func() ([]byte, error) {
+			return table.encode(key, val, nil)
+		})
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("ETag", tag)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		check := writeCondition(r)
+		table, err := h.db.findTable(name)
+		switch {
+		case err == nil:
+			err = table.deleteIf(key, check)
+		case os.IsNotExist(err) && check != nil:
+			err = check(nil)
+		case os.IsNotExist(err):
+			// Nothing to delete.
+			err = nil
+		}
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, POST, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// readCondition evaluates the If-Match, If-None-Match, and If-Modified-Since
+// headers of a GET or HEAD request for rec. Returns http.StatusOK if the
+// request should proceed, or the status with which to respond.
+func readCondition(r *http.Request, rec *Record) int {
+	if tags := parseETags(r, "If-Match"); tags != nil && !tagIn(rec.ETag, tags) {
+		return http.StatusPreconditionFailed
+	}
+	if tags := parseETags(r, "If-None-Match"); tags != nil {
+		if tagIn(rec.ETag, tags) {
+			return http.StatusNotModified
+		}
+		return http.StatusOK
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" {
+		t, err := http.ParseTime(since)
+		if err == nil && !rec.Modified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return http.StatusOK
+}
+
+// writeCondition returns a checkFunc that evaluates the If-Match and
+// If-None-Match headers of a PUT or DELETE request under the exclusive lock, or
+// nil if the request has neither. "If-None-Match: *" makes PUT act like Create,
+// and "If-Match: *" like Update.
+func writeCondition(r *http.Request) checkFunc {
+	match := parseETags(r, "If-Match")
+	noneMatch := parseETags(r, "If-None-Match")
+	switch {
+	case match == nil && noneMatch == nil:
+		return nil
+	case noneMatch == nil:
+		return ifMatch(match)
+	case match == nil:
+		return ifNoneMatch(noneMatch)
+	}
+	return func(data []byte) error {
+		if err := ifMatch(match)(data); err != nil {
+			return err
+		}
+		return ifNoneMatch(noneMatch)(data)
+	}
+}
+
+// parseETags returns the list of entity tags in the request header name, or
+// nil if the request does not include the header.
+func parseETags(r *http.Request, name string) []string {
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return nil
+	}
+	tags := []string{}
+	for _, v := range values {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// writeJSON responds with status and v encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpError responds with the HTTP status appropriate for err.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, ErrNoChangeLog):
+		status = http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		status = http.StatusConflict
+	case errors.Is(err, ErrPrecondition):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", "1")
+	case errors.Is(err, os.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrTrimmed):
+		status = http.StatusGone
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,295 @@
+package flockd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// do sends a request to the handler and returns the response status, headers,
+// and body.
+func (s *TS) do(h http.Handler, method, path, body string, hdr ...string) (int, http.Header, string) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	res := rec.Result()
+	data, err := ioutil.ReadAll(res.Body)
+	s.Nil(err, "Should read body for %v %v", method, path)
+	return res.StatusCode, res.Header, string(data)
+}
+
+func (s *TS) TestRESTHandler() {
+	h := RESTHandler(s.db)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		hdr    []string
+		status int
+		resp   string
+	}{
+		{"GET", "/keys/foo", "", nil, 404, "file does not exist\n"},
+		{"POST", "/keys/foo", "hi", nil, 201, ""},
+		{"POST", "/keys/foo", "hi", nil, 409, "file already exists\n"},
+		{"GET", "/keys/foo", "", nil, 200, "hi"},
+		{"HEAD", "/keys/foo", "", nil, 200, ""},
+		{"PUT", "/keys/foo", "bye", nil, 204, ""},
+		{"GET", "/keys/foo", "", nil, 200, "bye"},
+		{"PUT", "/keys/bar", "x", []string{"If-Match", "*"}, 412, "flockd: precondition failed\n"},
+		{"PUT", "/keys/foo", "upd", []string{"If-Match", "*"}, 204, ""},
+		{"GET", "/keys/foo", "", nil, 200, "upd"},
+		{"PUT", "/tables/tbl/keys/a", "1", nil, 204, ""},
+		{"PUT", "/tables/a%2Fb/keys/deep", "2", nil, 204, ""},
+		{"GET", "/tables/a%2Fb/keys/deep", "", nil, 200, "2"},
+		{"GET", "/tables/nope/keys/a", "", nil, 404, "file does not exist\n"},
+		{"GET", "/tables/..%2Fx/keys/a", "", nil, 400, "invalid argument\n"},
+		{"PUT", "/keys/a%2Fb", "x", nil, 400, "invalid argument\n"},
+		{"PATCH", "/keys/foo", "", nil, 405, "Method Not Allowed\n"},
+		{"DELETE", "/keys/foo", "", nil, 204, ""},
+		{"DELETE", "/keys/foo", "", nil, 204, ""},
+		{"DELETE", "/tables/nope/keys/foo", "", nil, 204, ""},
+		{"GET", "/keys/foo", "", nil, 404, "file does not exist\n"},
+		{"GET", "/tables", "", nil, 200, `["a/b","tbl"]` + "\n"},
+		{"POST", "/tables", "", nil, 405, "Method Not Allowed\n"},
+		{"GET", "/nope", "", nil, 404, "404 page not found\n"},
+		{"GET", "/tables/tbl/keys/a/b", "", nil, 404, "404 page not found\n"},
+	} {
+		status, _, body := s.do(h, tc.method, tc.path, tc.body, tc.hdr...)
+		s.Equal(tc.status, status, "Should have status for %v %v", tc.method, tc.path)
+		s.Equal(tc.resp, body, "Should have body for %v %v", tc.method, tc.path)
+	}
+
+	// The table should have the values.
+	tbl, err := s.db.Table("tbl")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, err := tbl.Get("a")
+	s.Nil(err, "Should get a")
+	s.Equal("1", string(val), "Should have value from PUT")
+
+	// Content-Type should come from the metadata.
+	s.Nil(tbl.SetWithMeta("json", []byte("{}"), &Meta{ContentType: "application/json"}), "Should set json")
+	status, hdr, body := s.do(h, "GET", "/tables/tbl/keys/json", "")
+	s.Equal(200, status, "Should get json")
+	s.Equal("{}", body, "Should have json body")
+	s.Equal("application/json", hdr.Get("Content-Type"), "Should have content type")
+	_, hdr, _ = s.do(h, "GET", "/tables/tbl/keys/a", "")
+	s.Equal("application/octet-stream", hdr.Get("Content-Type"), "Should have default content type")
+
+	// Lock timeouts should be 503.
+	lock, err := lockFile(filepath.Join(tbl.path, "a"+recExt), true, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("lockFile", err)
+	}
+	status, hdr, _ = s.do(h, "GET", "/tables/tbl/keys/a", "")
+	s.Equal(503, status, "Should have 503 for lock timeout")
+	s.Equal("1", hdr.Get("Retry-After"), "Should have Retry-After")
+	status, _, _ = s.do(h, "PUT", "/tables/tbl/keys/a", "x")
+	s.Equal(503, status, "Should have 503 for lock timeout on PUT")
+	lock.Unlock()
+
+	// Read-only databases should be 403.
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	status, _, body = s.do(RESTHandler(ro), "PUT", "/tables/tbl/keys/a", "x")
+	s.Equal(403, status, "Should have 403 for read-only database")
+	s.Equal(ErrReadOnly.Error()+"\n", body, "Should have read-only error")
+
+	// Bodies over the limit should be 413.
+	status, _, _ = s.do(h, "PUT", "/keys/big", strings.Repeat("x", maxBodySize+1))
+	s.Equal(413, status, "Should have 413 for large body")
+	_, err = s.db.Get("big")
+	s.True(os.IsNotExist(err), "Should not set big")
+	status, _, _ = s.do(h, "PUT", "/keys/big", strings.Repeat("x", maxBodySize))
+	s.Equal(204, status, "Should set value at the limit")
+}
+
+func (s *TS) TestRESTKeys() {
+	h := RESTHandler(s.db)
+	tbl, err := s.db.Table("tbl")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	keys := []string{}
+	for i := 0; i < 250; i++ {
+		key := "k" + strconv.Itoa(1000+i)
+		keys = append(keys, key)
+		s.Nil(tbl.Set(key, []byte("x")), "Should set %v", key)
+	}
+
+	page := func(path string) KeyPage {
+		status, hdr, body := s.do(h, "GET", path, "")
+		s.Equal(200, status, "Should list keys for %v", path)
+		s.Equal("application/json", hdr.Get("Content-Type"), "Should have JSON for %v", path)
+		var page KeyPage
+		s.Nil(json.Unmarshal([]byte(body), &page), "Should decode page for %v", path)
+		return page
+	}
+
+	// Default page size.
+	p := page("/tables/tbl/keys")
+	s.Equal(keys[:100], p.Keys, "Should have first page")
+	s.Equal("k1099", p.Next, "Should have next cursor")
+	p = page("/tables/tbl/keys?after=" + p.Next)
+	s.Equal(keys[100:200], p.Keys, "Should have second page")
+	p = page("/tables/tbl/keys?after=" + p.Next)
+	s.Equal(keys[200:], p.Keys, "Should have last page")
+	s.Empty(p.Next, "Should have no next cursor")
+
+	// Custom limit and a cursor that's not a key.
+	p = page("/tables/tbl/keys?limit=3&after=k1100x")
+	s.Equal([]string{"k1101", "k1102", "k1103"}, p.Keys, "Should have limited page")
+	s.Equal("k1103", p.Next, "Should have next cursor")
+	p = page("/tables/tbl/keys?limit=5000")
+	s.Equal(keys, p.Keys, "Should cap limit")
+
+	// Root table, empty.
+	p = page("/keys")
+	s.Equal([]string{}, p.Keys, "Should have no root keys")
+	s.Empty(p.Next, "Should have no next cursor")
+
+	status, _, _ := s.do(h, "GET", "/tables/tbl/keys?limit=x", "")
+	s.Equal(400, status, "Should have 400 for invalid limit")
+	status, _, _ = s.do(h, "GET", "/tables/nope/keys", "")
+	s.Equal(404, status, "Should have 404 for missing table")
+	s.fileNotExists(filepath.Join(s.dir, "nope"+tblExt))
+}
+
+func (s *TS) TestRESTConditional() {
+	h := RESTHandler(s.db)
+
+	// If-None-Match: * acts like Create.
+	status, hdr, _ := s.do(h, "PUT", "/keys/foo", "one", "If-None-Match", "*")
+	s.Equal(204, status, "Should create with If-None-Match: *")
+	tag := hdr.Get("ETag")
+	s.NotEmpty(tag, "Should have ETag from PUT")
+	status, _, _ = s.do(h, "PUT", "/keys/foo", "two", "If-None-Match", "*")
+	s.Equal(412, status, "Should not create existing key with If-None-Match: *")
+
+	// GET returns the same ETag and a Last-Modified time.
+	status, hdr, body := s.do(h, "GET", "/keys/foo", "")
+	s.Equal(200, status, "Should get foo")
+	s.Equal("one", body, "Should have value")
+	s.Equal(tag, hdr.Get("ETag"), "Should have ETag from GET")
+	mod, err := http.ParseTime(hdr.Get("Last-Modified"))
+	s.Nil(err, "Should parse Last-Modified")
+
+	// Conditional GETs.
+	for _, tc := range []struct {
+		hdr    []string
+		status int
+	}{
+		{[]string{"If-None-Match", tag}, 304},
+		{[]string{"If-None-Match", `"nope", ` + tag}, 304},
+		{[]string{"If-None-Match", "W/" + tag}, 304},
+		{[]string{"If-None-Match", "*"}, 304},
+		{[]string{"If-None-Match", `"nope"`}, 200},
+		{[]string{"If-Match", tag}, 200},
+		{[]string{"If-Match", `"nope"`}, 412},
+		{[]string{"If-Modified-Since", mod.Format(http.TimeFormat)}, 304},
+		{[]string{"If-Modified-Since", mod.Add(-time.Second).Format(http.TimeFormat)}, 200},
+		{[]string{"If-Modified-Since", "garbage"}, 200},
+		{[]string{"If-None-Match", `"nope"`, "If-Modified-Since", mod.Format(http.TimeFormat)}, 200},
+	} {
+		status, hdr, _ := s.do(h, "GET", "/keys/foo", "", tc.hdr...)
+		s.Equal(tc.status, status, "Should have status for %v", tc.hdr)
+		s.Equal(tag, hdr.Get("ETag"), "Should have ETag for %v", tc.hdr)
+	}
+	status, _, body = s.do(h, "HEAD", "/keys/foo", "", "If-None-Match", tag)
+	s.Equal(304, status, "Should have 304 for HEAD")
+	s.Empty(body, "Should have no body")
+
+	// Conditional PUTs.
+	status, _, _ = s.do(h, "PUT", "/keys/foo", "two", "If-Match", `"nope"`)
+	s.Equal(412, status, "Should not set with mismatched If-Match")
+	status, _, _ = s.do(h, "PUT", "/keys/foo", "two", "If-None-Match", tag)
+	s.Equal(412, status, "Should not set with matching If-None-Match")
+	status, hdr, _ = s.do(h, "PUT", "/keys/foo", "two", "If-Match", tag)
+	s.Equal(204, status, "Should set with matching If-Match")
+	newTag := hdr.Get("ETag")
+	s.NotEqual(tag, newTag, "Should have new ETag")
+	status, _, _ = s.do(h, "PUT", "/keys/foo", "three", "If-Match", newTag, "If-None-Match", tag)
+	s.Equal(204, status, "Should set with both conditions")
+	_, hdr, _ = s.do(h, "GET", "/keys/foo", "")
+	newTag = hdr.Get("ETag")
+
+	// Conditional DELETEs.
+	status, _, _ = s.do(h, "DELETE", "/keys/foo", "", "If-Match", tag)
+	s.Equal(412, status, "Should not delete with old ETag")
+	status, _, _ = s.do(h, "DELETE", "/keys/foo", "", "If-Match", newTag)
+	s.Equal(204, status, "Should delete with current ETag")
+	status, _, _ = s.do(h, "DELETE", "/keys/foo", "", "If-Match", "*")
+	s.Equal(412, status, "Should not delete missing key with If-Match: *")
+	status, _, _ = s.do(h, "DELETE", "/tables/nope/keys/foo", "", "If-Match", "*")
+	s.Equal(412, status, "Should not delete missing table with If-Match: *")
+	status, _, _ = s.do(h, "DELETE", "/keys/foo", "", "If-None-Match", "*")
+	s.Equal(204, status, "Should delete missing key with If-None-Match: *")
+
+	// Failed checks should not leave empty files behind.
+	status, _, _ = s.do(h, "PUT", "/keys/bar", "x", "If-Match", "*")
+	s.Equal(412, status, "Should not update missing key")
+	s.fileNotExists(filepath.Join(s.dir, "bar"+recExt))
+}
+
+func (s *TS) TestRESTLostUpdate() {
+	srv := httptest.NewServer(RESTHandler(s.db))
+	defer srv.Close()
+	s.db.root.timeout = 5 * time.Second
+	url := srv.URL + "/keys/doc"
+	put := func(body, ifMatch string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+		if err != nil {
+			s.T().Fatal("NewRequest", err)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			s.T().Fatal("Do", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	get := func() (string, string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			s.T().Fatal("Get", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body), resp.Header.Get("ETag")
+	}
+
+	// Two clients read the same version.
+	s.Equal(204, put("v1", "").StatusCode, "Should put v1")
+	_, aliceTag := get()
+	_, bobTag := get()
+	s.Equal(aliceTag, bobTag, "Should read the same version")
+
+	// Alice writes first; Bob's write would lose her update.
+	resp := put("alice", aliceTag)
+	s.Equal(204, resp.StatusCode, "Should accept Alice's update")
+	s.Equal(412, put("bob", bobTag).StatusCode, "Should reject Bob's stale update")
+	body, tag := get()
+	s.Equal("alice", body, "Should keep Alice's update")
+	s.Equal(resp.Header.Get("ETag"), tag, "Should have ETag from Alice's PUT")
+
+	// Bob rereads and retries.
+	s.Equal(204, put("alice+bob", tag).StatusCode, "Should accept Bob's retry")
+	body, _ = get()
+	s.Equal("alice+bob", body, "Should have both updates")
+}
@@ -0,0 +1,125 @@
+package flockd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// semExt is the extension of the directory that holds the slot lock files of
+// a Semaphore.
+const semExt = ".sem"
+
+// Semaphore is a named counting semaphore shared by all processes using a
+// table directory, and by all Semaphores with the same name and table in a
+// process. It limits the number of concurrent holders to its number of slots,
+// each of which is a lock file in a directory in the ".locks" subdirectory of
+// the table directory. Each slot is a Mutex, so it records a Lease describing
+// its holder in a lease file next to the lock file, and the operating system
+// releases it if the holding process exits.
+//
+// All users of a semaphore must agree on its number of slots.
+type Semaphore struct {
+	slots []*Mutex
+	mu    sync.Mutex
+	held  []*Mutex
+}
+
+// Semaphore returns the Semaphore with the name and n slots in the root
+// directory. See Table.Semaphore for details.
+func (db *DB) Semaphore(name string, n int) (*Semaphore, error) {
+	return db.root.Semaphore(name, n)
+}
+
+// Semaphore returns the Semaphore with the name and n slots in the table. The
+// name must not contain a path separator character; if it does, or it is empty,
+// or n is less than one, os.ErrInvalid will be returned. Returns ErrReadOnly
+// for a read-only database.
+func (table *Table) Semaphore(name string, n int) (*Semaphore, error) {
+	if n < 1 {
+		return nil, os.ErrInvalid
+	}
+	dir, err := table.lockPath(name, semExt)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sem := &Semaphore{slots: make([]*Mutex, n)}
+	for i := range sem.slots {
+		sem.slots[i] = newMutex(table.db, filepath.Join(dir, strconv.Itoa(i)+lockExt))
+	}
+	return sem, nil
+}
+
+// Acquire acquires a slot, waiting until ctx is done for one to become free.
+// Returns the context error if it did not get a slot.
+func (sem *Semaphore) Acquire(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		ok, err := sem.TryAcquire()
+		if err != nil || ok {
+			return err
+		}
+		timer.Reset(lockRetryDelay)
+	}
+}
+
+// TryAcquire tries to acquire a slot without waiting, and returns true if it
+// succeeded.
+func (sem *Semaphore) TryAcquire() (bool, error) {
+	for _, slot := range sem.slots {
+		ok, err := slot.TryLock()
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			sem.mu.Lock()
+			sem.held = append(sem.held, slot)
+			sem.mu.Unlock()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Release releases a slot acquired by Acquire or TryAcquire. Returns
+// ErrNotLocked if the Semaphore holds no slots.
+func (sem *Semaphore) Release() error {
+	sem.mu.Lock()
+	n := len(sem.held)
+	if n == 0 {
+		sem.mu.Unlock()
+		return ErrNotLocked
+	}
+	slot := sem.held[n-1]
+	sem.held = sem.held[:n-1]
+	sem.mu.Unlock()
+	return slot.Unlock()
+}
+
+// Holders returns the leases of the processes holding slots, in slot order. A
+// process appears once for each slot it holds. See Mutex.Holder.
+func (sem *Semaphore) Holders() ([]Lease, error) {
+	leases := []Lease{}
+	for _, slot := range sem.slots {
+		lease, err := slot.Holder()
+		if err != nil {
+			return nil, err
+		}
+		if lease != nil {
+			leases = append(leases, *lease)
+		}
+	}
+	return leases, nil
+}
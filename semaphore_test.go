@@ -0,0 +1,174 @@
+package flockd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// semSlots is the number of slots in the Semaphore acquired by
+// TestMutexHelper.
+const semSlots = 2
+
+// semaphoreHelper acquires a slot of the Semaphore named by the environment for
+// TestMutexHelper, and exits after releasing it.
+func semaphoreHelper(db *DB) {
+	sem, err := db.Semaphore(os.Getenv(helperNameEnv), semSlots)
+	if err == nil {
+		err = sem.Acquire(context.Background())
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Println("locked")
+	io.Copy(ioutil.Discard, os.Stdin)
+	if err := sem.Release(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func (s *TS) TestSemaphoreName() {
+	for _, name := range []string{"", filepath.Join("a", "b")} {
+		_, err := s.db.Semaphore(name, 1)
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for %q", name)
+	}
+	for _, n := range []int{0, -1} {
+		_, err := s.db.Semaphore("jobs", n)
+		s.Equal(os.ErrInvalid, err, "Should have ErrInvalid for %v slots", n)
+	}
+
+	ro, err := New(s.dir, time.Second, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	_, err = ro.Semaphore("jobs", 1)
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from Semaphore")
+}
+
+func (s *TS) TestSemaphore() {
+	sem, err := s.db.Semaphore("jobs", 2)
+	if err != nil {
+		s.T().Fatal("Semaphore", err)
+	}
+	s.Equal(ErrNotLocked, sem.Release(), "Should have ErrNotLocked before acquiring")
+	holders, err := sem.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	s.Empty(holders, "Should have no holders")
+
+	// Fill the slots.
+	for i := 0; i < 2; i++ {
+		ok, err := sem.TryAcquire()
+		s.Nil(err, "Should have no error from TryAcquire")
+		s.True(ok, "Should acquire slot %v", i)
+	}
+	ok, err := sem.TryAcquire()
+	s.Nil(err, "Should have no error from TryAcquire")
+	s.False(ok, "Should not acquire third slot")
+	holders, err = sem.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	s.Len(holders, 2, "Should have two holders")
+	for _, lease := range holders {
+		s.Equal(os.Getpid(), lease.PID, "Should hold slot")
+	}
+	s.DirExists(filepath.Join(s.dir, locksDir, "jobs"+semExt), "Should have slot directory")
+	s.FileExists(
+		filepath.Join(s.dir, locksDir, "jobs"+semExt, "0"+lockExt+leaseExt),
+		"Should record slot lease in lease file",
+	)
+
+	// Another Semaphore with the same name shares the slots.
+	other, err := s.db.Semaphore("jobs", 2)
+	if err != nil {
+		s.T().Fatal("Semaphore", err)
+	}
+	ok, err = other.TryAcquire()
+	s.Nil(err, "Should have no error from TryAcquire")
+	s.False(ok, "Should not acquire slot from other Semaphore")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	s.Equal(context.DeadlineExceeded, other.Acquire(ctx), "Should time out acquiring")
+
+	// Release a slot for the waiting Semaphore.
+	done := make(chan error)
+	go func() { done <- other.Acquire(context.Background()) }()
+	s.Nil(sem.Release(), "Should release slot")
+	s.Nil(<-done, "Should acquire released slot")
+	holders, err = sem.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	s.Len(holders, 2, "Should still have two holders")
+
+	s.Nil(sem.Release(), "Should release second slot")
+	s.Equal(ErrNotLocked, sem.Release(), "Should have ErrNotLocked after releasing all slots")
+	s.Nil(other.Release(), "Should release other slot")
+	holders, err = other.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	s.Empty(holders, "Should have no holders after release")
+
+	// A table has its own semaphores.
+	tbl, err := s.db.Table("jobs")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	tsem, err := tbl.Semaphore("jobs", 1)
+	if err != nil {
+		s.T().Fatal("Semaphore", err)
+	}
+	s.Nil(other.Acquire(context.Background()), "Should acquire root slot")
+	ok, err = tsem.TryAcquire()
+	s.Nil(err, "Should have no error from TryAcquire")
+	s.True(ok, "Should acquire table slot")
+	s.DirExists(filepath.Join(tbl.path, locksDir, "jobs"+semExt), "Should have table slot directory")
+	s.Nil(tsem.Release(), "Should release table slot")
+	s.Nil(other.Release(), "Should release root slot")
+}
+
+func (s *TS) TestSemaphoreProcesses() {
+	sem, err := s.db.Semaphore("jobs", semSlots)
+	if err != nil {
+		s.T().Fatal("Semaphore", err)
+	}
+
+	// Two processes hold both slots.
+	child1 := s.startLocker("jobs", "acquire")
+	child2 := s.startLocker("jobs", "acquire")
+	ok, err := sem.TryAcquire()
+	s.Nil(err, "Should have no error from TryAcquire")
+	s.False(ok, "Should not acquire slot held by children")
+	holders, err := sem.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	pids := []int{}
+	for _, lease := range holders {
+		s.Equal("child", lease.WriterID, "Should have child writer ID")
+		pids = append(pids, lease.PID)
+	}
+	exp := []int{child1.cmd.Process.Pid, child2.cmd.Process.Pid}
+	sort.Ints(exp)
+	sort.Ints(pids)
+	s.Equal(exp, pids, "Should list child holders")
+
+	// A slot frees up when a child exits.
+	done := make(chan error)
+	go func() { done <- sem.Acquire(context.Background()) }()
+	s.Nil(child1.release(), "Child should exit cleanly")
+	s.Nil(<-done, "Should acquire slot after child releases it")
+	holders, err = sem.Holders()
+	s.Nil(err, "Should have no error from Holders")
+	pids = []int{}
+	for _, lease := range holders {
+		pids = append(pids, lease.PID)
+	}
+	sort.Ints(pids)
+	exp = []int{os.Getpid(), child2.cmd.Process.Pid}
+	sort.Ints(exp)
+	s.Equal(exp, pids, "Should list parent and remaining child")
+	s.Nil(sem.Release(), "Should release slot")
+	s.Nil(child2.release(), "Child should exit cleanly")
+}
@@ -0,0 +1,139 @@
+package flockd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	// dbLockFile is the name of the file in the root directory that writers
+	// lock with a shared lock and Snapshot locks with an exclusive lock.
+	dbLockFile = ".flockd.lock"
+
+	// snapshotFile is the name of the file in the root directory of a snapshot
+	// that marks it as a snapshot.
+	snapshotFile = ".flockd.snapshot"
+)
+
+// ErrReadOnly is returned when attempting to modify a read-only database.
+var ErrReadOnly = errors.New("flockd: read-only database")
+
+// WithReadOnly opens the database read-only. The database directory and the
+// directories for any tables must already exist, and all methods that would
+// modify the database return ErrReadOnly. Corrupt records are never moved to
+// quarantine, even with VerifyQuarantine. New opens snapshots created by
+// Snapshot read-only even without this option.
+func WithReadOnly() Option {
+	return func(db *DB) {
+		db.readOnly = true
+	}
+}
+
+// ReadOnly returns true if the database is read-only.
+func (db *DB) ReadOnly() bool {
+	return db.readOnly
+}
+
+// lockWrites acquires a shared lock on the database lock file, waiting up to
+// the timeout set for the database, so that Snapshot cannot run while a write
+// is in progress. Returns ErrReadOnly if the database is read-only. Writers
+// must call it before locking a key file.
+func (db *DB) lockWrites() (*flock.Flock, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	return lockFile(filepath.Join(db.root.path, dbLockFile), false, db.root.timeout)
+}
+
+// snapshotInfo is the content of the snapshot marker file.
+type snapshotInfo struct {
+	Source  string    `json:"source"`
+	Created time.Time `json:"created"`
+}
+
+// Snapshot creates a point-in-time copy of the database in the directory
+// dest, which must not exist. It acquires an exclusive lock on the database
+// lock file, waiting up to the timeout set for the database, which blocks all
+// writers until it finishes. It then creates the directory for every table in
+// dest, with the same layout as the database directory, and hard links every
+// record, raw record checksum, and table configuration file into it. Because
+// writes replace record files rather than modifying them, later writes to the
+// database do not affect the snapshot. The dest directory must be on the same
+// file system as the database. Other internal directories and temporary files
+// are not copied.
+//
+// Snapshot also creates a file marking dest as a snapshot, so that New opens it
+// read-only. Note that readers of the snapshot lock the same files as readers
+// and writers of the database, until those files are replaced.
+func (db *DB) Snapshot(dest string) error {
+	if !db.readOnly {
+		lock, err := lockFile(filepath.Join(db.root.path, dbLockFile), true, db.root.timeout)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	if err := os.Mkdir(dest, 0755); err != nil {
+		return err
+	}
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+
+	root := db.root.path
+	if err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		inTable := dir == root || filepath.Ext(dir) == tblExt
+
+		if info.IsDir() {
+			// Skip internal directories other than checksums, and the
+			// snapshot itself.
+			if (inTable && internalDirs[info.Name()] && info.Name() != sumsDir) ||
+				os.SameFile(info, destInfo) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dest, rel), 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		// Link records, table configurations, and checksums.
+		if inTable && (filepath.Ext(path) == recExt || info.Name() == cfgFile) ||
+			filepath.Base(dir) == sumsDir && filepath.Ext(path) == sumExt {
+			return os.Link(path, filepath.Join(dest, rel))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Mark it as a snapshot.
+	src, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snapshotInfo{src, time.Now().UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dest, snapshotFile), data, 0644)
+}
@@ -0,0 +1,154 @@
+package flockd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestSnapshot() {
+	s.False(s.db.ReadOnly(), "Should not be read-only")
+	s.Nil(s.db.Set("root", []byte("one")), "Should set root record")
+	tbl, err := s.db.Table("squish")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Compression: "gzip"}), "Should configure compression")
+	s.Nil(tbl.Set("gz", []byte("one")), "Should set compressed record")
+	nested, err := s.db.Table(filepath.Join("a", "b"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(nested.Set("deep", []byte("one")), "Should set nested record")
+
+	// Add some files that should not be copied.
+	if err := os.WriteFile(filepath.Join(s.dir, "root"+recExt+"1234"), []byte("tmp"), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	if err := os.MkdirAll(filepath.Join(tbl.path, quarantineDir), 0755); err != nil {
+		s.T().Fatal("MkdirAll", err)
+	}
+
+	dest := filepath.Join(s.dir, "snap")
+	s.Nil(s.db.Snapshot(dest), "Should have no error from Snapshot")
+	s.NotNil(s.db.Snapshot(dest), "Should have error for existing snapshot")
+	s.fileNotExists(filepath.Join(dest, "root"+recExt+"1234"))
+	s.fileNotExists(filepath.Join(dest, "squish"+tblExt, quarantineDir))
+	s.fileNotExists(filepath.Join(dest, "snap"))
+
+	// Change the database.
+	s.Nil(s.db.Set("root", []byte("two")), "Should update root record")
+	s.Nil(tbl.Set("gz", []byte("two")), "Should update compressed record")
+	s.Nil(nested.Delete("deep"), "Should delete nested record")
+	s.Nil(s.db.Set("new", []byte("two")), "Should add a record")
+
+	// The snapshot should be unchanged.
+	snap, err := New(dest, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	s.True(snap.ReadOnly(), "Snapshot should be read-only")
+	val, err := snap.Get("root")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("one", string(val), "Should have original root value")
+	_, err = snap.Get("new")
+	s.True(os.IsNotExist(err), "Should not have new record")
+	stbl, err := snap.Table("squish")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Equal(TableConfig{Compression: "gzip"}, stbl.Config(), "Should have table config")
+	val, err = stbl.Get("gz")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("one", string(val), "Should have original compressed value")
+	snested, err := snap.Table(filepath.Join("a", "b"))
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	val, err = snested.Get("deep")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("one", string(val), "Should have deleted value")
+
+	tables, err := snap.Tables()
+	s.Nil(err, "Should have no error from Tables")
+	s.Len(tables, 3, "Should have three tables")
+	report, err := snap.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems in snapshot")
+	report, err = s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Contains(kinds(report.Problems), TempFile, "Should have temp file in database")
+
+	// Snapshots of snapshots work.
+	s.Nil(snap.Snapshot(filepath.Join(s.dir, "snap2")), "Should snapshot a snapshot")
+}
+
+func (s *TS) TestReadOnly() {
+	s.Nil(s.db.Set("foo", []byte("bar")), "Should set foo")
+	db, err := New(s.dir, time.Millisecond, WithReadOnly())
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+	s.True(db.ReadOnly(), "Should be read-only")
+	val, err := db.Get("foo")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("bar", string(val), "Should get value")
+
+	s.Equal(ErrReadOnly, db.Set("foo", nil), "Should have ErrReadOnly from Set")
+	s.Equal(ErrReadOnly, db.SetWithMeta("foo", nil, nil), "Should have ErrReadOnly from SetWithMeta")
+	s.Equal(ErrReadOnly, db.Create("new", nil), "Should have ErrReadOnly from Create")
+	s.Equal(ErrReadOnly, db.Update("foo", nil), "Should have ErrReadOnly from Update")
+	s.Equal(ErrReadOnly, db.Delete("foo"), "Should have ErrReadOnly from Delete")
+	_, err = db.CompareAndSwap("foo", []byte("bar"), nil)
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from CompareAndSwap")
+	s.Equal(ErrReadOnly, db.Configure(TableConfig{}), "Should have ErrReadOnly from Configure")
+	_, err = db.Load(bytes.NewReader([]byte(`{"key":"x","value":""}`)), FormatJSONL, LoadOverwrite)
+	s.True(errors.Is(err, ErrReadOnly), "Should have ErrReadOnly from Load")
+	_, err = db.Check(CheckOptions{Repair: true})
+	s.Equal(ErrReadOnly, err, "Should have ErrReadOnly from Check with Repair")
+	s.fileNotExists(filepath.Join(s.dir, "new"+recExt))
+
+	// Tables must exist.
+	_, err = db.Table("nonesuch")
+	s.True(os.IsNotExist(err), "Should have not exist error for missing table")
+	s.fileNotExists(filepath.Join(s.dir, "nonesuch"+tblExt))
+	if err := os.WriteFile(filepath.Join(s.dir, "file"+tblExt), nil, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	_, err = db.Table("file")
+	s.NotNil(err, "Should have error for file named like a table")
+
+	// So must the database.
+	_, err = New(filepath.Join(s.dir, "nonesuch"), time.Millisecond, WithReadOnly())
+	s.True(os.IsNotExist(err), "Should have not exist error for missing database")
+}
+
+func (s *TS) TestSnapshotLock() {
+	lockPath := filepath.Join(s.dir, dbLockFile)
+
+	// A snapshot in progress should block writers.
+	lock, err := lockFile(lockPath, true, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("lockFile", err)
+	}
+	s.Equal(context.DeadlineExceeded, s.db.Set("foo", nil), "Should time out on Set")
+	s.Equal(context.DeadlineExceeded, s.db.Create("foo", nil), "Should time out on Create")
+	s.Equal(context.DeadlineExceeded, s.db.Delete("foo"), "Should time out on Delete")
+	lock.Unlock()
+	s.Nil(s.db.Set("foo", []byte("bar")), "Should set after unlock")
+
+	// A write in progress should block snapshots.
+	lock, err = lockFile(lockPath, false, time.Millisecond)
+	if err != nil {
+		s.T().Fatal("lockFile", err)
+	}
+	s.Equal(
+		context.DeadlineExceeded, s.db.Snapshot(filepath.Join(s.dir, "snap")),
+		"Should time out on Snapshot",
+	)
+	lock.Unlock()
+	s.Nil(s.db.Snapshot(filepath.Join(s.dir, "snap")), "Should snapshot after unlock")
+}
@@ -0,0 +1,165 @@
+package flockd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// isTombstone returns true if the record file at path contains a tombstone.
+func isTombstone(path string) (bool, error) {
+	meta, err := readMeta(path)
+	if err != nil {
+		if err == ErrCorrupt {
+			return false, nil
+		}
+		return false, err
+	}
+	return meta != nil && meta.Tombstone, nil
+}
+
+// tombstone replaces the record file for key with a tombstone. If meta is not
+// nil, the tombstone keeps it, as when propagating a delete from another
+// replica; otherwise it records the current time. The caller must hold an
+// exclusive lock on the record file.
+func (table *Table) tombstone(key string, meta *Meta) error {
+	if meta == nil {
+		now := time.Now().UTC()
+		meta = &Meta{Created: now, Modified: now, WriterID: table.db.writerID, Tombstone: true}
+	}
+	data, err := encodeEnvelope(meta, nil)
+	if err != nil {
+		return err
+	}
+	tmp, err := table.writeTemp(key, data)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	return table.commit(tmp, key, data)
+}
+
+// replaceTombstone writes the data returned by encode to the file for key, but
+// only if it contains a tombstone. It waits up to the timeout set for the
+// database for an exclusive lock, then checks the file again. Returns
+// os.ErrExist if the file does not contain a tombstone.
+func (table *Table) replaceTombstone(key string, encode func() ([]byte, error)) error {
+	// Don't wait for a lock on a record that's not a tombstone.
+	file := filepath.Join(table.path, key+recExt)
+	if tomb, err := isTombstone(file); err != nil || !tomb {
+		if err != nil {
+			return err
+		}
+		return os.ErrExist
+	}
+
+	// If locking created the file, another process removed the tombstone in
+	// the meantime, and the new file is ours to write.
+	lock, err := lockRecord(file, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if lock.created == nil {
+		if tomb, err := isTombstone(file); err != nil || !tomb {
+			if err != nil {
+				return err
+			}
+			return os.ErrExist
+		}
+	}
+
+	data, err := encode()
+	if err != nil {
+		return err
+	}
+	tmp, err := table.writeTemp(key, data)
+	if err != nil {
+		return err
+	}
+	defer tmp.Release()
+	return table.logChange(key, OpSet, func() error {
+		return table.commit(tmp, key, data)
+	})
+}
+
+// Compact removes tombstones older than the TombstoneGrace of their tables
+// from every table returned by Tables. See Table.Compact for details. Returns
+// the total number of tombstones removed.
+func (db *DB) Compact() (int, error) {
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, table := range tables {
+		n, err := table.Compact()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Compact removes tombstones written longer ago than the table's
+// TombstoneGrace, so that deleted records no longer take up space. Remove a
+// tombstone only once the delete has propagated to all replicas; otherwise,
+// they might resurrect the record. For each tombstone, Compact acquires an
+// exclusive lock, waiting up to the timeout set for the database before
+// returning a context.DeadlineExceeded error, and checks the tombstone again
+// before removing it. Returns the number of tombstones removed.
+func (table *Table) Compact() (int, error) {
+	grace := table.Config().TombstoneGrace
+	n := 0
+	err := table.eachKey(func(key string) error {
+		file := filepath.Join(table.path, key+recExt)
+		if expired, err := tombstoneExpired(file, grace); err != nil || !expired {
+			return err
+		}
+		removed, err := table.removeTombstone(file, grace)
+		if removed {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
+
+// tombstoneExpired returns true if the record file at path contains a
+// tombstone written longer ago than grace.
+func tombstoneExpired(path string, grace time.Duration) (bool, error) {
+	meta, err := readMeta(path)
+	if err != nil {
+		if err == ErrCorrupt || os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return meta != nil && meta.Tombstone && time.Since(meta.Modified) >= grace, nil
+}
+
+// removeTombstone removes the record file at path under an exclusive lock if it
+// still contains an expired tombstone. Returns true if it removed the file.
+func (table *Table) removeTombstone(path string, grace time.Duration) (bool, error) {
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return false, err
+	}
+	defer dbLock.Unlock()
+
+	lock, err := lockRecord(path, table.timeout)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	if expired, err := tombstoneExpired(path, grace); err != nil || !expired {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
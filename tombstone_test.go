@@ -0,0 +1,127 @@
+package flockd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestTombstones() {
+	tbl, err := s.db.Table("tomb")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true}), "Should configure tombstones")
+	s.Nil(tbl.Set("foo", []byte("foo")), "Should set foo")
+	s.Nil(tbl.Set("bar", []byte("bar")), "Should set bar")
+	_, orig, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Nil(orig, "Should have raw record")
+
+	// Delete should leave a tombstone.
+	start := time.Now()
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	file := filepath.Join(tbl.path, "foo"+recExt)
+	meta, err := readMeta(file)
+	s.Nil(err, "Should have no error from readMeta")
+	s.True(meta.Tombstone, "Should have tombstone")
+	s.False(meta.Modified.Before(start.Truncate(time.Second)), "Should have deletion time")
+	s.Equal(s.db.writerID, meta.WriterID, "Should have writer ID")
+
+	// Which should be treated as nonexistent.
+	_, err = tbl.Get("foo")
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist from Get")
+	_, _, err = tbl.GetWithMeta("foo")
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist from GetWithMeta")
+	s.Equal(os.ErrNotExist, tbl.Update("foo", []byte("x")), "Should have ErrNotExist from Update")
+	_, err = tbl.CompareAndSwap("foo", nil, []byte("x"))
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist from CompareAndSwap")
+	keys := []string{}
+	s.Nil(tbl.ForEach(func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	}), "Should have no error from ForEach")
+	s.Equal([]string{"bar"}, keys, "Should skip tombstones in ForEach")
+
+	// Deleting again should leave the tombstone alone.
+	s.Nil(tbl.Delete("foo"), "Should delete foo again")
+	again, err := readMeta(file)
+	s.Nil(err, "Should have no error from readMeta")
+	s.Equal(meta, again, "Should have the same tombstone")
+
+	// Create should replace the tombstone.
+	s.Nil(tbl.Create("foo", []byte("new")), "Should create over tombstone")
+	val, got, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("new", string(val), "Should have created value")
+	s.Nil(got, "Should have raw record")
+	s.Equal(os.ErrExist, tbl.Create("foo", nil), "Should not create over record")
+
+	// Set should replace it, too, with a new created time.
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	time.Sleep(time.Millisecond)
+	s.Nil(tbl.SetWithMeta("foo", []byte("meta"), &Meta{}), "Should set over tombstone")
+	_, got, err = tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.True(got.Created.After(meta.Modified), "Should not keep tombstone created time")
+
+	// Tombstones should not trip up Check or Scrub.
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems")
+}
+
+func (s *TS) TestTombstoneModes() {
+	tbl, err := s.db.Table("modes")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true, Trash: true, HistoryKeep: 5}), "Should configure")
+	s.Nil(tbl.Set("foo", []byte("one")), "Should set foo")
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	s.Nil(tbl.Set("foo", []byte("two")), "Should set foo again")
+
+	// History should skip the tombstone.
+	vals, _ := s.historyValues(tbl, "foo")
+	s.Equal([]string{"one"}, vals, "Should not keep tombstone in history")
+
+	// Undelete should replace the tombstone.
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	entries, err := tbl.Trash()
+	s.Nil(err, "Should have no error from Trash")
+	s.Len(entries, 2, "Should have deleted records in trash")
+	s.Nil(tbl.Undelete("foo"), "Should undelete foo")
+	val, err := tbl.Get("foo")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("two", string(val), "Should have undeleted value")
+}
+
+func (s *TS) TestCompact() {
+	tbl, err := s.db.Table("compact")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Tombstones: true, TombstoneGrace: 50 * time.Millisecond}), "Should configure tombstones")
+	for _, key := range []string{"old", "new", "live"} {
+		s.Nil(tbl.Set(key, []byte(key)), "Should set %v", key)
+	}
+	s.Nil(tbl.Delete("old"), "Should delete old")
+	time.Sleep(60 * time.Millisecond)
+	s.Nil(tbl.Delete("new"), "Should delete new")
+
+	n, err := s.db.Compact()
+	s.Nil(err, "Should have no error from Compact")
+	s.Equal(1, n, "Should have removed one tombstone")
+	s.fileNotExists(filepath.Join(tbl.path, "old"+recExt))
+	s.FileExists(filepath.Join(tbl.path, "new"+recExt), "Should keep new tombstone")
+	val, err := tbl.Get("live")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("live", string(val), "Should keep live record")
+
+	time.Sleep(60 * time.Millisecond)
+	n, err = tbl.Compact()
+	s.Nil(err, "Should have no error from Compact")
+	s.Equal(1, n, "Should have removed one tombstone")
+	s.fileNotExists(filepath.Join(tbl.path, "new"+recExt))
+}
@@ -0,0 +1,171 @@
+package flockd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// trashDir is the name of the subdirectory of a table directory into which
+// Delete moves records in trash mode.
+const trashDir = ".trash"
+
+// TrashEntry describes a record in the trash.
+type TrashEntry struct {
+	// Key is the key of the deleted record.
+	Key string
+
+	// Deleted is the time the record was deleted.
+	Deleted time.Time
+
+	// Size is the size of the record file.
+	Size int64
+
+	// name is the name of the file in the trash.
+	name string
+}
+
+// trash moves the record file for key to the ".trash" subdirectory of the
+// table directory, appending the current time in nanoseconds to its name. The
+// caller must hold an exclusive lock on the record file.
+func (table *Table) trash(key string) error {
+	dir := filepath.Join(table.path, trashDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file := filepath.Join(table.path, key+recExt)
+	dest := filepath.Join(dir, fmt.Sprintf("%v%v.%d", key, recExt, time.Now().UnixNano()))
+	return os.Rename(file, dest)
+}
+
+// Trash returns the records in the trash of the table, newest first. Configure
+// a table for trash mode by setting TableConfig.Trash.
+func (table *Table) Trash() ([]TrashEntry, error) {
+	dh, err := os.Open(filepath.Join(table.path, trashDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []TrashEntry{}, nil
+		}
+		return nil, err
+	}
+	defer dh.Close()
+
+	entries := []TrashEntry{}
+	for err != io.EOF {
+		var files []os.FileInfo
+		files, err = dh.Readdir(readNum)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, info := range files {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			name := info.Name()
+			i := strings.LastIndexByte(name, '.')
+			if i < 0 || !strings.HasSuffix(name[:i], recExt) {
+				continue
+			}
+			nanos, perr := strconv.ParseInt(name[i+1:], 10, 64)
+			if perr != nil {
+				continue
+			}
+			entries = append(entries, TrashEntry{
+				Key:     strings.TrimSuffix(name[:i], recExt),
+				Deleted: time.Unix(0, nanos),
+				Size:    info.Size(),
+				name:    name,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Deleted.After(entries[j].Deleted) })
+	return entries, nil
+}
+
+// Undelete restores the most recently deleted record for key from the trash,
+// just like Create. The key must not contain a path separator character; if it
+// does, os.ErrInvalid will be returned. Returns os.ErrNotExist if the key is
+// not in the trash, and os.ErrExist if the record already exists.
+func (table *Table) Undelete(key string) error {
+	if strings.ContainsRune(key, os.PathSeparator) {
+		return os.ErrInvalid
+	}
+	entries, err := table.Trash()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Key != key {
+			continue
+		}
+		file := filepath.Join(table.path, trashDir, entry.name)
+		if err := table.create(key, func() ([]byte, error) {
+			return ioutil.ReadFile(file)
+		}); err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+// PurgeTrash permanently removes the records in the trash of every table
+// returned by Tables that have been in the trash longer than their tables'
+// TrashRetention. Returns the total number of records removed.
+func (db *DB) PurgeTrash() (int, error) {
+	tables, err := db.Tables()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, table := range tables {
+		n, err := table.PurgeTrash()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// PurgeTrash permanently removes the records that have been in the trash
+// longer than the table's TrashRetention, or all of them if TrashRetention is
+// zero. Returns the number of records removed.
+func (table *Table) PurgeTrash() (int, error) {
+	entries, err := table.Trash()
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return 0, err
+	}
+	defer dbLock.Unlock()
+
+	retention := table.Config().TrashRetention
+	n := 0
+	for _, entry := range entries {
+		if time.Since(entry.Deleted) < retention {
+			continue
+		}
+		err := os.Remove(filepath.Join(table.path, trashDir, entry.name))
+		if err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package flockd
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func (s *TS) TestTrash() {
+	// No trash by default.
+	s.Nil(s.db.Set("foo", []byte("one")), "Should set foo")
+	s.Nil(s.db.Delete("foo"), "Should delete foo")
+	s.fileNotExists(filepath.Join(s.dir, trashDir))
+	s.Equal(os.ErrNotExist, s.db.root.Undelete("foo"), "Should have nothing to undelete")
+
+	tbl, err := s.db.Table("trash")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Trash: true, Envelope: true}), "Should configure trash")
+	entries, err := tbl.Trash()
+	s.Nil(err, "Should have no error from Trash")
+	s.Empty(entries, "Should have empty trash")
+
+	start := time.Now()
+	s.Nil(tbl.SetWithMeta("foo", []byte("one"), &Meta{ContentType: "text/plain"}), "Should set one")
+	s.Nil(tbl.Delete("foo"), "Should delete one")
+	s.Nil(tbl.Set("foo", []byte("two")), "Should set two")
+	s.Nil(tbl.Delete("foo"), "Should delete two")
+	s.Nil(tbl.Set("bar", []byte("bar")), "Should set bar")
+	s.Nil(tbl.Delete("bar"), "Should delete bar")
+	s.Equal(os.ErrNotExist, tbl.Delete("bar"), "Should have ErrNotExist deleting bar again")
+	_, err = tbl.Get("foo")
+	s.True(os.IsNotExist(err), "Should have deleted foo")
+
+	entries, err = tbl.Trash()
+	s.Nil(err, "Should have no error from Trash")
+	s.Len(entries, 3, "Should have three records in the trash")
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+		s.False(e.Deleted.Before(start), "Should have deletion time")
+		s.True(e.Size > 0, "Should have size")
+	}
+	s.Equal([]string{"bar", "foo", "foo"}, keys, "Should list newest first")
+
+	// Undelete restores the newest.
+	s.Nil(tbl.Undelete("foo"), "Should undelete foo")
+	val, err := tbl.Get("foo")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("two", string(val), "Should have restored newest value")
+	s.Equal(os.ErrExist, tbl.Undelete("foo"), "Should not undelete existing record")
+	s.Nil(tbl.Delete("foo"), "Should delete foo")
+	s.Equal(os.ErrNotExist, tbl.Delete("foo"), "Should have ErrNotExist deleting nonexistent record")
+	s.Equal(os.ErrNotExist, tbl.Delete("nonesuch"), "Should have ErrNotExist for missing key")
+	entries, err = tbl.Trash()
+	s.Nil(err, "Should have no error from Trash")
+	s.Len(entries, 3, "Should have undeleted and deleted again")
+	s.Nil(tbl.Undelete("foo"), "Should undelete foo again")
+	val, meta, err := tbl.GetWithMeta("foo")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("two", string(val), "Should have restored value")
+	s.NotNil(meta, "Should have restored envelope")
+	s.Equal(os.ErrInvalid, tbl.Undelete("a/b"), "Should have ErrInvalid for invalid key")
+
+	// Trash should not trip up Check.
+	report, err := s.db.Check(CheckOptions{})
+	s.Nil(err, "Should have no error from Check")
+	s.Empty(report.Problems, "Should have no problems")
+}
+
+func (s *TS) TestPurgeTrash() {
+	tbl, err := s.db.Table("purge")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	s.Nil(tbl.Configure(TableConfig{Trash: true, TrashRetention: 50 * time.Millisecond}), "Should configure trash")
+	s.Nil(tbl.Set("old", []byte("old")), "Should set old")
+	s.Nil(tbl.Delete("old"), "Should delete old")
+	time.Sleep(60 * time.Millisecond)
+	s.Nil(tbl.Set("new", []byte("new")), "Should set new")
+	s.Nil(tbl.Delete("new"), "Should delete new")
+
+	n, err := s.db.PurgeTrash()
+	s.Nil(err, "Should have no error from PurgeTrash")
+	s.Equal(1, n, "Should have purged one record")
+	entries, err := tbl.Trash()
+	s.Nil(err, "Should have no error from Trash")
+	s.Len(entries, 1, "Should have one record in the trash")
+	s.Equal("new", entries[0].Key, "Should have kept new record")
+	s.Equal(os.ErrNotExist, tbl.Undelete("old"), "Should not undelete purged record")
+
+	// Zero retention empties the trash.
+	s.Nil(tbl.Configure(TableConfig{Trash: true}), "Should configure trash")
+	n, err = tbl.PurgeTrash()
+	s.Nil(err, "Should have no error from PurgeTrash")
+	s.Equal(1, n, "Should have purged one record")
+	n, err = tbl.PurgeTrash()
+	s.Nil(err, "Should have no error from PurgeTrash")
+	s.Equal(0, n, "Should have purged no records")
+}
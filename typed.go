@@ -0,0 +1,164 @@
+package flockd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+)
+
+// ValueCodec defines the interface for marshaling values of type T to and from
+// the bytes stored in a table. JSONCodec, GobCodec, and BytesCodec implement
+// it; implement it to use other formats, such as protobuf or msgpack.
+type ValueCodec[T any] interface {
+	// Marshal returns the encoding of v.
+	Marshal(v T) ([]byte, error)
+
+	// Unmarshal decodes data into v.
+	Unmarshal(data []byte, v *T) error
+}
+
+// JSONCodec marshals values as JSON.
+type JSONCodec[T any] struct{}
+
+// Marshal returns the JSON encoding of v.
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON in data into v.
+func (JSONCodec[T]) Unmarshal(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec marshals values with encoding/gob.
+type GobCodec[T any] struct{}
+
+// Marshal returns the gob encoding of v.
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the gob in data into v.
+func (GobCodec[T]) Unmarshal(data []byte, v *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BytesCodec stores byte slices as-is.
+type BytesCodec struct{}
+
+// Marshal returns v.
+func (BytesCodec) Marshal(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+// Unmarshal sets v to data.
+func (BytesCodec) Unmarshal(data []byte, v *[]byte) error {
+	*v = data
+	return nil
+}
+
+// TypedTable wraps a Table to get and set values of type T, using a ValueCodec
+// to marshal them to and from bytes. All of the locking semantics of Table
+// apply.
+type TypedTable[T any] struct {
+	table *Table
+	codec ValueCodec[T]
+}
+
+// NewTypedTable returns a TypedTable that uses codec to marshal values stored
+// in table.
+func NewTypedTable[T any](table *Table, codec ValueCodec[T]) *TypedTable[T] {
+	return &TypedTable[T]{table: table, codec: codec}
+}
+
+// Table returns the underlying Table.
+func (tt *TypedTable[T]) Table() *Table {
+	return tt.table
+}
+
+// Get returns the value for the key. See Table.Get for details.
+func (tt *TypedTable[T]) Get(key string) (T, error) {
+	var v T
+	data, err := tt.table.Get(key)
+	if err != nil {
+		return v, err
+	}
+	err = tt.codec.Unmarshal(data, &v)
+	return v, err
+}
+
+// Set sets the value for the key. See Table.Set for details.
+func (tt *TypedTable[T]) Set(key string, v T) error {
+	data, err := tt.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tt.table.Set(key, data)
+}
+
+// Create creates the key/value pair, but only if the key does not already
+// exist. See Table.Create for details.
+func (tt *TypedTable[T]) Create(key string, v T) error {
+	data, err := tt.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tt.table.Create(key, data)
+}
+
+// Update updates the value for the key, but only if the key already exists.
+// See Table.Update for details.
+func (tt *TypedTable[T]) Update(key string, v T) error {
+	data, err := tt.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tt.table.Update(key, data)
+}
+
+// Delete deletes the key and its value. See Table.Delete for details.
+func (tt *TypedTable[T]) Delete(key string) error {
+	return tt.table.Delete(key)
+}
+
+// ForEach executes a function for each key/value pair in the table. An error
+// unmarshaling a value halts the iteration. See Table.ForEach for details.
+func (tt *TypedTable[T]) ForEach(feFunc func(key string, v T) error) error {
+	return tt.table.ForEach(func(key string, data []byte) error {
+		var v T
+		if err := tt.codec.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		return feFunc(key, v)
+	})
+}
+
+// CompareAndSwap sets the value for the key to new, but only if its current
+// value is deeply equal to old, as determined by reflect.DeepEqual after
+// unmarshaling the current value. Returns true if it set the value. See
+// Table.CompareAndSwap for details.
+func (tt *TypedTable[T]) CompareAndSwap(key string, old, new T) (bool, error) {
+	data, err := tt.codec.Marshal(new)
+	if err != nil {
+		return false, err
+	}
+
+	swapped := false
+	err = tt.table.modify(key, func(val []byte, meta *Meta) ([]byte, *Meta, error) {
+		var cur T
+		if err := tt.codec.Unmarshal(val, &cur); err != nil {
+			return nil, nil, err
+		}
+		if !reflect.DeepEqual(cur, old) {
+			return nil, nil, errNoChange
+		}
+		swapped = true
+		return data, meta, nil
+	})
+	return swapped, err
+}
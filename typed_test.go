@@ -0,0 +1,144 @@
+package flockd
+
+import (
+	"errors"
+	"os"
+)
+
+type typedPerson struct {
+	Name string
+	Age  int
+	Tags []string
+}
+
+// failCodec fails to unmarshal anything, for testing error handling.
+type failCodec struct {
+	JSONCodec[int]
+}
+
+var errFailCodec = errors.New("cannot unmarshal")
+
+func (failCodec) Unmarshal(data []byte, v *int) error {
+	return errFailCodec
+}
+
+func (s *TS) TestTypedTable() {
+	for name, codec := range map[string]ValueCodec[typedPerson]{
+		"json": JSONCodec[typedPerson]{},
+		"gob":  GobCodec[typedPerson]{},
+	} {
+		tbl, err := s.db.Table("typed_" + name)
+		if err != nil {
+			s.T().Fatal("Table", err)
+		}
+		tt := NewTypedTable[typedPerson](tbl, codec)
+		s.Equal(tbl, tt.Table(), "Should have the table for %v", name)
+
+		theory := typedPerson{Name: "Theory", Age: 42, Tags: []string{"perl"}}
+		got, err := tt.Get("theory")
+		s.Equal(typedPerson{}, got, "Should have zero value for %v", name)
+		s.True(os.IsNotExist(err), "Should have not exist error for %v", name)
+
+		// Create, Update, and Set.
+		s.Nil(tt.Create("theory", theory), "Should create for %v", name)
+		s.Equal(os.ErrExist, tt.Create("theory", theory), "Should not create twice for %v", name)
+		s.Equal(os.ErrNotExist, tt.Update("julie", theory), "Should not update nonexistent for %v", name)
+		theory.Age++
+		s.Nil(tt.Update("theory", theory), "Should update for %v", name)
+		julie := typedPerson{Name: "Julie", Age: 39}
+		s.Nil(tt.Set("julie", julie), "Should set for %v", name)
+
+		got, err = tt.Get("theory")
+		s.Nil(err, "Should have no error from Get for %v", name)
+		s.Equal(theory, got, "Should have the value for %v", name)
+
+		// ForEach.
+		all := map[string]typedPerson{}
+		s.Nil(tt.ForEach(func(key string, v typedPerson) error {
+			all[key] = v
+			return nil
+		}), "Should have no error from ForEach for %v", name)
+		s.Equal(map[string]typedPerson{"theory": theory, "julie": julie}, all)
+
+		// CompareAndSwap.
+		older := theory
+		older.Age++
+		ok, err := tt.CompareAndSwap("theory", julie, older)
+		s.Nil(err, "Should have no error from failed CompareAndSwap for %v", name)
+		s.False(ok, "Should not have swapped for %v", name)
+		ok, err = tt.CompareAndSwap("theory", theory, older)
+		s.Nil(err, "Should have no error from CompareAndSwap for %v", name)
+		s.True(ok, "Should have swapped for %v", name)
+		got, err = tt.Get("theory")
+		s.Nil(err, "Should have no error from Get for %v", name)
+		s.Equal(older, got, "Should have swapped value for %v", name)
+		ok, err = tt.CompareAndSwap("nobody", julie, older)
+		s.False(ok, "Should not have swapped nonexistent for %v", name)
+		s.Equal(os.ErrNotExist, err, "Should have ErrNotExist for %v", name)
+
+		// Delete.
+		s.Nil(tt.Delete("julie"), "Should delete for %v", name)
+		_, err = tt.Get("julie")
+		s.True(os.IsNotExist(err), "Should have deleted for %v", name)
+	}
+}
+
+func (s *TS) TestTypedBytes() {
+	tt := NewTypedTable[[]byte](s.db.root, BytesCodec{})
+	s.Nil(tt.Set("raw", []byte("hello")), "Should set bytes")
+	got, err := s.db.Get("raw")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("hello", string(got), "Should have stored bytes as-is")
+	ok, err := tt.CompareAndSwap("raw", []byte("hello"), []byte("goodbye"))
+	s.Nil(err, "Should have no error from CompareAndSwap")
+	s.True(ok, "Should have swapped")
+	val, err := tt.Get("raw")
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("goodbye", string(val), "Should have swapped bytes")
+}
+
+func (s *TS) TestTypedErrors() {
+	s.Nil(s.db.Set("bad", []byte("not json")), "Should set invalid JSON")
+	tt := NewTypedTable[int](s.db.root, JSONCodec[int]{})
+	_, err := tt.Get("bad")
+	s.NotNil(err, "Should have unmarshal error from Get")
+	ok, err := tt.CompareAndSwap("bad", 1, 2)
+	s.False(ok, "Should not have swapped")
+	s.NotNil(err, "Should have unmarshal error from CompareAndSwap")
+
+	s.Nil(s.db.Delete("bad"), "Should delete")
+	ft := NewTypedTable[int](s.db.root, failCodec{})
+	s.Nil(ft.Set("one", 1), "Should set with failing codec")
+	s.Equal(errFailCodec, ft.ForEach(func(key string, v int) error {
+		return nil
+	}), "Should have codec error from ForEach")
+
+	// Marshal errors.
+	ct := NewTypedTable[chan int](s.db.root, JSONCodec[chan int]{})
+	s.NotNil(ct.Set("chan", make(chan int)), "Should have marshal error from Set")
+	s.NotNil(ct.Create("chan", make(chan int)), "Should have marshal error from Create")
+	s.NotNil(ct.Update("chan", make(chan int)), "Should have marshal error from Update")
+	_, err = ct.CompareAndSwap("chan", nil, make(chan int))
+	s.NotNil(err, "Should have marshal error from CompareAndSwap")
+}
+
+func (s *TS) TestCompareAndSwap() {
+	ok, err := s.db.CompareAndSwap("cas", nil, []byte("x"))
+	s.False(ok, "Should not swap nonexistent key")
+	s.Equal(os.ErrNotExist, err, "Should have ErrNotExist")
+	ok, err = s.db.CompareAndSwap("a/b", nil, []byte("x"))
+	s.False(ok, "Should not swap invalid key")
+	s.Equal(os.ErrInvalid, err, "Should have ErrInvalid")
+
+	s.Nil(s.db.SetWithMeta("cas", []byte("one"), &Meta{ContentType: "text/plain"}), "Should set")
+	ok, err = s.db.CompareAndSwap("cas", []byte("two"), []byte("three"))
+	s.Nil(err, "Should have no error from CompareAndSwap")
+	s.False(ok, "Should not have swapped mismatched value")
+	ok, err = s.db.CompareAndSwap("cas", []byte("one"), []byte("two"))
+	s.Nil(err, "Should have no error from CompareAndSwap")
+	s.True(ok, "Should have swapped")
+	got, meta, err := s.db.GetWithMeta("cas")
+	s.Nil(err, "Should have no error from GetWithMeta")
+	s.Equal("two", string(got), "Should have new value")
+	s.Equal("text/plain", meta.ContentType, "Should preserve metadata")
+}
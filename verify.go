@@ -0,0 +1,336 @@
+package flockd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// quarantineDir is the name of the subdirectory of a table directory into
+	// which corrupt records are moved.
+	quarantineDir = ".quarantine"
+
+	// sumsDir is the name of the subdirectory of a table directory that holds
+	// the checksums of raw records.
+	sumsDir = ".sums"
+
+	// sumExt is the extension of the checksum files in the sums directory.
+	sumExt = ".sum"
+)
+
+// ErrChecksum is returned when the payload of a record does not match its
+// checksum.
+var ErrChecksum = errors.New("flockd: checksum mismatch")
+
+// VerifyPolicy defines how Get and ForEach handle records that fail
+// verification, either because the envelope cannot be decoded or because the
+// payload does not match its checksum. Records written in the envelope format
+// carry their checksums in the envelope. For raw records, writes store the
+// checksum in a file in the ".sums" subdirectory of the table directory, along
+// with the size and modification time of the record file. The checksum applies
+// only while the record file keeps that size and modification time, so that a
+// record replaced by some other program, such as a file synchronization tool,
+// is merely unverified rather than corrupt.
+type VerifyPolicy int
+
+const (
+	// VerifyReject causes Get to return ErrCorrupt or ErrChecksum for a record
+	// that fails verification. This is the default.
+	VerifyReject VerifyPolicy = iota
+
+	// VerifyIgnore causes Get to skip checksum verification. Get still returns
+	// ErrCorrupt for an envelope that cannot be decoded.
+	VerifyIgnore
+
+	// VerifyQuarantine works like VerifyReject, but also moves the corrupt
+	// record file to the ".quarantine" subdirectory of the table directory.
+	VerifyQuarantine
+)
+
+// WithVerifyPolicy sets the policy for handling records that fail
+// verification. Defaults to VerifyReject.
+func WithVerifyPolicy(policy VerifyPolicy) Option {
+	return func(db *DB) {
+		db.verify = policy
+	}
+}
+
+// isCorrupt returns true if err indicates a record failed verification.
+func isCorrupt(err error) bool {
+	return err == ErrCorrupt || err == ErrChecksum
+}
+
+// verifyChecksum returns ErrChecksum if payload does not match the checksum in
+// meta. Checksums for unknown algorithms are not verified.
+func verifyChecksum(meta *Meta, payload []byte) error {
+	if meta == nil || !strings.HasPrefix(meta.Checksum, sumPrefix) {
+		return nil
+	}
+	if checksum(payload) != meta.Checksum {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// rawSum is the checksum of a raw record, stored in the sums directory, along
+// with the size and modification time of the record file it describes.
+type rawSum struct {
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// verify returns true if sum applies to the record file described by info,
+// and ErrChecksum if it applies but does not match data. Returns false for a
+// nil sum.
+func (sum *rawSum) verify(data []byte, info os.FileInfo) (bool, error) {
+	if sum == nil || sum.Size != info.Size() || !sum.Modified.Equal(info.ModTime()) {
+		return false, nil
+	}
+	if checksum(data) != sum.Checksum {
+		return true, ErrChecksum
+	}
+	return true, nil
+}
+
+// sumPath returns the path to the checksum file for key.
+func (table *Table) sumPath(key string) string {
+	return filepath.Join(table.path, sumsDir, key+sumExt)
+}
+
+// readSum reads the checksum file at path. Returns nil if the file does not
+// exist or cannot be decoded, leaving the record unverified.
+func readSum(path string) (*rawSum, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sum := &rawSum{}
+	if err := json.Unmarshal(data, sum); err != nil {
+		return nil, nil
+	}
+	return sum, nil
+}
+
+// commit moves the temporary file holding data into place as the record file
+// for key. For a raw record, it first records the checksum of data in the sums
+// directory, along with the size and modification time of the temporary file,
+// which the move preserves; for an envelope, which carries its own checksum, it
+// removes any checksum file. Nothing is written after the move, so that a
+// writer that locks the new file as soon as it is in place never has its
+// checksum overwritten by this one. If the move fails, commit removes the new
+// checksum. The caller must hold the exclusive lock on the record file.
+func (table *Table) commit(tmp *tmpFile, key string, data []byte) error {
+	path := table.sumPath(key)
+	file := filepath.Join(table.path, key+recExt)
+	if hasEnvelope(data) {
+		if err := removeFile(path); err != nil {
+			return err
+		}
+		return os.Rename(tmp.file, file)
+	}
+
+	info, err := os.Stat(tmp.file)
+	if err != nil {
+		return err
+	}
+	sum, err := json.Marshal(&rawSum{
+		Checksum: checksum(data),
+		Size:     info.Size(),
+		Modified: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	stmp, err := writeTemp(dir, key+sumExt, sum, table.timeout)
+	if err != nil {
+		return err
+	}
+	defer stmp.Release()
+	if err := os.Rename(stmp.file, path); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.file, file); err != nil {
+		removeFile(path)
+		return err
+	}
+	return nil
+}
+
+// check reads and verifies the record file for key, regardless of the database
+// verify policy. Returns false if the record has no checksum to verify.
+func (table *Table) check(key string) (bool, error) {
+	data, info, sum, err := table.readRecord(key)
+	if err != nil {
+		return false, err
+	}
+	val, meta, err := decodeEnvelope(data)
+	if err != nil {
+		return true, err
+	}
+	if meta == nil {
+		return sum.verify(data, info)
+	}
+	return true, verifyChecksum(meta, val)
+}
+
+// quarantine moves the record file for key to the ".quarantine" subdirectory of
+// the table directory, appending the current time in nanoseconds to its name.
+// It first acquires an exclusive lock on the file, waiting up to the timeout
+// set for the database, and verifies the record again, so that a record
+// rewritten in the meantime is left in place. Returns true if the file was
+// moved.
+func (table *Table) quarantine(key string) (bool, error) {
+	// Leave it alone in a read-only database.
+	if table.db.readOnly {
+		return false, nil
+	}
+	dbLock, err := table.db.lockWrites()
+	if err != nil {
+		return false, err
+	}
+	defer dbLock.Unlock()
+
+	file := filepath.Join(table.path, key+recExt)
+	lock, err := lockRecord(file, table.timeout)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	// Make sure it's still corrupt.
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	val, meta, err := decodeEnvelope(data)
+	if err == nil && meta == nil {
+		var info os.FileInfo
+		var sum *rawSum
+		if info, err = os.Stat(file); err != nil {
+			return false, err
+		}
+		if sum, err = readSum(table.sumPath(key)); err != nil {
+			return false, err
+		}
+		_, err = sum.verify(data, info)
+	} else if err == nil {
+		err = verifyChecksum(meta, val)
+	}
+	if !isCorrupt(err) {
+		return false, nil
+	}
+
+	// Move it.
+	dir := filepath.Join(table.path, quarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+	dest := filepath.Join(dir, fmt.Sprintf("%v%v.%d", key, recExt, time.Now().UnixNano()))
+	if err := os.Rename(file, dest); err != nil {
+		return false, err
+	}
+	return true, removeFile(table.sumPath(key))
+}
+
+// ScrubReport describes the results of DB.Scrub.
+type ScrubReport struct {
+	// Tables is the number of tables scrubbed.
+	Tables int
+
+	// Records is the number of records scrubbed.
+	Records int
+
+	// Unverified is the number of raw records with no checksum, or whose
+	// checksum no longer applies because some other program replaced the
+	// record file.
+	Unverified int
+
+	// Corrupt lists the records that failed verification.
+	Corrupt []CorruptRecord
+}
+
+// CorruptRecord describes a record that failed verification.
+type CorruptRecord struct {
+	// Table is the name of the table containing the record.
+	Table string
+
+	// Key is the record key.
+	Key string
+
+	// Err is ErrCorrupt or ErrChecksum.
+	Err error
+
+	// Quarantined is true if the record was moved to quarantine.
+	Quarantined bool
+}
+
+// Scrub verifies every record in every table returned by Tables. It reads each
+// record under a shared lock, just like Get, and verifies its envelope and
+// checksum regardless of the verify policy. If the verify policy is
+// VerifyQuarantine, Scrub moves corrupt records to quarantine. Corrupt records
+// are listed in the report; any other error, or the cancellation of ctx, halts
+// the scrub and returns the error along with the report so far.
+func (db *DB) Scrub(ctx context.Context) (*ScrubReport, error) {
+	report := &ScrubReport{}
+	tables, err := db.Tables()
+	if err != nil {
+		return report, err
+	}
+
+	for _, table := range tables {
+		report.Tables++
+		if err := table.scrub(ctx, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// scrub verifies every record in the table, adding the results to report.
+func (table *Table) scrub(ctx context.Context, report *ScrubReport) error {
+	return table.eachKey(func(key string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		verified, err := table.check(key)
+		if err == os.ErrNotExist {
+			// Deleted since we read the directory.
+			return nil
+		}
+		report.Records++
+		if !verified {
+			report.Unverified++
+		}
+		if err == nil {
+			return nil
+		}
+		if !isCorrupt(err) {
+			return err
+		}
+
+		rec := CorruptRecord{Table: table.name, Key: key, Err: err}
+		if table.db.verify == VerifyQuarantine {
+			if rec.Quarantined, err = table.quarantine(key); err != nil {
+				return err
+			}
+		}
+		report.Corrupt = append(report.Corrupt, rec)
+		return nil
+	})
+}
@@ -0,0 +1,208 @@
+package flockd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// corrupt flips the last byte of the record file for key in tbl, preserving
+// its modification time.
+func (s *TS) corrupt(tbl *Table, key string) {
+	path := filepath.Join(tbl.path, key+recExt)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		s.T().Fatal("ReadFile", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		s.T().Fatal("Stat", err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	// Keep the modification time, as bit rot would.
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		s.T().Fatal("Chtimes", err)
+	}
+}
+
+func (s *TS) TestVerifyPolicy() {
+	key := "rotten"
+	val := []byte("hello")
+	for _, spec := range []struct {
+		name   string
+		policy VerifyPolicy
+		err    error
+		val    []byte
+		moved  bool
+	}{
+		{"reject", VerifyReject, ErrChecksum, nil, false},
+		{"ignore", VerifyIgnore, nil, []byte("hell\x90"), false},
+		{"quarantine", VerifyQuarantine, ErrChecksum, nil, true},
+	} {
+		db, err := New(s.dir, time.Millisecond, WithVerifyPolicy(spec.policy))
+		if err != nil {
+			s.T().Fatal("New", err)
+		}
+		tbl, err := db.Table(spec.name)
+		if err != nil {
+			s.T().Fatal("Table", err)
+		}
+		s.Nil(tbl.SetWithMeta(key, val, nil), "Should have no error from SetWithMeta")
+		got, err := tbl.Get(key)
+		s.Nil(err, "Should have no error from Get with %v", spec.name)
+		s.Equal(val, got, "Should have value with %v", spec.name)
+
+		s.corrupt(tbl, key)
+		got, err = tbl.Get(key)
+		s.Equal(spec.err, err, "Should have expected error with %v", spec.name)
+		s.Equal(spec.val, got, "Should have expected value with %v", spec.name)
+
+		path := filepath.Join(tbl.path, key+recExt)
+		matches, _ := filepath.Glob(filepath.Join(tbl.path, quarantineDir, key+recExt+".*"))
+		if spec.moved {
+			s.fileNotExists(path)
+			s.Len(matches, 1, "Should have quarantined file with %v", spec.name)
+		} else {
+			s.FileExists(path, "Should still have file with %v", spec.name)
+			s.Len(matches, 0, "Should have no quarantined file with %v", spec.name)
+		}
+	}
+
+	// A bad envelope should always be corrupt.
+	path := filepath.Join(s.db.root.path, key+recExt)
+	if err := ioutil.WriteFile(path, []byte(envMagic), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err := s.db.Get(key)
+	s.Nil(got, "Should have no value for bad envelope")
+	s.Equal(ErrCorrupt, err, "Should have ErrCorrupt for bad envelope")
+
+	// Quarantine should leave a valid record in place.
+	s.Nil(s.db.SetWithMeta(key, val, nil), "Should have no error from SetWithMeta")
+	moved, err := s.db.root.quarantine(key)
+	s.Nil(err, "Should have no error from quarantine")
+	s.False(moved, "Should not have quarantined valid record")
+	s.FileExists(path, "Should still have valid record")
+}
+
+func (s *TS) TestScrub() {
+	db, err := New(s.dir, time.Millisecond, WithVerifyPolicy(VerifyQuarantine))
+	if err != nil {
+		s.T().Fatal("New", err)
+	}
+
+	// Fill out a few tables.
+	tables := map[string]*Table{"": db.root}
+	for _, name := range []string{"foo", "bar", filepath.Join("foo", "baz")} {
+		tbl, err := db.Table(name)
+		if err != nil {
+			s.T().Fatal("Table", err)
+		}
+		tables[name] = tbl
+	}
+	for _, tbl := range tables {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := tbl.SetWithMeta(key, []byte(key), nil); err != nil {
+				s.T().Fatal("SetWithMeta", err)
+			}
+		}
+		if err := tbl.Set("raw", []byte("raw")); err != nil {
+			s.T().Fatal("Set", err)
+		}
+	}
+
+	// All should be well.
+	report, err := db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Equal(&ScrubReport{Tables: 4, Records: 16}, report, "Should have clean report")
+
+	// Corrupt a couple of records.
+	s.corrupt(tables["foo"], "b")
+	path := filepath.Join(tables["bar"].path, "c"+recExt)
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte(envMagic), 2), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	report, err = db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Equal(16, report.Records, "Should have scrubbed all records")
+	s.ElementsMatch([]CorruptRecord{
+		{Table: "foo", Key: "b", Err: ErrChecksum, Quarantined: true},
+		{Table: "bar", Key: "c", Err: ErrCorrupt, Quarantined: true},
+	}, report.Corrupt, "Should have reported and quarantined corrupt records")
+
+	// They should be gone now.
+	report, err = db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Equal(&ScrubReport{Tables: 4, Records: 14}, report, "Should have clean report")
+
+	// Scrub should report without quarantining by default.
+	s.corrupt(tables["foo"], "a")
+	report, err = s.db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Equal([]CorruptRecord{{Table: "foo", Key: "a", Err: ErrChecksum}}, report.Corrupt)
+	s.FileExists(filepath.Join(tables["foo"].path, "a"+recExt), "Should not have quarantined")
+
+	// Scrub should halt when the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.Scrub(ctx)
+	s.Equal(context.Canceled, err, "Should have canceled error")
+}
+
+func (s *TS) TestRawChecksum() {
+	tbl, err := s.db.Table("raw")
+	if err != nil {
+		s.T().Fatal("Table", err)
+	}
+	key := "rotten"
+	path := filepath.Join(tbl.path, key+recExt)
+	sumPath := filepath.Join(tbl.path, sumsDir, key+sumExt)
+
+	// Setting a raw record should store its checksum.
+	s.Nil(tbl.Set(key, []byte("hello")), "Should have no error from Set")
+	s.FileExists(sumPath, "Should have checksum file")
+	got, err := tbl.Get(key)
+	s.Nil(err, "Should have no error from Get")
+	s.Equal("hello", string(got), "Should have value")
+
+	// Bit rot should fail verification.
+	s.corrupt(tbl, key)
+	got, err = tbl.Get(key)
+	s.Equal(ErrChecksum, err, "Should have ErrChecksum for corrupt raw record")
+	s.Nil(got, "Should have no value for corrupt raw record")
+	report, err := s.db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Equal([]CorruptRecord{{Table: "raw", Key: key, Err: ErrChecksum}}, report.Corrupt)
+	s.Equal(0, report.Unverified, "Should have verified the raw record")
+
+	// A file replaced by another program should be unverified.
+	if err := ioutil.WriteFile(path, []byte("goodbye"), 0600); err != nil {
+		s.T().Fatal("WriteFile", err)
+	}
+	got, err = tbl.Get(key)
+	s.Nil(err, "Should have no error from Get for replaced record")
+	s.Equal("goodbye", string(got), "Should have replaced value")
+	report, err = s.db.Scrub(context.Background())
+	s.Nil(err, "Should have no error from Scrub")
+	s.Empty(report.Corrupt, "Should have no corrupt records")
+	s.Equal(1, report.Unverified, "Should have unverified replaced record")
+
+	// Envelopes carry their own checksums.
+	s.Nil(tbl.SetWithMeta(key, []byte("hello"), nil), "Should have no error from SetWithMeta")
+	s.fileNotExists(sumPath)
+
+	// Delete should remove the checksum.
+	s.Nil(tbl.Set(key, []byte("hello")), "Should have no error from Set")
+	s.FileExists(sumPath, "Should have checksum file")
+	s.Nil(tbl.Delete(key), "Should have no error from Delete")
+	s.fileNotExists(sumPath)
+	keys, err := tbl.Keys()
+	s.Nil(err, "Should have no error from Keys")
+	s.Empty(keys, "Should have no keys")
+}